@@ -1,14 +1,18 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"net/http"
 	"os"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/Pupsichekk/lenslocked/controllers"
 	"github.com/Pupsichekk/lenslocked/migrations"
 	"github.com/Pupsichekk/lenslocked/models"
+	"github.com/Pupsichekk/lenslocked/rand"
 	"github.com/Pupsichekk/lenslocked/templates"
 	"github.com/Pupsichekk/lenslocked/views"
 	"github.com/go-chi/chi/v5"
@@ -24,13 +28,39 @@ type config struct {
 		Key    string
 		Secure bool
 	}
+	// UnlockKey signs the cookies of visitors who entered the password of a
+	// gallery.
+	UnlockKey string
+
 	Server struct {
 		Address string
+		// BaseURL is the URL the site is reached at, without a trailing
+		// slash. Links in emails and share links start with it.
+		BaseURL string
 	}
 	SSL struct {
 		cert string
 		key  string
 	}
+	Storage struct {
+		// Backend is either "local" or "s3", defaults to "local"
+		Backend   string
+		ImagesDir string
+		S3        models.S3Config
+	}
+	Passkey models.PasskeyConfig
+	Session struct {
+		IdleTimeout             time.Duration
+		AbsoluteTimeout         time.Duration
+		RememberIdleTimeout     time.Duration
+		RememberAbsoluteTimeout time.Duration
+	}
+	Upload struct {
+		Limits models.UploadLimits
+		// MaxResumableSize is the largest file that can be uploaded in parts,
+		// it is not restricted by Limits.MaxFileSize.
+		MaxResumableSize int64
+	}
 }
 
 func loadEnvConfig() (config, error) {
@@ -64,15 +94,129 @@ func loadEnvConfig() (config, error) {
 
 	cfg.CSRF.Key = os.Getenv("CSRF_KEY")
 	cfg.CSRF.Secure = os.Getenv("CSRF_SECURE") == "true"
+	cfg.UnlockKey = os.Getenv("UNLOCK_KEY")
 
 	cfg.Server.Address = os.Getenv("SERVER_ADDRESS")
+	cfg.Server.BaseURL = strings.TrimSuffix(os.Getenv("SERVER_BASE_URL"), "/")
+	if cfg.Server.BaseURL == "" {
+		cfg.Server.BaseURL = "https://localhost"
+	}
 
 	cfg.SSL.cert = os.Getenv("SSL_CERT")
 	cfg.SSL.key = os.Getenv("SSL_KEY")
+
+	cfg.Storage.Backend = os.Getenv("STORAGE_BACKEND")
+	cfg.Storage.ImagesDir = os.Getenv("IMAGES_DIR")
+	cfg.Storage.S3 = models.S3Config{
+		Endpoint:  os.Getenv("S3_ENDPOINT"),
+		Region:    os.Getenv("S3_REGION"),
+		Bucket:    os.Getenv("S3_BUCKET"),
+		AccessKey: os.Getenv("S3_ACCESS_KEY"),
+		SecretKey: os.Getenv("S3_SECRET_KEY"),
+		UseSSL:    os.Getenv("S3_USE_SSL") == "true",
+	}
+
+	cfg.Passkey.RPID = os.Getenv("PASSKEY_RP_ID")
+	if cfg.Passkey.RPID == "" {
+		cfg.Passkey.RPID = "localhost"
+	}
+	cfg.Passkey.Origin = os.Getenv("PASSKEY_ORIGIN")
+	if cfg.Passkey.Origin == "" {
+		cfg.Passkey.Origin = cfg.Server.BaseURL
+	}
+
+	cfg.Session.IdleTimeout, err = envDuration("SESSION_IDLE_TIMEOUT")
+	if err != nil {
+		return cfg, err
+	}
+	cfg.Session.AbsoluteTimeout, err = envDuration("SESSION_ABSOLUTE_TIMEOUT")
+	if err != nil {
+		return cfg, err
+	}
+	cfg.Session.RememberIdleTimeout, err = envDuration("SESSION_REMEMBER_IDLE_TIMEOUT")
+	if err != nil {
+		return cfg, err
+	}
+	cfg.Session.RememberAbsoluteTimeout, err = envDuration("SESSION_REMEMBER_ABSOLUTE_TIMEOUT")
+	if err != nil {
+		return cfg, err
+	}
+
+	cfg.Upload.Limits.MaxFileSize, err = envBytes("UPLOAD_MAX_FILE_SIZE")
+	if err != nil {
+		return cfg, err
+	}
+	cfg.Upload.Limits.MaxRequestSize, err = envBytes("UPLOAD_MAX_REQUEST_SIZE")
+	if err != nil {
+		return cfg, err
+	}
+	cfg.Upload.Limits.MaxUserSize, err = envBytes("UPLOAD_MAX_USER_SIZE")
+	if err != nil {
+		return cfg, err
+	}
+	cfg.Upload.Limits.MaxArchiveSize, err = envBytes("UPLOAD_MAX_ARCHIVE_SIZE")
+	if err != nil {
+		return cfg, err
+	}
+	if entries := os.Getenv("UPLOAD_MAX_ARCHIVE_ENTRIES"); entries != "" {
+		cfg.Upload.Limits.MaxArchiveEntries, err = strconv.Atoi(entries)
+		if err != nil {
+			return cfg, fmt.Errorf("UPLOAD_MAX_ARCHIVE_ENTRIES needs to be a number: %q", entries)
+		}
+	}
+	cfg.Upload.MaxResumableSize, err = envBytes("UPLOAD_MAX_RESUMABLE_SIZE")
+	if err != nil {
+		return cfg, err
+	}
 	return cfg, nil
 }
 
+// envBytes reads a size in bytes from the named environment variable,
+// returning 0 if it isn't set.
+func envBytes(name string) (int64, error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return 0, nil
+	}
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("%s needs to be a number of bytes: %q", name, value)
+	}
+	return n, nil
+}
+
+// envDuration reads a duration such as "2h" from the named environment
+// variable, returning 0 if it isn't set.
+func envDuration(name string) (time.Duration, error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("%s needs to be a duration like 2h: %q", name, value)
+	}
+	return d, nil
+}
+
+// sweep calls deleteExpired every interval, to delete sessions, uploads and
+// the like that expired.
+func sweep(interval time.Duration, deleteExpired func() (int64, error)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		_, err := deleteExpired()
+		if err != nil {
+			fmt.Println(err)
+		}
+	}
+}
+
 func main() {
+	importImages := flag.Bool("import-images", false,
+		"record images stored before the images table existed, then exit. "+
+			"This happens on its own the first time the server starts")
+	flag.Parse()
 	cfg, err := loadEnvConfig()
 	if err != nil {
 		panic(err)
@@ -93,15 +237,88 @@ func main() {
 		DB: db,
 	}
 	sessionService := &models.SessionService{
-		DB: db,
+		DB:                      db,
+		IdleTimeout:             cfg.Session.IdleTimeout,
+		AbsoluteTimeout:         cfg.Session.AbsoluteTimeout,
+		RememberIdleTimeout:     cfg.Session.RememberIdleTimeout,
+		RememberAbsoluteTimeout: cfg.Session.RememberAbsoluteTimeout,
 	}
+	go sweep(time.Hour, sessionService.DeleteExpired)
 	pwResetService := &models.PasswordResetService{
 		DB: db,
 	}
+	twoFactorService := &models.TwoFactorService{
+		DB: db,
+	}
+	passkeyService, err := models.NewPasskeyService(db, cfg.Passkey)
+	if err != nil {
+		panic(err)
+	}
 	emailService := models.NewEmailService(cfg.SMTP)
+	var storage models.Storage
+	switch cfg.Storage.Backend {
+	case "", "local":
+		storage = &models.LocalStorage{
+			Dir: cfg.Storage.ImagesDir,
+		}
+	case "s3":
+		storage, err = models.NewS3Storage(cfg.Storage.S3)
+		if err != nil {
+			panic(err)
+		}
+	default:
+		panic(fmt.Errorf("unknown storage backend: %v", cfg.Storage.Backend))
+	}
+	unlockKey := []byte(cfg.UnlockKey)
+	if len(unlockKey) == 0 {
+		// Visitors need to enter gallery passwords again after a restart.
+		unlockKey, err = rand.Bytes(32)
+		if err != nil {
+			panic(err)
+		}
+	}
 	galleryService := &models.GalleryService{
+		DB:        db,
+		Storage:   storage,
+		UnlockKey: unlockKey,
+	}
+	// Images stored before the images table existed are imported the first
+	// time the server starts with it, before any new image can be added.
+	hasImages, err := galleryService.HasImages()
+	if err != nil {
+		panic(err)
+	}
+	if *importImages || !hasImages {
+		n, err := galleryService.ImportLegacyImages()
+		if err != nil {
+			panic(err)
+		}
+		if *importImages || n > 0 {
+			fmt.Printf("Imported %d images\n", n)
+		}
+		if *importImages {
+			return
+		}
+	}
+	shareService := &models.ShareService{
+		DB: db,
+	}
+	go sweep(time.Hour, shareService.DeleteExpired)
+	organizationService := &models.OrganizationService{
+		DB: db,
+	}
+	transferService := &models.TransferService{
 		DB: db,
 	}
+	auditService := &models.AuditService{
+		DB: db,
+	}
+	uploadService := &models.UploadService{
+		DB:      db,
+		Storage: storage,
+		MaxSize: cfg.Upload.MaxResumableSize,
+	}
+	go sweep(time.Hour, uploadService.DeleteExpired)
 
 	// Setup middleware
 	umw := controllers.UserMiddleware{
@@ -121,16 +338,46 @@ func main() {
 		PasswordResetService: pwResetService,
 		EmailService:         emailService,
 		GalleryService:       galleryService,
+		TwoFactorService:     twoFactorService,
+		PasskeyService:       passkeyService,
+		TwoFactorAttempts: &controllers.AttemptLimiter{
+			Max:    5,
+			Window: 15 * time.Minute,
+		},
+		BaseURL: cfg.Server.BaseURL,
 	}
 	usersC.Templates.New = views.Must(views.ParseFS(templates.FS, "signup.gohtml", "tailwind.gohtml"))
-	usersC.Templates.SignIn = views.Must(views.ParseFS(templates.FS, "signin.gohtml", "tailwind.gohtml"))
+	usersC.Templates.SignIn = views.Must(views.ParseFS(templates.FS,
+		"signin.gohtml", "passkey.gohtml", "tailwind.gohtml"))
 	usersC.Templates.ForgotPassword = views.Must(views.ParseFS(templates.FS, "forgot-pw.gohtml", "tailwind.gohtml"))
 	usersC.Templates.CheckYourEmail = views.Must(views.ParseFS(templates.FS,
 		"check-your-email.gohtml", "tailwind.gohtml"))
 	usersC.Templates.ResetPassword = views.Must(views.ParseFS(templates.FS,
 		"reset-pw.gohtml", "tailwind.gohtml"))
+	usersC.Templates.CurrentUser = views.Must(views.ParseFS(templates.FS,
+		"me.gohtml", "tailwind.gohtml"))
+	usersC.Templates.Sessions = views.Must(views.ParseFS(templates.FS,
+		"sessions.gohtml", "tailwind.gohtml"))
+	usersC.Templates.TwoFactor = views.Must(views.ParseFS(templates.FS,
+		"two-factor.gohtml", "tailwind.gohtml"))
+	usersC.Templates.SignInTwoFactor = views.Must(views.ParseFS(templates.FS,
+		"signin-two-factor.gohtml", "tailwind.gohtml"))
+	usersC.Templates.Passkeys = views.Must(views.ParseFS(templates.FS,
+		"passkeys.gohtml", "passkey.gohtml", "tailwind.gohtml"))
 	galleriesC := controllers.Galleries{
-		GalleryService: galleryService,
+		GalleryService:      galleryService,
+		UploadService:       uploadService,
+		ShareService:        shareService,
+		OrganizationService: organizationService,
+		TransferService:     transferService,
+		AuditService:        auditService,
+		EmailService:        emailService,
+		PasswordAttempts: &controllers.AttemptLimiter{
+			Max:    5,
+			Window: 15 * time.Minute,
+		},
+		Limits:  cfg.Upload.Limits,
+		BaseURL: cfg.Server.BaseURL,
 	}
 	galleriesC.Templates.New = views.Must(views.ParseFS(templates.FS,
 		"galleries/new.gohtml", "tailwind.gohtml"))
@@ -140,9 +387,27 @@ func main() {
 		"galleries/index.gohtml", "tailwind.gohtml"))
 	galleriesC.Templates.Show = views.Must(views.ParseFS(templates.FS,
 		"galleries/show.gohtml", "tailwind.gohtml"))
+	galleriesC.Templates.Image = views.Must(views.ParseFS(templates.FS,
+		"galleries/image.gohtml", "tailwind.gohtml"))
+	galleriesC.Templates.Unlock = views.Must(views.ParseFS(templates.FS,
+		"galleries/unlock.gohtml", "tailwind.gohtml"))
+	galleriesC.Templates.Transfer = views.Must(views.ParseFS(templates.FS,
+		"galleries/transfer.gohtml", "tailwind.gohtml"))
+	organizationsC := controllers.Organizations{
+		OrganizationService: organizationService,
+		EmailService:        emailService,
+		BaseURL:             cfg.Server.BaseURL,
+	}
+	organizationsC.Templates.Index = views.Must(views.ParseFS(templates.FS,
+		"organizations/index.gohtml", "tailwind.gohtml"))
+	organizationsC.Templates.Show = views.Must(views.ParseFS(templates.FS,
+		"organizations/show.gohtml", "tailwind.gohtml"))
+	organizationsC.Templates.Invitation = views.Must(views.ParseFS(templates.FS,
+		"organizations/invitation.gohtml", "tailwind.gohtml"))
 
 	// Setup router and routes
 	r := chi.NewRouter()
+	r.Use(controllers.MultipartCSRF)
 	r.Use(csrfMw)
 	r.Use(umw.SetUser)
 	tpl := views.Must(views.ParseFS(templates.FS, "home.gohtml", "tailwind.gohtml"))
@@ -155,6 +420,10 @@ func main() {
 	r.Post("/users", usersC.Create)
 	r.Get("/signin", usersC.SignIn)
 	r.Post("/signin", usersC.ProcessSignIn)
+	r.Get("/signin/two-factor", usersC.SignInTwoFactor)
+	r.Post("/signin/two-factor", usersC.ProcessSignInTwoFactor)
+	r.Post("/signin/passkey/begin", usersC.BeginPasskeySignIn)
+	r.Post("/signin/passkey", usersC.ProcessPasskeySignIn)
 	r.Post("/signout", usersC.ProcessSignOut)
 	r.Get("/forgot-pw", usersC.ForgotPassword)
 	r.Post("/forgot-pw", usersC.ProcessForgotPassword)
@@ -163,10 +432,27 @@ func main() {
 	r.Route("/users/me", func(r chi.Router) {
 		r.Use(umw.RequireUser)
 		r.Get("/", usersC.CurrentUser)
+		r.Post("/privacy", usersC.UpdatePrivacy)
+		r.Get("/sessions", usersC.Sessions)
+		r.Post("/sessions/{id}/revoke", usersC.RevokeSession)
+		r.Post("/sessions/revoke-others", usersC.RevokeOtherSessions)
+		r.Get("/two-factor", usersC.TwoFactor)
+		r.Get("/two-factor/qr.png", usersC.TwoFactorQR)
+		r.Post("/two-factor", usersC.EnableTwoFactor)
+		r.Post("/two-factor/disable", usersC.DisableTwoFactor)
+		r.Get("/passkeys", usersC.Passkeys)
+		r.Post("/passkeys/begin", usersC.BeginPasskeyRegistration)
+		r.Post("/passkeys", usersC.FinishPasskeyRegistration)
+		r.Post("/passkeys/{id}/delete", usersC.DeletePasskey)
 	})
+	r.Get("/share/{token}", galleriesC.OpenShareLink)
 	r.Route("/galleries", func(r chi.Router) {
 		r.Get("/{id}", galleriesC.Show)
+		r.Get("/{id}/download", galleriesC.Download)
+		r.Get("/{id}/unlock", galleriesC.Unlock)
+		r.Post("/{id}/unlock", galleriesC.ProcessUnlock)
 		r.Get("/{id}/images/{filename}", galleriesC.Image)
+		r.Get("/{id}/images/{filename}/info", galleriesC.ImageInfo)
 		// http forms are whacky, have to use post, otherwise would've used normal methods
 		r.Group(func(r chi.Router) {
 			r.Use(umw.RequireUser)
@@ -176,10 +462,48 @@ func main() {
 			r.Get("/{id}/edit", galleriesC.Edit)
 			r.Post("/{id}", galleriesC.Update)
 			r.Post("/{id}/delete", galleriesC.Delete)
+			r.Post("/{id}/slug", galleriesC.ResetSlug)
+			r.Post("/{id}/password", galleriesC.UpdatePassword)
+			r.Post("/{id}/shares", galleriesC.CreateShareLink)
+			r.Post("/{id}/shares/{shareID}/revoke", galleriesC.RevokeShareLink)
+			r.Post("/{id}/collaborators", galleriesC.AddCollaborator)
+			r.Post("/{id}/collaborators/{userID}/remove", galleriesC.RemoveCollaborator)
+			r.Post("/{id}/albums", galleriesC.CreateAlbum)
+			r.Post("/{id}/transfer", galleriesC.StartTransfer)
+			r.Post("/{id}/transfer/cancel", galleriesC.CancelTransfer)
+			r.Get("/{id}/images/{filename}/original", galleriesC.DownloadOriginal)
 			r.Post("/{id}/images/{filename}/delete", galleriesC.DeleteImage)
+			r.Post("/{id}/images/{filename}", galleriesC.UpdateImage)
+			r.Post("/{id}/images/{filename}/cover", galleriesC.SetCover)
+			r.Post("/{id}/images/{filename}/move", galleriesC.MoveImage)
+			r.Post("/{id}/images/order", galleriesC.ReorderImages)
 			r.Post("/{id}/images", galleriesC.UploadImage)
+			// Resumable uploads using the tus protocol
+			r.Options("/{id}/uploads", galleriesC.UploadOptions)
+			r.Post("/{id}/uploads", galleriesC.CreateUpload)
+			r.Head("/{id}/uploads/{uploadID}", galleriesC.UploadOffset)
+			r.Patch("/{id}/uploads/{uploadID}", galleriesC.ContinueUpload)
+			r.Delete("/{id}/uploads/{uploadID}", galleriesC.CancelUpload)
 		})
 	})
+	r.Route("/transfers/{token}", func(r chi.Router) {
+		r.Use(umw.RequireUser)
+		r.Get("/", galleriesC.Transfer)
+		r.Post("/", galleriesC.AcceptTransfer)
+	})
+	r.Route("/organizations", func(r chi.Router) {
+		r.Use(umw.RequireUser)
+		r.Get("/", organizationsC.Index)
+		r.Post("/", organizationsC.Create)
+		r.Get("/{id}", organizationsC.Show)
+		r.Post("/{id}/invitations", organizationsC.Invite)
+		r.Post("/{id}/invitations/{invitationID}/revoke", organizationsC.RevokeInvitation)
+		r.Post("/{id}/delete", organizationsC.Delete)
+		r.Post("/{id}/members/{userID}/role", organizationsC.SetMemberRole)
+		r.Post("/{id}/members/{userID}/remove", organizationsC.RemoveMember)
+		r.Get("/invitations/{token}", organizationsC.Invitation)
+		r.Post("/invitations/{token}", organizationsC.AcceptInvitation)
+	})
 	r.NotFound(func(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Page not found", http.StatusNotFound)
 	})
@@ -0,0 +1,93 @@
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/Pupsichekk/lenslocked/models"
+)
+
+// Album is an album listed on the page of the gallery it is in.
+type Album struct {
+	// Ref identifies the album in URLs.
+	Ref   string
+	ID    int
+	Title string
+	// Cover is nil for albums without images.
+	Cover *Image
+}
+
+// Breadcrumb links to one of the galleries an album is in.
+type Breadcrumb struct {
+	Ref   string
+	Title string
+}
+
+// CreateAlbum creates an album inside a gallery. Albums can be nested in
+// other albums.
+func (g Galleries) CreateAlbum(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryByID(w, r, g.userMustHaveRole(models.RoleEditor))
+	if err != nil {
+		return
+	}
+	album, err := g.GalleryService.CreateAlbum(gallery, r.FormValue("title"))
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, fmt.Sprintf("/galleries/%d/edit", album.ID), http.StatusFound)
+}
+
+// albumsOf returns the albums directly inside gallery.
+func (g Galleries) albumsOf(r *http.Request, gallery *models.Gallery) ([]Album, error) {
+	albums, err := g.GalleryService.Albums(gallery)
+	if err != nil {
+		return nil, err
+	}
+	var converted []Album
+	for _, album := range albums {
+		converted = append(converted, Album{
+			Ref:   galleryRef(r, &album),
+			ID:    album.ID,
+			Title: album.Title,
+		})
+		cover, err := g.GalleryService.Cover(&album)
+		switch {
+		case err == nil:
+			image := convertImage(r, cover, &album)
+			converted[len(converted)-1].Cover = &image
+		case !errors.Is(err, models.ErrNotFound):
+			return nil, err
+		}
+	}
+	return converted, nil
+}
+
+// breadcrumbs returns links to the galleries gallery is in, starting with its
+// root gallery.
+func (g Galleries) breadcrumbs(r *http.Request, gallery *models.Gallery) ([]Breadcrumb, error) {
+	ancestors, err := g.GalleryService.Ancestors(gallery)
+	if err != nil {
+		return nil, err
+	}
+	var crumbs []Breadcrumb
+	for _, ancestor := range ancestors {
+		crumbs = append(crumbs, Breadcrumb{
+			Ref:   galleryRef(r, &ancestor),
+			Title: ancestor.Title,
+		})
+	}
+	return crumbs, nil
+}
+
+// galleryMustBeTopLevel makes sure the gallery isn't an album. Albums share
+// the settings of their root gallery, which can only be changed there.
+func galleryMustBeTopLevel(w http.ResponseWriter, r *http.Request, gallery *models.Gallery) error {
+	if gallery.IsAlbum() {
+		http.Error(w, "Albums share the settings of the gallery they are in", http.StatusBadRequest)
+		return fmt.Errorf("gallery is an album")
+	}
+	return nil
+}
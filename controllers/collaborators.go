@@ -0,0 +1,68 @@
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/Pupsichekk/lenslocked/context"
+	apperrors "github.com/Pupsichekk/lenslocked/errors"
+	"github.com/Pupsichekk/lenslocked/models"
+	"github.com/go-chi/chi/v5"
+)
+
+// AddCollaborator gives an existing user a role in a gallery, or changes the
+// role they have already.
+func (g Galleries) AddCollaborator(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryByID(w, r, g.userMustHaveRole(models.RoleOwner), galleryMustBeTopLevel)
+	if err != nil {
+		return
+	}
+	role := models.Role(r.FormValue("role"))
+	if !role.Assignable() {
+		http.Error(w, "Invalid role", http.StatusBadRequest)
+		return
+	}
+	email := r.FormValue("email")
+	if strings.EqualFold(email, context.User(r.Context()).Email) {
+		err = apperrors.Public(fmt.Errorf("add collaborator: user owns the gallery"),
+			"You already own this gallery.")
+		g.renderEdit(w, r, gallery, editNotices{}, err)
+		return
+	}
+	err = g.GalleryService.AddCollaborator(gallery, email, role)
+	if err != nil {
+		if errors.Is(err, models.ErrNotFound) {
+			err = apperrors.Public(err, "There is no account with that email address.")
+			g.renderEdit(w, r, gallery, editNotices{}, err)
+			return
+		}
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	editPath := fmt.Sprintf("/galleries/%d/edit", gallery.ID)
+	http.Redirect(w, r, editPath, http.StatusFound)
+}
+
+func (g Galleries) RemoveCollaborator(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryByID(w, r, g.userMustHaveRole(models.RoleOwner), galleryMustBeTopLevel)
+	if err != nil {
+		return
+	}
+	userID, err := strconv.Atoi(chi.URLParam(r, "userID"))
+	if err != nil {
+		http.Error(w, "Collaborator not found", http.StatusNotFound)
+		return
+	}
+	err = g.GalleryService.RemoveCollaborator(gallery.ID, userID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	editPath := fmt.Sprintf("/galleries/%d/edit", gallery.ID)
+	http.Redirect(w, r, editPath, http.StatusFound)
+}
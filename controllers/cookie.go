@@ -3,10 +3,25 @@ package controllers
 import (
 	"fmt"
 	"net/http"
+	"time"
+
+	"github.com/Pupsichekk/lenslocked/models"
 )
 
 const (
 	CookieSession = "session"
+	// CookieShare holds the token of the share link a gallery was opened
+	// with. There is one per gallery, named by galleryCookie.
+	CookieShare = "share"
+	// CookieUnlock proves the password of a gallery was entered. There is
+	// one per gallery, named by galleryCookie.
+	CookieUnlock = "unlock"
+	// CookieTwoFactor holds the token of a sign in waiting for a two-factor
+	// authentication code.
+	CookieTwoFactor = "two-factor"
+	// CookiePasskey holds the token of a passkey registration or sign in
+	// waiting for the browser to respond.
+	CookiePasskey = "passkey"
 )
 
 func newCookie(name, value string) *http.Cookie {
@@ -15,15 +30,41 @@ func newCookie(name, value string) *http.Cookie {
 		Value:    value,
 		Path:     "/",
 		HttpOnly: true,
+		Secure:   true,
+		SameSite: http.SameSiteLaxMode,
 	}
 	return &cookie
 }
 
+// newGalleryCookie returns a cookie for a gallery and the albums inside it,
+// which all have paths of their own. The cookie is named after the root
+// gallery, so cookies of different galleries don't replace each other.
+func newGalleryCookie(name string, gallery *models.Gallery, value string) *http.Cookie {
+	cookie := newCookie(galleryCookie(name, gallery), value)
+	cookie.Path = "/galleries/"
+	return cookie
+}
+
+// galleryCookie returns the name of the cookie called name for gallery.
+func galleryCookie(name string, gallery *models.Gallery) string {
+	return fmt.Sprintf("%s-%d", name, gallery.RootID)
+}
+
 func setCookie(w http.ResponseWriter, name, value string) {
 	cookie := newCookie(name, value)
 	http.SetCookie(w, cookie)
 }
 
+// setSessionCookie sets the session cookie. It lasts for maxAge, or until the
+// browser is closed if maxAge is 0.
+func setSessionCookie(w http.ResponseWriter, token string, maxAge time.Duration) {
+	cookie := newCookie(CookieSession, token)
+	if maxAge > 0 {
+		cookie.MaxAge = max(int(maxAge.Seconds()), 1)
+	}
+	http.SetCookie(w, cookie)
+}
+
 func readCookie(r *http.Request, name string) (string, error) {
 	cookie, err := r.Cookie(name)
 	if err != nil {
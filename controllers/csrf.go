@@ -0,0 +1,50 @@
+package controllers
+
+import (
+	"bytes"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+)
+
+const (
+	// These match the defaults of gorilla/csrf.
+	csrfFieldName  = "gorilla.csrf.Token"
+	csrfHeaderName = "X-CSRF-Token"
+
+	maxCSRFTokenSize = 1024
+)
+
+// MultipartCSRF lets the CSRF middleware check multipart forms without
+// parsing them. Otherwise it would read every uploaded file into memory or
+// temporary files before the handler gets to stream them. The CSRF field has
+// to be the first field of the form. Its value is copied into the CSRF request
+// header and the body is left untouched, so it needs to run before the CSRF
+// middleware.
+func MultipartCSRF(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mediaType, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		if err != nil || mediaType != "multipart/form-data" || r.Header.Get(csrfHeaderName) != "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		// Everything read while looking for the token is kept, so it can be
+		// put back in front of the rest of the body.
+		body := r.Body
+		var read bytes.Buffer
+		mr := multipart.NewReader(io.TeeReader(body, &read), params["boundary"])
+		part, err := mr.NextPart()
+		if err == nil && part.FormName() == csrfFieldName && part.FileName() == "" {
+			token, err := io.ReadAll(io.LimitReader(part, maxCSRFTokenSize))
+			if err == nil {
+				r.Header.Set(csrfHeaderName, string(token))
+			}
+		}
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(&read, body), body}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,143 @@
+package controllers
+
+import (
+	"archive/zip"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/Pupsichekk/lenslocked/models"
+)
+
+// Download streams a ZIP archive of every image in a gallery, with the images
+// of its albums in folders named after them. The owner and collaborators get
+// the images as they were uploaded, visitors get the same files the gallery
+// shows them. If the size param is set, the renditions of that size are
+// archived instead.
+func (g Galleries) Download(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryByID(w, r, g.galleryMayBeDownloaded)
+	if err != nil {
+		return
+	}
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{
+		"filename": archiveName(gallery),
+	}))
+	zw := zip.NewWriter(w)
+	err = g.archiveGallery(zw, r, gallery, "", make(map[string]bool))
+	if err != nil {
+		// The response has already started, so all that can be done is
+		// logging the error. The client ends up with a truncated archive.
+		fmt.Println(err)
+		return
+	}
+	err = zw.Close()
+	if err != nil {
+		fmt.Println(err)
+	}
+}
+
+// archiveGallery writes the images of gallery to zw in the folder dir, and
+// the images of its albums in folders inside it. names holds the names used
+// in the archive so far.
+func (g Galleries) archiveGallery(zw *zip.Writer, r *http.Request, gallery *models.Gallery, dir string, names map[string]bool) error {
+	// Albums share the roles of their root gallery.
+	isMember := g.roleIn(r, gallery).Includes(models.RoleViewer)
+	strip := false
+	var err error
+	if !isMember {
+		strip, err = g.GalleryService.StripsMetadata(gallery)
+		if err != nil {
+			return fmt.Errorf("archive gallery: %w", err)
+		}
+	}
+	// An invalid or missing size archives the full size images.
+	size, _ := strconv.Atoi(r.FormValue("size"))
+	images, err := g.GalleryService.Images(gallery.ID)
+	if err != nil {
+		return fmt.Errorf("archive gallery: %w", err)
+	}
+	for _, image := range images {
+		var obj *models.StorageObject
+		if isMember && size <= 0 {
+			obj, err = g.GalleryService.OriginalContent(image)
+		} else {
+			obj, err = g.GalleryService.ImageContent(image, size)
+		}
+		if err != nil {
+			// A single missing file shouldn't make the whole gallery
+			// impossible to download.
+			fmt.Println(err)
+			continue
+		}
+		err = writeArchiveImage(zw, uniqueName(names, dir+image.Filename), image, obj, strip)
+		obj.Close()
+		if err != nil {
+			return err
+		}
+	}
+	albums, err := g.GalleryService.Albums(gallery)
+	if err != nil {
+		return fmt.Errorf("archive gallery: %w", err)
+	}
+	for _, album := range albums {
+		albumDir := uniqueName(names, dir+strings.TrimSuffix(archiveName(&album), ".zip")) + "/"
+		err = g.archiveGallery(zw, r, &album, albumDir, names)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeArchiveImage(zw *zip.Writer, name string, image models.Image, obj *models.StorageObject, strip bool) error {
+	// Images are compressed already, compressing them again only costs time.
+	fw, err := zw.CreateHeader(&zip.FileHeader{
+		Name:     name,
+		Method:   zip.Store,
+		Modified: image.UploadedAt,
+	})
+	if err != nil {
+		return fmt.Errorf("archive image %v: %w", image.Filename, err)
+	}
+	if strip {
+		err = models.StripMetadata(fw, obj, image.ContentType)
+	} else {
+		_, err = io.Copy(fw, obj)
+	}
+	if err != nil {
+		return fmt.Errorf("archive image %v: %w", image.Filename, err)
+	}
+	return nil
+}
+
+// uniqueName returns filename, numbered if it is in names already, and adds
+// it to names. Several images of a gallery can share a filename.
+func uniqueName(names map[string]bool, filename string) string {
+	name := filename
+	ext := path.Ext(filename)
+	for i := 2; names[name]; i++ {
+		name = fmt.Sprintf("%s (%d)%s", strings.TrimSuffix(filename, ext), i, ext)
+	}
+	names[name] = true
+	return name
+}
+
+// archiveName returns the filename of the archive of a gallery, based on its
+// title.
+func archiveName(gallery *models.Gallery) string {
+	name := strings.Map(func(r rune) rune {
+		if strings.ContainsRune(`/\:*?"<>|`, r) || r < ' ' {
+			return '_'
+		}
+		return r
+	}, strings.TrimSpace(gallery.Title))
+	if name == "" {
+		name = fmt.Sprintf("gallery-%d", gallery.ID)
+	}
+	return name + ".zip"
+}
@@ -1,12 +1,18 @@
 package controllers
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
 	"net/http"
 	"net/url"
+	"os"
 	"path/filepath"
 	"strconv"
+	"strings"
 
 	"github.com/Pupsichekk/lenslocked/context"
 	"github.com/Pupsichekk/lenslocked/models"
@@ -15,37 +21,102 @@ import (
 
 type Galleries struct {
 	Templates struct {
-		Show  Template
-		New   Template
-		Edit  Template
-		Index Template
+		Show     Template
+		New      Template
+		Edit     Template
+		Index    Template
+		Image    Template
+		Unlock   Template
+		Transfer Template
 	}
 	GalleryService *models.GalleryService
+	UploadService  *models.UploadService
+	ShareService   *models.ShareService
+	// OrganizationService is used to find the organizations galleries can
+	// be created for.
+	OrganizationService *models.OrganizationService
+	TransferService     *models.TransferService
+	AuditService        *models.AuditService
+	EmailService        *models.EmailService
+	// PasswordAttempts limits how often visitors can enter a wrong gallery
+	// password.
+	PasswordAttempts *AttemptLimiter
+	// Limits restrict the size of images uploaded through the upload form.
+	// The storage limit per user applies to resumable uploads as well.
+	Limits models.UploadLimits
+	// BaseURL is the URL the site is served from, e.g.
+	// "https://example.com", used for links that are sent to people.
+	BaseURL string
 }
 
 type Image struct {
-	GalleryID       int
-	Filename        string
-	FilenameEscaped string
+	// GalleryRef identifies the gallery of the image in URLs.
+	GalleryRef string
+	// UID identifies the image in URLs.
+	UID      string
+	Filename string
+	// SrcSet lists the renditions and the original of the image in the
+	// format of the img srcset attribute.
+	SrcSet  string
+	Caption string
+	AltText string
+	// IsCover is true for the image the owner chose as the gallery cover.
+	IsCover bool
 }
 
 func (g Galleries) New(w http.ResponseWriter, r *http.Request) {
 	var data struct {
-		Title string
+		Title          string
+		OrganizationID int
+		// Organizations are the organizations the user can create the
+		// gallery for instead of themselves.
+		Organizations []models.Organization
 	}
 	data.Title = r.FormValue("title")
+	data.OrganizationID, _ = strconv.Atoi(r.FormValue("organization_id"))
+	var err error
+	data.Organizations, err = g.OrganizationService.ByUserID(context.User(r.Context()).ID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
 	g.Templates.New.Execute(w, r, data)
 }
 
+// Create creates a gallery for the user making the request, or for one of
+// their organizations if the organization_id param is set.
 func (g Galleries) Create(w http.ResponseWriter, r *http.Request) {
 	var data struct {
-		Title  string
-		UserID int
+		Title          string
+		UserID         int
+		OrganizationID int
+		Organizations  []models.Organization
 	}
 	data.UserID = context.User(r.Context()).ID
 	data.Title = r.FormValue("title")
-	gallery, err := g.GalleryService.Create(data.Title, data.UserID)
+	if orgID := r.FormValue("organization_id"); orgID != "" {
+		id, err := strconv.Atoi(orgID)
+		if err != nil {
+			http.Error(w, "Organization not found", http.StatusNotFound)
+			return
+		}
+		// Any member can create galleries for their organization.
+		org, err := g.OrganizationService.ByID(id, data.UserID)
+		if err != nil {
+			if errors.Is(err, models.ErrNotFound) {
+				http.Error(w, "Organization not found", http.StatusNotFound)
+				return
+			}
+			fmt.Println(err)
+			http.Error(w, "Something went wrong", http.StatusInternalServerError)
+			return
+		}
+		data.OrganizationID = org.ID
+	}
+	gallery, err := g.GalleryService.Create(data.Title, data.UserID, data.OrganizationID)
 	if err != nil {
+		data.Organizations, _ = g.OrganizationService.ByUserID(data.UserID)
 		g.Templates.New.Execute(w, r, data, err)
 		return
 	}
@@ -58,48 +129,182 @@ func (g Galleries) Show(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	var data struct {
-		ID     int
+		// Ref identifies the gallery in URLs.
+		Ref    string
 		Title  string
+		Cover  *Image
 		Images []Image
+		// CanDownload is false for visitors using a share link that only
+		// allows viewing the gallery.
+		CanDownload bool
+		Breadcrumbs []Breadcrumb
+		Albums      []Album
 	}
-	data.ID = gallery.ID
+	data.Ref = galleryRef(r, gallery)
+	data.CanDownload = g.canDownloadGallery(r, gallery)
 	data.Title = gallery.Title
-	data.Images, err = g.imagesByID(gallery.ID)
+	data.Images, err = g.imagesByID(r, gallery)
 	if err != nil {
 		http.Error(w, "Something went wrong", http.StatusInternalServerError)
 		return
 	}
+	data.Breadcrumbs, err = g.breadcrumbs(r, gallery)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	data.Albums, err = g.albumsOf(r, gallery)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	for i := range data.Images {
+		if data.Images[i].IsCover {
+			data.Cover = &data.Images[i]
+		}
+	}
 	g.Templates.Show.Execute(w, r, data)
 }
 
 func (g Galleries) Edit(w http.ResponseWriter, r *http.Request) {
-	gallery, err := g.galleryByID(w, r, userMustOwnGallery)
+	gallery, err := g.galleryByID(w, r, g.userMustHaveRole(models.RoleContributor))
 	if err != nil {
 		return
 	}
+	g.renderEdit(w, r, gallery, editNotices{})
+}
+
+// editNotices are shown on the edit page after an action that can't redirect
+// back to it, because its outcome can't be looked up again.
+type editNotices struct {
+	// Upload holds the results of an upload.
+	Upload *uploadReport
+	// ShareURL is the URL of a share link that was just created, which is
+	// only known until the page is left.
+	ShareURL string
+}
+
+// renderEdit renders the edit page of gallery, along with notices about the
+// action that led to it. Only the parts the user making the request is
+// allowed to use are shown.
+func (g Galleries) renderEdit(w http.ResponseWriter, r *http.Request, gallery *models.Gallery, notices editNotices, errs ...error) {
 	var data struct {
 		ID     int
 		Title  string
 		Images []Image
+		// IsOwner is true if the user can change the settings of the
+		// gallery, share it and manage its collaborators.
+		IsOwner bool
+		// CanEdit is true if the user can edit, reorder and delete images,
+		// and create albums.
+		CanEdit bool
+		// IsAlbum is true for albums, which share the settings of their
+		// root gallery.
+		IsAlbum     bool
+		Breadcrumbs []Breadcrumb
+		Albums      []Album
+		// StripMetadata is "true" or "false" when the gallery overrides the
+		// owner's privacy setting and empty otherwise.
+		StripMetadata string
+		Visibility    models.Visibility
+		Slug          string
+		HasPassword   bool
+		ShareLinks    []models.ShareLink
+		Collaborators []models.Collaborator
+		// CanTransfer is true if the gallery can be transferred to another
+		// user, which only personal galleries can.
+		CanTransfer bool
+		// Transfer is the transfer of the gallery waiting to be accepted, if
+		// there is one.
+		Transfer *models.Transfer
+		History  []models.AuditEntry
+		editNotices
 	}
+	role := g.roleIn(r, gallery)
 	data.ID = gallery.ID
 	data.Title = gallery.Title
-	data.Images, err = g.imagesByID(gallery.ID)
+	data.IsOwner = role == models.RoleOwner
+	data.CanEdit = role.Includes(models.RoleEditor)
+	data.IsAlbum = gallery.IsAlbum()
+	data.Visibility = gallery.Visibility
+	data.Slug = gallery.Slug
+	data.HasPassword = gallery.HasPassword()
+	if gallery.StripMetadata != nil {
+		data.StripMetadata = strconv.FormatBool(*gallery.StripMetadata)
+	}
+	data.editNotices = notices
+	var err error
+	data.Images, err = g.imagesByID(r, gallery)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	data.Breadcrumbs, err = g.breadcrumbs(r, gallery)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	data.Albums, err = g.albumsOf(r, gallery)
 	if err != nil {
 		fmt.Println(err)
 		http.Error(w, "Something went wrong", http.StatusInternalServerError)
 		return
 	}
-	g.Templates.Edit.Execute(w, r, data)
+	if data.IsOwner && !data.IsAlbum {
+		data.ShareLinks, err = g.ShareService.ByGalleryID(gallery.ID)
+		if err != nil {
+			fmt.Println(err)
+			http.Error(w, "Something went wrong", http.StatusInternalServerError)
+			return
+		}
+		data.Collaborators, err = g.GalleryService.Collaborators(gallery.ID)
+		if err != nil {
+			fmt.Println(err)
+			http.Error(w, "Something went wrong", http.StatusInternalServerError)
+			return
+		}
+		data.CanTransfer = gallery.OrganizationID == 0
+		data.Transfer, err = g.TransferService.ByGalleryID(gallery.ID)
+		if err != nil && !errors.Is(err, models.ErrNotFound) {
+			fmt.Println(err)
+			http.Error(w, "Something went wrong", http.StatusInternalServerError)
+			return
+		}
+		data.History, err = g.AuditService.ByGalleryID(gallery.ID)
+		if err != nil {
+			fmt.Println(err)
+			http.Error(w, "Something went wrong", http.StatusInternalServerError)
+			return
+		}
+	}
+	g.Templates.Edit.Execute(w, r, data, errs...)
 }
 
 func (g Galleries) Update(w http.ResponseWriter, r *http.Request) {
-	gallery, err := g.galleryByID(w, r, userMustOwnGallery)
+	gallery, err := g.galleryByID(w, r, g.userMustHaveRole(models.RoleOwner))
 	if err != nil {
 		return
 	}
 
 	gallery.Title = r.FormValue("title")
+	gallery.StripMetadata = nil
+	if strip, err := strconv.ParseBool(r.FormValue("strip_metadata")); err == nil {
+		gallery.StripMetadata = &strip
+	}
+	// Albums can be seen by whoever can see their root gallery, so their
+	// visibility can't be changed on its own.
+	if !gallery.IsAlbum() {
+		visibility := models.Visibility(r.FormValue("visibility"))
+		if !visibility.Valid() {
+			http.Error(w, "Invalid visibility", http.StatusBadRequest)
+			return
+		}
+		gallery.Visibility = visibility
+	}
 	err = g.GalleryService.Update(gallery)
 	if err != nil {
 		http.Error(w, "Something went wrong", http.StatusInternalServerError)
@@ -112,13 +317,53 @@ func (g Galleries) Index(w http.ResponseWriter, r *http.Request) {
 	// TODO: Might need to check into this func further, if user is not logged in, code panics
 	// with pointer to nil error
 	type Gallery struct {
-		ID    int
-		Title string
+		ID         int
+		Title      string
+		Visibility models.Visibility
+		// Cover is nil for galleries without images.
+		Cover *Image
+		// Role is the role of the user in the gallery.
+		Role models.Role
+		// Organization is the name of the organization the gallery belongs
+		// to, empty for personal galleries.
+		Organization string
 	}
 	var data struct {
+		// Galleries are the personal galleries of the user and the
+		// galleries of their organizations.
 		Galleries []Gallery
+		// Shared are the galleries of other users the user collaborates on.
+		Shared []Gallery
 	}
 	user := context.User(r.Context())
+	orgs, err := g.OrganizationService.ByUserID(user.ID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	orgNames := make(map[int]string)
+	for _, org := range orgs {
+		orgNames[org.ID] = org.Name
+	}
+
+	toIndexGallery := func(gallery models.Gallery) (Gallery, error) {
+		indexGallery := Gallery{
+			ID:           gallery.ID,
+			Title:        gallery.Title,
+			Visibility:   gallery.Visibility,
+			Organization: orgNames[gallery.OrganizationID],
+		}
+		cover, err := g.GalleryService.Cover(&gallery)
+		switch {
+		case err == nil:
+			image := convertImage(r, cover, &gallery)
+			indexGallery.Cover = &image
+		case !errors.Is(err, models.ErrNotFound):
+			return Gallery{}, err
+		}
+		return indexGallery, nil
+	}
 
 	galleries, err := g.GalleryService.ByUserID(user.ID)
 	if err != nil {
@@ -126,18 +371,38 @@ func (g Galleries) Index(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Something went wrong", http.StatusInternalServerError)
 		return
 	}
-
 	for _, gallery := range galleries {
-		data.Galleries = append(data.Galleries, Gallery{
-			ID:    gallery.ID,
-			Title: gallery.Title,
-		})
+		indexGallery, err := toIndexGallery(gallery)
+		if err != nil {
+			fmt.Println(err)
+			http.Error(w, "Something went wrong", http.StatusInternalServerError)
+			return
+		}
+		indexGallery.Role = g.roleIn(r, &gallery)
+		data.Galleries = append(data.Galleries, indexGallery)
+	}
+
+	shared, roles, err := g.GalleryService.ByCollaborator(user.ID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	for i, gallery := range shared {
+		indexGallery, err := toIndexGallery(gallery)
+		if err != nil {
+			fmt.Println(err)
+			http.Error(w, "Something went wrong", http.StatusInternalServerError)
+			return
+		}
+		indexGallery.Role = roles[i]
+		data.Shared = append(data.Shared, indexGallery)
 	}
 	g.Templates.Index.Execute(w, r, data)
 }
 
 func (g Galleries) Delete(w http.ResponseWriter, r *http.Request) {
-	gallery, err := g.galleryByID(w, r, userMustOwnGallery)
+	gallery, err := g.galleryByID(w, r, g.userMustHaveRole(models.RoleOwner))
 	if err != nil {
 		return
 	}
@@ -146,17 +411,37 @@ func (g Galleries) Delete(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Something went wrong", http.StatusInternalServerError)
 		return
 	}
+	if gallery.IsAlbum() {
+		http.Redirect(w, r, fmt.Sprintf("/galleries/%d/edit", gallery.ParentID), http.StatusFound)
+		return
+	}
 	http.Redirect(w, r, "/galleries", http.StatusFound)
 }
 
 func (g Galleries) Image(w http.ResponseWriter, r *http.Request) {
 	filename := g.filename(w, r)
-	galleryID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	gallery, err := g.galleryByID(w, r)
 	if err != nil {
-		http.Error(w, "Invalid gallery ID", http.StatusNotFound)
 		return
 	}
-	image, err := g.GalleryService.Image(galleryID, filename)
+	image, err := g.imageByRef(w, gallery.ID, filename)
+	if err != nil {
+		return
+	}
+	// Owners and collaborators always get the images as uploaded, visitors
+	// may only get a copy without private metadata.
+	strip := false
+	if !g.roleIn(r, gallery).Includes(models.RoleViewer) {
+		strip, err = g.GalleryService.StripsMetadata(gallery)
+		if err != nil {
+			fmt.Println(err)
+			http.Error(w, "Something went wrong", http.StatusInternalServerError)
+			return
+		}
+	}
+	// An invalid or missing size serves the original.
+	size, _ := strconv.Atoi(r.FormValue("size"))
+	obj, err := g.GalleryService.ImageContent(image, size)
 	if err != nil {
 		if errors.Is(err, models.ErrNotFound) {
 			http.Error(w, "Image not found", http.StatusNotFound)
@@ -166,57 +451,467 @@ func (g Galleries) Image(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Something went wrong", http.StatusInternalServerError)
 		return
 	}
-	http.ServeFile(w, r, image.Path)
+	defer obj.Close()
+	if strip {
+		w.Header().Set("Content-Type", image.ContentType)
+		err = models.StripMetadata(w, obj, image.ContentType)
+		if err != nil {
+			// The response has already started, so all that can be done is
+			// logging the error.
+			fmt.Println(err)
+		}
+		return
+	}
+	serveObject(w, r, image.Filename, obj)
 }
 
-func (g Galleries) UploadImage(w http.ResponseWriter, r *http.Request) {
-	gallery, err := g.galleryByID(w, r, userMustOwnGallery)
+// DownloadOriginal lets the owner and collaborators of a gallery download an
+// image exactly as it was uploaded, including all of its metadata.
+func (g Galleries) DownloadOriginal(w http.ResponseWriter, r *http.Request) {
+	filename := g.filename(w, r)
+	gallery, err := g.galleryByID(w, r, g.userMustHaveRole(models.RoleViewer))
 	if err != nil {
-		http.Error(w, "Access denied", http.StatusForbidden)
 		return
 	}
-	err = r.ParseMultipartForm(5 * 1024 * 1024) // 5mb or 5 << 20
+	image, err := g.imageByRef(w, gallery.ID, filename)
 	if err != nil {
-		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	obj, err := g.GalleryService.OriginalContent(image)
+	if err != nil {
+		if errors.Is(err, models.ErrNotFound) {
+			http.Error(w, "Image not found", http.StatusNotFound)
+			return
+		}
 		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
 		return
 	}
-	fileHeaders := r.MultipartForm.File["images"]
+	defer obj.Close()
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{
+		"filename": image.Filename,
+	}))
+	serveObject(w, r, image.Filename, obj)
+}
 
-	if len(fileHeaders) == 0 {
-		editPath := fmt.Sprintf("/galleries/%d/edit", gallery.ID)
-		http.Redirect(w, r, editPath, http.StatusFound)
+func (g Galleries) ImageInfo(w http.ResponseWriter, r *http.Request) {
+	filename := g.filename(w, r)
+	gallery, err := g.galleryByID(w, r)
+	if err != nil {
+		return
 	}
-
-	for _, fileHeader := range fileHeaders {
-		file, err := fileHeader.Open()
+	image, err := g.imageByRef(w, gallery.ID, filename)
+	if err != nil {
+		return
+	}
+	isMember := g.roleIn(r, gallery).Includes(models.RoleViewer)
+	strip := false
+	if !isMember {
+		strip, err = g.GalleryService.StripsMetadata(gallery)
 		if err != nil {
 			fmt.Println(err)
 			http.Error(w, "Something went wrong", http.StatusInternalServerError)
 			return
 		}
-		defer file.Close()
-		err = g.GalleryService.CreateImage(gallery.ID, fileHeader.Filename, file)
+	}
+	var data struct {
+		GalleryRef   string
+		GalleryTitle string
+		Image        Image
+		Width        int
+		Height       int
+		Size         string
+		Exif         *models.Exif
+		// IsMember is true for the owner and collaborators of the gallery.
+		IsMember bool
+	}
+	data.GalleryRef = galleryRef(r, gallery)
+	data.GalleryTitle = gallery.Title
+	data.Image = convertImage(r, image, gallery)
+	data.Width = image.Width
+	data.Height = image.Height
+	data.Size = fmt.Sprintf("%.1f MB", float64(image.Size)/(1<<20))
+	data.Exif = image.Exif
+	if data.Exif != nil && strip {
+		exif := *data.Exif
+		exif.HasLocation = false
+		exif.Latitude, exif.Longitude = 0, 0
+		data.Exif = &exif
+	}
+	data.IsMember = isMember
+	g.Templates.Image.Execute(w, r, data)
+}
+
+// uploadResult reports what happened to one file of an upload.
+type uploadResult struct {
+	Filename string `json:"filename"`
+	Stored   bool   `json:"stored"`
+	// Archive is the name of the uploaded archive the file was imported
+	// from, if it was.
+	Archive string `json:"archive,omitempty"`
+	// UID is the UID of the stored image.
+	UID string `json:"uid,omitempty"`
+	// Error is the reason the file was rejected.
+	Error string `json:"error,omitempty"`
+}
+
+type uploadReport struct {
+	Files []uploadResult `json:"files"`
+	// Error explains why the upload stopped before every file was received.
+	Error string `json:"error,omitempty"`
+}
+
+// UploadImage streams the files of the upload form one at a time, so no
+// matter how many files are uploaded, only the one being stored is held on
+// disk. Each file is stored or rejected on its own, and the result for every
+// file is shown on the edit page, or returned as JSON to clients that accept
+// it.
+func (g Galleries) UploadImage(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryByID(w, r, g.userMustHaveRole(models.RoleContributor))
+	if err != nil {
+		return
+	}
+	// Images count towards the storage of the gallery owner, whoever
+	// uploads them.
+	used, err := g.GalleryService.StorageUsed(gallery.UserID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, g.Limits.RequestLimit())
+	mr, err := r.MultipartReader()
+	if err != nil {
+		http.Error(w, "Images need to be uploaded as a multipart form", http.StatusBadRequest)
+		return
+	}
+	report := uploadReport{
+		Files: []uploadResult{},
+	}
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
 		if err != nil {
-			var fileError models.FileError
-			if errors.As(err, &fileError) {
-				msg := fmt.Sprintf("%v has an invalid content type or extension. Only png, gif and jpg files can be uploaded", fileHeader.Filename)
-				http.Error(w, msg, http.StatusBadRequest)
-				return
+			_, report.Error = g.uploadErrorMessage("", err)
+			break
+		}
+		if part.FormName() != "images" || part.FileName() == "" {
+			continue
+		}
+		if isArchive(part.FileName()) {
+			results, size, err := g.importArchive(gallery.ID, part, used)
+			report.Files = append(report.Files, results...)
+			used += size
+			if err != nil {
+				result := uploadResult{
+					Filename: part.FileName(),
+				}
+				_, result.Error = g.uploadErrorMessage(result.Filename, err)
+				report.Files = append(report.Files, result)
+				var maxBytesErr *http.MaxBytesError
+				if errors.As(err, &maxBytesErr) {
+					report.Error = "Any further files were not received."
+					break
+				}
 			}
-			http.Error(w, "Something went wrong", http.StatusInternalServerError)
-			return
+			continue
+		}
+		result := uploadResult{
+			Filename: part.FileName(),
+		}
+		image, size, err := g.uploadPart(gallery.ID, part, used)
+		if err != nil {
+			_, result.Error = g.uploadErrorMessage(result.Filename, err)
+			report.Files = append(report.Files, result)
+			// Once the request is too large, nothing more can be read.
+			var maxBytesErr *http.MaxBytesError
+			if errors.As(err, &maxBytesErr) {
+				report.Error = "Any further files were not received."
+				break
+			}
+			continue
+		}
+		result.Stored = true
+		result.UID = image.UID
+		report.Files = append(report.Files, result)
+		used += size
+	}
+
+	if wantsJSON(r) {
+		w.Header().Set("Content-Type", "application/json")
+		err = json.NewEncoder(w).Encode(report)
+		if err != nil {
+			fmt.Println(err)
 		}
+		return
+	}
+	if len(report.Files) == 0 && report.Error == "" {
 		editPath := fmt.Sprintf("/galleries/%d/edit", gallery.ID)
 		http.Redirect(w, r, editPath, http.StatusFound)
+		return
 	}
+	g.renderEdit(w, r, gallery, editNotices{Upload: &report})
+}
+
+var (
+	errFileTooLarge = errors.New("file is larger than the upload limit")
+	errStorageLimit = errors.New("file exceeds the storage limit of the user")
+)
+
+// uploadPart spools a file of the upload form to a temporary file, enforcing
+// the size limits on the way, and adds it to the gallery. used is the number
+// of bytes the uploading user already stores.
+func (g Galleries) uploadPart(galleryID int, part *multipart.Part, used int64) (models.Image, int64, error) {
+	tmp, size, err := spool(part, g.Limits.FileLimit())
+	if err != nil {
+		return models.Image{}, 0, fmt.Errorf("upload part: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	if !g.Limits.UserAllows(used, size) {
+		return models.Image{}, 0, errStorageLimit
+	}
+	image, err := g.GalleryService.CreateImage(galleryID, part.FileName(), tmp)
+	if err != nil {
+		return models.Image{}, 0, err
+	}
+	return image, size, nil
+}
+
+// spool copies up to limit bytes from r to a temporary file, returning
+// errFileTooLarge if there is more. The gallery service needs to read the
+// contents of images more than once, to hash, decode and store them. Callers
+// need to close and remove the returned file.
+func spool(r io.Reader, limit int64) (*os.File, int64, error) {
+	tmp, err := os.CreateTemp("", "lenslocked-image-*")
+	if err != nil {
+		return nil, 0, err
+	}
+	size, err := io.Copy(tmp, io.LimitReader(r, limit+1))
+	if err == nil && size > limit {
+		err = errFileTooLarge
+	}
+	if err == nil {
+		_, err = tmp.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return nil, 0, err
+	}
+	return tmp, size, nil
+}
+
+// uploadError writes the response for a failed upload of the named file.
+func (g Galleries) uploadError(w http.ResponseWriter, filename string, err error) {
+	status, msg := g.uploadErrorMessage(filename, err)
+	http.Error(w, msg, status)
+}
+
+// uploadErrorMessage returns the status code and the message telling the
+// user why the upload of the named file failed. filename is empty if the
+// upload failed between files.
+func (g Galleries) uploadErrorMessage(filename string, err error) (int, string) {
+	var maxBytesErr *http.MaxBytesError
+	var fileError models.FileError
+	switch {
+	case errors.As(err, &maxBytesErr):
+		msg := fmt.Sprintf("The upload is larger than the maximum of %s per upload", formatBytes(maxBytesErr.Limit))
+		if filename != "" {
+			msg = fmt.Sprintf("%v could not be uploaded: %s", filename, msg)
+		}
+		return http.StatusRequestEntityTooLarge, msg
+	case errors.Is(err, errFileTooLarge):
+		msg := fmt.Sprintf("%v is larger than the maximum of %s per file", filename, formatBytes(g.Limits.FileLimit()))
+		return http.StatusRequestEntityTooLarge, msg
+	case errors.Is(err, errStorageLimit):
+		msg := fmt.Sprintf("%v would exceed your storage limit of %s", filename, formatBytes(g.Limits.MaxUserSize))
+		return http.StatusRequestEntityTooLarge, msg
+	case errors.Is(err, errArchiveTooLarge):
+		msg := fmt.Sprintf("%v holds more than %s or %d files, the rest of it was skipped",
+			filename, formatBytes(g.Limits.ArchiveLimit()), g.Limits.ArchiveEntryLimit())
+		return http.StatusRequestEntityTooLarge, msg
+	case errors.Is(err, errUnreadableArchive):
+		msg := fmt.Sprintf("%v could not be read, it needs to be a valid zip file", filename)
+		return http.StatusBadRequest, msg
+	case errors.Is(err, errUnsafePath):
+		msg := fmt.Sprintf("%v has an unsafe path in the archive", filename)
+		return http.StatusBadRequest, msg
+	case errors.As(err, &fileError):
+		msg := fmt.Sprintf("%v has an invalid content type or extension. Only png, gif and jpg files can be uploaded", filename)
+		return http.StatusBadRequest, msg
+	default:
+		fmt.Println(err)
+		if filename != "" {
+			return http.StatusInternalServerError, fmt.Sprintf("Something went wrong while storing %v", filename)
+		}
+		return http.StatusInternalServerError, "Something went wrong"
+	}
+}
+
+// wantsJSON reports whether the client asked for a JSON response.
+func wantsJSON(r *http.Request) bool {
+	for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(accept))
+		if err == nil && mediaType == "application/json" {
+			return true
+		}
+	}
+	return false
+}
+
+// formatBytes formats a number of bytes for people to read, e.g. 20.0 MB.
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %cB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// ResetSlug gives a gallery and its albums new slugs, for when an unlisted
+// gallery was shared with people who shouldn't see it anymore.
+func (g Galleries) ResetSlug(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryByID(w, r, g.userMustHaveRole(models.RoleOwner), galleryMustBeTopLevel)
+	if err != nil {
+		return
+	}
+	err = g.GalleryService.ResetSlug(gallery)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	editPath := fmt.Sprintf("/galleries/%d/edit", gallery.ID)
+	http.Redirect(w, r, editPath, http.StatusFound)
+}
+
+// UpdateImage saves the caption and alt text of an image.
+func (g Galleries) UpdateImage(w http.ResponseWriter, r *http.Request) {
+	filename := g.filename(w, r)
+	gallery, err := g.galleryByID(w, r, g.userMustHaveRole(models.RoleEditor))
+	if err != nil {
+		return
+	}
+	image, err := g.imageByRef(w, gallery.ID, filename)
+	if err != nil {
+		return
+	}
+	image.Caption = strings.TrimSpace(r.FormValue("caption"))
+	image.AltText = strings.TrimSpace(r.FormValue("alt_text"))
+	err = g.GalleryService.UpdateImage(&image)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	editPath := fmt.Sprintf("/galleries/%d/edit", gallery.ID)
+	http.Redirect(w, r, editPath, http.StatusFound)
+}
+
+// SetCover makes an image the cover of its gallery.
+func (g Galleries) SetCover(w http.ResponseWriter, r *http.Request) {
+	filename := g.filename(w, r)
+	gallery, err := g.galleryByID(w, r, g.userMustHaveRole(models.RoleEditor))
+	if err != nil {
+		return
+	}
+	image, err := g.imageByRef(w, gallery.ID, filename)
+	if err != nil {
+		return
+	}
+	gallery.CoverImageID = image.ID
+	err = g.GalleryService.Update(gallery)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	editPath := fmt.Sprintf("/galleries/%d/edit", gallery.ID)
+	http.Redirect(w, r, editPath, http.StatusFound)
+}
+
+// MoveImage moves an image one place up or down in its gallery, depending on
+// the direction param.
+func (g Galleries) MoveImage(w http.ResponseWriter, r *http.Request) {
+	filename := g.filename(w, r)
+	gallery, err := g.galleryByID(w, r, g.userMustHaveRole(models.RoleEditor))
+	if err != nil {
+		return
+	}
+	image, err := g.imageByRef(w, gallery.ID, filename)
+	if err != nil {
+		return
+	}
+	var step int
+	switch r.FormValue("direction") {
+	case "up":
+		step = -1
+	case "down":
+		step = 1
+	default:
+		http.Error(w, "Direction needs to be up or down", http.StatusBadRequest)
+		return
+	}
+	images, err := g.GalleryService.Images(gallery.ID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	uids := make([]string, len(images))
+	for i := range images {
+		uids[i] = images[i].UID
+	}
+	for i := range uids {
+		if uids[i] == image.UID && i+step >= 0 && i+step < len(uids) {
+			uids[i], uids[i+step] = uids[i+step], uids[i]
+			break
+		}
+	}
+	err = g.GalleryService.ReorderImages(gallery.ID, uids)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	editPath := fmt.Sprintf("/galleries/%d/edit", gallery.ID)
+	http.Redirect(w, r, editPath, http.StatusFound)
+}
+
+// ReorderImages puts the images of a gallery in the order of the uid params.
+// Images that are left out keep their order after the listed ones.
+func (g Galleries) ReorderImages(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryByID(w, r, g.userMustHaveRole(models.RoleEditor))
+	if err != nil {
+		return
+	}
+	err = r.ParseForm()
+	if err != nil {
+		http.Error(w, "Invalid form", http.StatusBadRequest)
+		return
+	}
+	err = g.GalleryService.ReorderImages(gallery.ID, r.PostForm["uid"])
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	editPath := fmt.Sprintf("/galleries/%d/edit", gallery.ID)
+	http.Redirect(w, r, editPath, http.StatusFound)
 }
 
 func (g Galleries) DeleteImage(w http.ResponseWriter, r *http.Request) {
 	filename := g.filename(w, r)
-	gallery, err := g.galleryByID(w, r, userMustOwnGallery)
+	gallery, err := g.galleryByID(w, r, g.userMustHaveRole(models.RoleEditor))
 	if err != nil {
-		http.Error(w, "Access denied", http.StatusForbidden)
 		return
 	}
 	err = g.GalleryService.DeleteImage(gallery.ID, filename)
@@ -232,57 +927,208 @@ func (g Galleries) DeleteImage(w http.ResponseWriter, r *http.Request) {
 	http.Redirect(w, r, editPath, http.StatusFound)
 }
 
+// serveObject streams a stored object to the client. Objects that support
+// seeking are served with http.ServeContent so range requests keep working.
+func serveObject(w http.ResponseWriter, r *http.Request, name string, obj *models.StorageObject) {
+	if rs, ok := obj.ReadCloser.(io.ReadSeeker); ok {
+		http.ServeContent(w, r, name, obj.ModTime, rs)
+		return
+	}
+	if contentType := mime.TypeByExtension(filepath.Ext(name)); contentType != "" {
+		w.Header().Set("Content-Type", contentType)
+	}
+	w.Header().Set("Content-Length", strconv.FormatInt(obj.Size, 10))
+	io.Copy(w, obj)
+}
+
 func (g Galleries) filename(w http.ResponseWriter, r *http.Request) string {
 	filename := chi.URLParam(r, "filename")
 	filename = filepath.Base(filename)
 	return filename
 }
 
+// imageByRef looks up an image of a gallery by its UID, or by filename for
+// URLs created before images had UIDs, writing an error response if it can't
+// be found.
+func (g Galleries) imageByRef(w http.ResponseWriter, galleryID int, ref string) (models.Image, error) {
+	image, err := g.GalleryService.Image(galleryID, ref)
+	if err != nil {
+		if errors.Is(err, models.ErrNotFound) {
+			http.Error(w, "Image not found", http.StatusNotFound)
+			return models.Image{}, err
+		}
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return models.Image{}, err
+	}
+	return image, nil
+}
+
 type galleryOpt func(w http.ResponseWriter, r *http.Request, gallery *models.Gallery) error
 
+// galleryByID looks up the gallery in the URL, which is referenced by its ID,
+// or by its slug. Galleries the user making the request isn't allowed to see,
+// either through their visibility or a share link, are reported as not found,
+// so their existence isn't revealed. Visitors of password protected galleries
+// are sent to the password prompt until they entered it.
 func (g Galleries) galleryByID(w http.ResponseWriter, r *http.Request, opts ...galleryOpt) (*models.Gallery, error) {
-	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	gallery, err := g.findGallery(w, r)
 	if err != nil {
 		return nil, err
 	}
-	gallery, err := g.GalleryService.ByID(id)
+	if g.isLocked(r, gallery) {
+		http.Redirect(w, r, "/galleries/"+galleryRef(r, gallery)+"/unlock", http.StatusFound)
+		return nil, fmt.Errorf("gallery is password protected")
+	}
+	for _, opt := range opts {
+		err = opt(w, r, gallery)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return gallery, nil
+}
+
+// findGallery looks up the gallery in the URL like galleryByID, without
+// asking for its password.
+func (g Galleries) findGallery(w http.ResponseWriter, r *http.Request) (*models.Gallery, error) {
+	ref := chi.URLParam(r, "id")
+	var gallery *models.Gallery
+	var err error
+	if id, convErr := strconv.Atoi(ref); convErr == nil {
+		gallery, err = g.GalleryService.ByID(id)
+	} else {
+		gallery, err = g.GalleryService.BySlug(ref)
+	}
+	if err == nil && !g.canViewGallery(r, gallery) {
+		err = models.ErrNotFound
+	}
 	if err != nil {
 		if errors.Is(err, models.ErrNotFound) {
 			http.Error(w, models.ErrNotFound.Error(), http.StatusNotFound)
 			return nil, err
 		}
+		fmt.Println(err)
 		http.Error(w, "Something went wrong", http.StatusInternalServerError)
 		return nil, err
 	}
-	for _, opt := range opts {
-		err = opt(w, r, gallery)
-		if err != nil {
-			return nil, err
+	return gallery, nil
+}
+
+// canViewGallery reports whether the user making the request can see
+// gallery, because of its visibility or through a share link.
+func (g Galleries) canViewGallery(r *http.Request, gallery *models.Gallery) bool {
+	if g.visibleTo(r, gallery) {
+		return true
+	}
+	_, ok := g.sharedWith(r, gallery)
+	return ok
+}
+
+// visibleTo reports whether the user making the request can see gallery,
+// because of their role in it or its visibility. Unlisted galleries can only
+// be seen when they are referenced by slug.
+func (g Galleries) visibleTo(r *http.Request, gallery *models.Gallery) bool {
+	if g.roleIn(r, gallery).Includes(models.RoleViewer) {
+		return true
+	}
+	switch gallery.Visibility {
+	case models.VisibilityPublic:
+		return true
+	case models.VisibilityUnlisted:
+		return chi.URLParam(r, "id") == gallery.Slug
+	}
+	return false
+}
+
+// canDownloadGallery reports whether the user making the request can
+// download gallery as an archive. Share links only allow it if they were
+// created to.
+func (g Galleries) canDownloadGallery(r *http.Request, gallery *models.Gallery) bool {
+	if g.visibleTo(r, gallery) {
+		return true
+	}
+	link, ok := g.sharedWith(r, gallery)
+	return ok && link.AllowDownload
+}
+
+func (g Galleries) galleryMayBeDownloaded(w http.ResponseWriter, r *http.Request, gallery *models.Gallery) error {
+	if !g.canDownloadGallery(r, gallery) {
+		http.Error(w, "This gallery can't be downloaded", http.StatusForbidden)
+		return fmt.Errorf("user can not download this gallery")
+	}
+	return nil
+}
+
+// galleryRef returns what identifies gallery in the URLs of the page r asks
+// for. Visitors of unlisted galleries can only see them through their slug,
+// so pages they found by slug link to slugs. Everyone else gets IDs, which
+// keeps the lasting slug from visitors using a share link.
+func galleryRef(r *http.Request, gallery *models.Gallery) string {
+	_, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if gallery.Visibility == models.VisibilityUnlisted && err != nil {
+		return gallery.Slug
+	}
+	return strconv.Itoa(gallery.ID)
+}
+
+// userMustHaveRole returns an option making sure the user making the request
+// has at least role in the gallery.
+func (g Galleries) userMustHaveRole(role models.Role) galleryOpt {
+	return func(w http.ResponseWriter, r *http.Request, gallery *models.Gallery) error {
+		if !g.roleIn(r, gallery).Includes(role) {
+			http.Error(w, "You are not authorized to do this in this gallery", http.StatusForbidden)
+			return fmt.Errorf("user does not have the %v role in this gallery", role)
 		}
+		return nil
 	}
-	return gallery, nil
 }
 
-func userMustOwnGallery(w http.ResponseWriter, r *http.Request, gallery *models.Gallery) error {
+// roleIn returns the role of the user making the request in gallery.
+func (g Galleries) roleIn(r *http.Request, gallery *models.Gallery) models.Role {
 	user := context.User(r.Context())
-	if gallery.UserID != user.ID {
-		return fmt.Errorf("user does not have access to this gallery")
+	if user == nil {
+		return models.RoleNone
 	}
-	return nil
+	role, err := g.GalleryService.Role(gallery, user.ID)
+	if err != nil {
+		fmt.Println(err)
+		return models.RoleNone
+	}
+	return role
 }
 
-func (g Galleries) imagesByID(galleryID int) ([]Image, error) {
+func (g Galleries) imagesByID(r *http.Request, gallery *models.Gallery) ([]Image, error) {
 	convertedImages := []Image{}
-	images, err := g.GalleryService.Images(galleryID)
+	images, err := g.GalleryService.Images(gallery.ID)
 	if err != nil {
 		return nil, err
 	}
 	for _, image := range images {
-		convertedImages = append(convertedImages, Image{
-			GalleryID:       image.GalleryID,
-			Filename:        image.Filename,
-			FilenameEscaped: url.PathEscape(image.Filename),
-		})
+		convertedImages = append(convertedImages, convertImage(r, image, gallery))
 	}
 	return convertedImages, nil
 }
+
+func convertImage(r *http.Request, image models.Image, gallery *models.Gallery) Image {
+	ref := galleryRef(r, gallery)
+	return Image{
+		GalleryRef: ref,
+		UID:        image.UID,
+		Filename:   image.Filename,
+		SrcSet:     srcSet(ref, image),
+		Caption:    image.Caption,
+		AltText:    image.AltText,
+		IsCover:    image.ID == gallery.CoverImageID,
+	}
+}
+
+func srcSet(galleryRef string, image models.Image) string {
+	imagePath := fmt.Sprintf("/galleries/%s/images/%s", url.PathEscape(galleryRef), url.PathEscape(image.UID))
+	var candidates []string
+	for _, rendition := range image.Renditions {
+		candidates = append(candidates, fmt.Sprintf("%s?size=%d %dw", imagePath, rendition.Size, rendition.Width))
+	}
+	candidates = append(candidates, fmt.Sprintf("%s %dw", imagePath, image.Width))
+	return strings.Join(candidates, ", ")
+}
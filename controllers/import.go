@@ -0,0 +1,153 @@
+package controllers
+
+import (
+	"archive/zip"
+	"errors"
+	"fmt"
+	"mime/multipart"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/Pupsichekk/lenslocked/models"
+)
+
+var (
+	errArchiveTooLarge   = errors.New("archive extracts to more than the upload limit")
+	errUnreadableArchive = errors.New("archive is not a readable zip file")
+	errUnsafePath        = errors.New("archive entry has an unsafe path")
+)
+
+// isArchive reports whether an uploaded file is a ZIP archive of images to
+// import, rather than an image.
+func isArchive(filename string) bool {
+	return strings.EqualFold(path.Ext(filename), ".zip")
+}
+
+// importArchive adds every image in an uploaded ZIP archive to the gallery,
+// returning the result for each entry and the number of bytes stored. The
+// archive itself only has to fit in the request, but what is extracted from
+// it is limited per entry, in total and in number of entries, so a small
+// archive can't expand into more than that. used is the number of bytes the
+// uploading user already stores.
+//
+// If an error is returned, the entries that were not reported yet were
+// skipped.
+func (g Galleries) importArchive(galleryID int, part *multipart.Part, used int64) ([]uploadResult, int64, error) {
+	// The request limit applies already, the archive is only spooled so its
+	// directory at the end can be read.
+	tmp, size, err := spool(part, g.Limits.RequestLimit())
+	if err != nil {
+		return nil, 0, fmt.Errorf("import archive: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	zr, err := zip.NewReader(tmp, size)
+	if err != nil {
+		return nil, 0, fmt.Errorf("import archive: %w: %v", errUnreadableArchive, err)
+	}
+
+	var results []uploadResult
+	var stored, extracted int64
+	entries := 0
+	for _, file := range zr.File {
+		if file.FileInfo().IsDir() || isArchiveMetadata(file.Name) {
+			continue
+		}
+		entries++
+		if entries > g.Limits.ArchiveEntryLimit() {
+			return results, stored, fmt.Errorf("import archive: %w", errArchiveTooLarge)
+		}
+		result := uploadResult{
+			Filename: file.Name,
+			Archive:  part.FileName(),
+		}
+		image, n, err := g.importEntry(galleryID, file, extracted, used+stored)
+		extracted += n
+		if errors.Is(err, errArchiveTooLarge) {
+			return results, stored, fmt.Errorf("import archive: %w", err)
+		}
+		if err != nil {
+			_, result.Error = g.uploadErrorMessage(file.Name, err)
+			results = append(results, result)
+			continue
+		}
+		result.Stored = true
+		result.UID = image.UID
+		results = append(results, result)
+		stored += n
+	}
+	return results, stored, nil
+}
+
+// importEntry extracts a single archive entry and adds it to the gallery.
+// extracted is the number of bytes extracted from the archive so far. The
+// number of bytes extracted from the entry is returned even if it could not
+// be added.
+func (g Galleries) importEntry(galleryID int, file *zip.File, extracted, used int64) (models.Image, int64, error) {
+	filename, ok := archiveEntryName(file.Name)
+	if !ok {
+		return models.Image{}, 0, errUnsafePath
+	}
+	if file.UncompressedSize64 > uint64(g.Limits.FileLimit()) {
+		return models.Image{}, 0, errFileTooLarge
+	}
+	remaining := g.Limits.ArchiveLimit() - extracted
+	if file.UncompressedSize64 > uint64(remaining) {
+		return models.Image{}, 0, errArchiveTooLarge
+	}
+	// The sizes in the archive can't be trusted, so at most the allowed
+	// number of bytes is read, no matter what the header claims.
+	limit := min(g.Limits.FileLimit(), remaining)
+	rc, err := file.Open()
+	if err != nil {
+		return models.Image{}, 0, fmt.Errorf("import entry: %w: %v", errUnreadableArchive, err)
+	}
+	defer rc.Close()
+	tmp, size, err := spool(rc, limit)
+	if err != nil {
+		switch {
+		case errors.Is(err, errFileTooLarge) && limit < g.Limits.FileLimit():
+			return models.Image{}, limit, errArchiveTooLarge
+		case errors.Is(err, errFileTooLarge):
+			return models.Image{}, limit, errFileTooLarge
+		}
+		return models.Image{}, 0, fmt.Errorf("import entry: %w: %v", errUnreadableArchive, err)
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	if !g.Limits.UserAllows(used, size) {
+		return models.Image{}, size, errStorageLimit
+	}
+	image, err := g.GalleryService.CreateImage(galleryID, filename, tmp)
+	if err != nil {
+		return models.Image{}, size, err
+	}
+	return image, size, nil
+}
+
+// archiveEntryName returns the filename an archive entry is imported as.
+// Entries are never written to disk under their own path, but entries with
+// absolute paths or paths leaving the archive are a sign of a malicious
+// archive and are rejected.
+func archiveEntryName(name string) (string, bool) {
+	name = strings.ReplaceAll(name, `\`, "/")
+	if name == "" || path.IsAbs(name) || strings.Contains(name, ":") {
+		return "", false
+	}
+	for _, elem := range strings.Split(name, "/") {
+		if elem == ".." {
+			return "", false
+		}
+	}
+	return path.Base(name), true
+}
+
+// isArchiveMetadata reports whether an archive entry holds metadata added by
+// the tool that created the archive, rather than a file of the user.
+func isArchiveMetadata(name string) bool {
+	return strings.HasPrefix(name, "__MACOSX/") ||
+		strings.HasPrefix(path.Base(name), "._") ||
+		path.Base(name) == ".DS_Store" ||
+		path.Base(name) == "Thumbs.db"
+}
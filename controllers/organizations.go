@@ -0,0 +1,317 @@
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/Pupsichekk/lenslocked/context"
+	apperrors "github.com/Pupsichekk/lenslocked/errors"
+	"github.com/Pupsichekk/lenslocked/models"
+	"github.com/go-chi/chi/v5"
+)
+
+type Organizations struct {
+	Templates struct {
+		Index      Template
+		Show       Template
+		Invitation Template
+	}
+	OrganizationService *models.OrganizationService
+	EmailService        *models.EmailService
+	// BaseURL is the URL the site is served from, e.g.
+	// "https://example.com", used for links that are sent to people.
+	BaseURL string
+}
+
+func (o Organizations) Index(w http.ResponseWriter, r *http.Request) {
+	o.renderIndex(w, r, "")
+}
+
+func (o Organizations) renderIndex(w http.ResponseWriter, r *http.Request, name string, errs ...error) {
+	var data struct {
+		Name          string
+		Organizations []models.Organization
+	}
+	data.Name = name
+	var err error
+	data.Organizations, err = o.OrganizationService.ByUserID(context.User(r.Context()).ID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	o.Templates.Index.Execute(w, r, data, errs...)
+}
+
+// Create creates an organization with the user making the request as its
+// admin.
+func (o Organizations) Create(w http.ResponseWriter, r *http.Request) {
+	name := r.FormValue("name")
+	org, err := o.OrganizationService.Create(name, context.User(r.Context()).ID)
+	if err != nil {
+		o.renderIndex(w, r, name, err)
+		return
+	}
+	http.Redirect(w, r, fmt.Sprintf("/organizations/%d", org.ID), http.StatusFound)
+}
+
+func (o Organizations) Show(w http.ResponseWriter, r *http.Request) {
+	org, err := o.organizationByID(w, r)
+	if err != nil {
+		return
+	}
+	o.renderShow(w, r, org)
+}
+
+// renderShow renders the page of an organization. Only admins see the
+// invitations that weren't accepted yet.
+func (o Organizations) renderShow(w http.ResponseWriter, r *http.Request, org *models.Organization, errs ...error) {
+	var data struct {
+		ID          int
+		Name        string
+		IsAdmin     bool
+		UserID      int
+		Members     []models.Member
+		Invitations []models.Invitation
+	}
+	data.ID = org.ID
+	data.Name = org.Name
+	data.IsAdmin = org.Role == models.OrganizationAdmin
+	data.UserID = context.User(r.Context()).ID
+	var err error
+	data.Members, err = o.OrganizationService.Members(org.ID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	if data.IsAdmin {
+		data.Invitations, err = o.OrganizationService.Invitations(org.ID)
+		if err != nil {
+			fmt.Println(err)
+			http.Error(w, "Something went wrong", http.StatusInternalServerError)
+			return
+		}
+	}
+	o.Templates.Show.Execute(w, r, data, errs...)
+}
+
+// Invite emails an invitation to join an organization. Inviting someone who
+// was invited already sends them a new invitation, the old one stops
+// working.
+func (o Organizations) Invite(w http.ResponseWriter, r *http.Request) {
+	org, err := o.organizationByID(w, r, userMustBeAdmin)
+	if err != nil {
+		return
+	}
+	role := models.OrganizationRole(r.FormValue("role"))
+	if !role.Valid() {
+		http.Error(w, "Invalid role", http.StatusBadRequest)
+		return
+	}
+	email := r.FormValue("email")
+	invitation, err := o.OrganizationService.Invite(org.ID, email, role, context.User(r.Context()).ID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	inviteURL := fmt.Sprintf("%s/organizations/invitations/%s", o.BaseURL,
+		url.PathEscape(invitation.Token))
+	err = o.EmailService.OrganizationInvitation(invitation.Email, org.Name, inviteURL)
+	if err != nil {
+		fmt.Println(err)
+		err = apperrors.Public(err, "The invitation couldn't be sent, please try again later.")
+		o.renderShow(w, r, org, err)
+		return
+	}
+	http.Redirect(w, r, fmt.Sprintf("/organizations/%d", org.ID), http.StatusFound)
+}
+
+func (o Organizations) RevokeInvitation(w http.ResponseWriter, r *http.Request) {
+	org, err := o.organizationByID(w, r, userMustBeAdmin)
+	if err != nil {
+		return
+	}
+	id, err := strconv.Atoi(chi.URLParam(r, "invitationID"))
+	if err != nil {
+		http.Error(w, "Invitation not found", http.StatusNotFound)
+		return
+	}
+	err = o.OrganizationService.RevokeInvitation(org.ID, id)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, fmt.Sprintf("/organizations/%d", org.ID), http.StatusFound)
+}
+
+// RemoveMember removes a member from an organization. Admins can remove
+// anyone, other members can only leave the organization themselves.
+func (o Organizations) RemoveMember(w http.ResponseWriter, r *http.Request) {
+	org, err := o.organizationByID(w, r)
+	if err != nil {
+		return
+	}
+	userID, err := strconv.Atoi(chi.URLParam(r, "userID"))
+	if err != nil {
+		http.Error(w, "Member not found", http.StatusNotFound)
+		return
+	}
+	user := context.User(r.Context())
+	if org.Role != models.OrganizationAdmin && userID != user.ID {
+		http.Error(w, "You are not authorized to remove members of this organization", http.StatusForbidden)
+		return
+	}
+	err = o.OrganizationService.RemoveMember(org.ID, userID)
+	if err != nil {
+		if errors.Is(err, models.ErrLastAdmin) {
+			err = apperrors.Public(err, "The organization needs at least one admin, make someone else an admin first.")
+			o.renderShow(w, r, org, err)
+			return
+		}
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	if userID == user.ID {
+		http.Redirect(w, r, "/organizations", http.StatusFound)
+		return
+	}
+	http.Redirect(w, r, fmt.Sprintf("/organizations/%d", org.ID), http.StatusFound)
+}
+
+// SetMemberRole makes a member of an organization an admin, or the other way
+// around. Only admins can change roles.
+func (o Organizations) SetMemberRole(w http.ResponseWriter, r *http.Request) {
+	org, err := o.organizationByID(w, r, userMustBeAdmin)
+	if err != nil {
+		return
+	}
+	userID, err := strconv.Atoi(chi.URLParam(r, "userID"))
+	if err != nil {
+		http.Error(w, "Member not found", http.StatusNotFound)
+		return
+	}
+	role := models.OrganizationRole(r.FormValue("role"))
+	if !role.Valid() {
+		http.Error(w, "Invalid role", http.StatusBadRequest)
+		return
+	}
+	err = o.OrganizationService.SetRole(org.ID, userID, role)
+	if err != nil {
+		switch {
+		case errors.Is(err, models.ErrLastAdmin):
+			err = apperrors.Public(err, "The organization needs at least one admin, make someone else an admin first.")
+			o.renderShow(w, r, org, err)
+		case errors.Is(err, models.ErrNotFound):
+			http.Error(w, "Member not found", http.StatusNotFound)
+		default:
+			fmt.Println(err)
+			http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		}
+		return
+	}
+	http.Redirect(w, r, fmt.Sprintf("/organizations/%d", org.ID), http.StatusFound)
+}
+
+// Delete deletes an organization. Its galleries go to the admin deleting it.
+func (o Organizations) Delete(w http.ResponseWriter, r *http.Request) {
+	org, err := o.organizationByID(w, r, userMustBeAdmin)
+	if err != nil {
+		return
+	}
+	err = o.OrganizationService.Delete(org.ID, context.User(r.Context()).ID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/organizations", http.StatusFound)
+}
+
+// Invitation shows an invitation to join an organization, so the user can
+// accept it.
+func (o Organizations) Invitation(w http.ResponseWriter, r *http.Request) {
+	invitation, err := o.OrganizationService.Invitation(chi.URLParam(r, "token"))
+	if err != nil {
+		switch {
+		case errors.Is(err, models.ErrNotFound):
+			http.Error(w, "Invitation not found", http.StatusNotFound)
+		case errors.Is(err, models.ErrLinkExpired):
+			http.Error(w, "This invitation has expired", http.StatusGone)
+		default:
+			fmt.Println(err)
+			http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		}
+		return
+	}
+	o.Templates.Invitation.Execute(w, r, invitation)
+}
+
+func (o Organizations) AcceptInvitation(w http.ResponseWriter, r *http.Request) {
+	token := chi.URLParam(r, "token")
+	invitation, err := o.OrganizationService.Accept(token, context.User(r.Context()))
+	if err != nil {
+		switch {
+		case errors.Is(err, models.ErrNotFound):
+			// The invitation exists, it was only sent to someone else.
+			if invitation, lookupErr := o.OrganizationService.Invitation(token); lookupErr == nil {
+				err = apperrors.Public(err, fmt.Sprintf(
+					"This invitation was sent to %s, sign in with that email address to accept it.",
+					invitation.Email))
+				o.Templates.Invitation.Execute(w, r, invitation, err)
+				return
+			}
+			http.Error(w, "Invitation not found", http.StatusNotFound)
+		case errors.Is(err, models.ErrLinkExpired):
+			http.Error(w, "This invitation has expired", http.StatusGone)
+		default:
+			fmt.Println(err)
+			http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		}
+		return
+	}
+	http.Redirect(w, r, fmt.Sprintf("/organizations/%d", invitation.OrganizationID), http.StatusFound)
+}
+
+type organizationOpt func(w http.ResponseWriter, r *http.Request, org *models.Organization) error
+
+// organizationByID looks up the organization in the URL. Users who aren't
+// members of it get a 404, as if it didn't exist.
+func (o Organizations) organizationByID(w http.ResponseWriter, r *http.Request, opts ...organizationOpt) (*models.Organization, error) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, "Organization not found", http.StatusNotFound)
+		return nil, err
+	}
+	org, err := o.OrganizationService.ByID(id, context.User(r.Context()).ID)
+	if err != nil {
+		if errors.Is(err, models.ErrNotFound) {
+			http.Error(w, "Organization not found", http.StatusNotFound)
+			return nil, err
+		}
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return nil, err
+	}
+	for _, opt := range opts {
+		err = opt(w, r, org)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return org, nil
+}
+
+func userMustBeAdmin(w http.ResponseWriter, r *http.Request, org *models.Organization) error {
+	if org.Role != models.OrganizationAdmin {
+		http.Error(w, "You are not authorized to manage this organization", http.StatusForbidden)
+		return fmt.Errorf("user is not an admin of this organization")
+	}
+	return nil
+}
@@ -0,0 +1,216 @@
+package controllers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/Pupsichekk/lenslocked/context"
+	"github.com/Pupsichekk/lenslocked/models"
+	"github.com/go-chi/chi/v5"
+	"github.com/go-webauthn/webauthn/protocol"
+)
+
+// Passkeys lists the passkeys the user can sign in with, and lets them
+// register new ones.
+func (u Users) Passkeys(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	type Passkey struct {
+		ID         int
+		Name       string
+		CreatedAt  time.Time
+		LastUsedAt *time.Time
+	}
+	var data struct {
+		Passkeys []Passkey
+		// TwoFactor asks for a code from their app before adding a passkey.
+		TwoFactor bool
+	}
+	var err error
+	data.TwoFactor, err = u.TwoFactorService.Enabled(user.ID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	passkeys, err := u.PasskeyService.ByUserID(user.ID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	for _, passkey := range passkeys {
+		data.Passkeys = append(data.Passkeys, Passkey{
+			ID:         passkey.ID,
+			Name:       passkey.Name,
+			CreatedAt:  passkey.CreatedAt,
+			LastUsedAt: passkey.LastUsedAt,
+		})
+	}
+	u.Templates.Passkeys.Execute(w, r, data)
+}
+
+// BeginPasskeyRegistration returns the options the browser needs to create a
+// new passkey. A passkey signs in without the password or a two-factor code,
+// so users need to enter both again first. Otherwise anyone at a device
+// someone left signed in could add their own passkey and keep access.
+func (u Users) BeginPasskeyRegistration(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	var data struct {
+		Password string `json:"password"`
+		Code     string `json:"code"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&data)
+	if err != nil {
+		http.Error(w, "Please enter your password", http.StatusBadRequest)
+		return
+	}
+	key := strconv.Itoa(user.ID)
+	if !u.TwoFactorAttempts.Allow(key) {
+		http.Error(w, "Too many wrong attempts, please try again later.", http.StatusTooManyRequests)
+		return
+	}
+	_, err = u.UserService.Authenticate(user.Email, data.Password)
+	if err != nil {
+		u.TwoFactorAttempts.Fail(key)
+		http.Error(w, "That password is incorrect.", http.StatusUnauthorized)
+		return
+	}
+	err = u.TwoFactorService.Verify(user.ID, data.Code)
+	switch {
+	case errors.Is(err, models.ErrNotFound):
+		// Two-factor authentication isn't enabled.
+	case errors.Is(err, models.ErrInvalidCode):
+		u.TwoFactorAttempts.Fail(key)
+		http.Error(w, "That code is incorrect.", http.StatusUnauthorized)
+		return
+	case err != nil:
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	ceremony, err := u.PasskeyService.BeginRegistration(user)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	writeCeremony(w, ceremony)
+}
+
+// FinishPasskeyRegistration stores the passkey the browser created, named
+// after the name query parameter.
+func (u Users) FinishPasskeyRegistration(w http.ResponseWriter, r *http.Request) {
+	response, err := protocol.ParseCredentialCreationResponseBody(r.Body)
+	if err != nil {
+		http.Error(w, "The passkey couldn't be read", http.StatusBadRequest)
+		return
+	}
+	token, err := readCookie(r, CookiePasskey)
+	if err != nil {
+		http.Error(w, "Please try adding the passkey again", http.StatusBadRequest)
+		return
+	}
+	deleteCookie(w, CookiePasskey)
+	user := context.User(r.Context())
+	_, err = u.PasskeyService.FinishRegistration(user, token, r.URL.Query().Get("name"), response)
+	if err != nil {
+		switch {
+		case errors.Is(err, models.ErrNotFound), errors.Is(err, models.ErrLinkExpired):
+			http.Error(w, "Please try adding the passkey again", http.StatusBadRequest)
+		case errors.Is(err, models.ErrInvalidPasskey):
+			fmt.Println(err)
+			http.Error(w, "The passkey couldn't be verified", http.StatusBadRequest)
+		default:
+			fmt.Println(err)
+			http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		}
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (u Users) DeletePasskey(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, "Passkey not found", http.StatusNotFound)
+		return
+	}
+	err = u.PasskeyService.Delete(user.ID, id)
+	if err != nil {
+		if errors.Is(err, models.ErrNotFound) {
+			http.Error(w, "Passkey not found", http.StatusNotFound)
+			return
+		}
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/users/me/passkeys", http.StatusFound)
+}
+
+// BeginPasskeySignIn returns the options the browser needs to sign in with
+// one of its passkeys.
+func (u Users) BeginPasskeySignIn(w http.ResponseWriter, r *http.Request) {
+	ceremony, err := u.PasskeyService.BeginLogin()
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	writeCeremony(w, ceremony)
+}
+
+// ProcessPasskeySignIn signs in the user the passkey the browser picked
+// belongs to, instead of ProcessSignIn checking their password. Passkeys
+// require the user to unlock them with a PIN or biometrics, so no
+// two-factor authentication code is asked for.
+func (u Users) ProcessPasskeySignIn(w http.ResponseWriter, r *http.Request) {
+	response, err := protocol.ParseCredentialRequestResponseBody(r.Body)
+	if err != nil {
+		http.Error(w, "The passkey couldn't be read", http.StatusBadRequest)
+		return
+	}
+	token, err := readCookie(r, CookiePasskey)
+	if err != nil {
+		http.Error(w, "Please try signing in again", http.StatusBadRequest)
+		return
+	}
+	deleteCookie(w, CookiePasskey)
+	user, err := u.PasskeyService.FinishLogin(token, response)
+	if err != nil {
+		switch {
+		case errors.Is(err, models.ErrNotFound), errors.Is(err, models.ErrLinkExpired):
+			http.Error(w, "Please try signing in again", http.StatusBadRequest)
+		case errors.Is(err, models.ErrInvalidPasskey):
+			fmt.Println(err)
+			http.Error(w, "That passkey couldn't be verified", http.StatusUnauthorized)
+		default:
+			fmt.Println(err)
+			http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		}
+		return
+	}
+	err = u.signIn(w, r, user.ID, r.URL.Query().Get("remember") == "true")
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// writeCeremony remembers the ceremony in a cookie and sends its options to
+// the browser.
+func writeCeremony(w http.ResponseWriter, ceremony *models.PasskeyCeremony) {
+	setCookie(w, CookiePasskey, ceremony.Token)
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(ceremony.Options)
+	if err != nil {
+		fmt.Println(err)
+	}
+}
@@ -0,0 +1,117 @@
+package controllers
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	apperrors "github.com/Pupsichekk/lenslocked/errors"
+	"github.com/Pupsichekk/lenslocked/models"
+)
+
+// UpdatePassword sets or removes the password visitors need to enter to see a
+// gallery.
+func (g Galleries) UpdatePassword(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryByID(w, r, g.userMustHaveRole(models.RoleOwner), galleryMustBeTopLevel)
+	if err != nil {
+		return
+	}
+	password := r.FormValue("password")
+	if r.FormValue("remove") == "true" {
+		password = ""
+	} else if password == "" {
+		http.Error(w, "The password can't be empty", http.StatusBadRequest)
+		return
+	}
+	err = g.GalleryService.UpdatePassword(gallery, password)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	editPath := fmt.Sprintf("/galleries/%d/edit", gallery.ID)
+	http.Redirect(w, r, editPath, http.StatusFound)
+}
+
+// Unlock shows the prompt for the password of a gallery.
+func (g Galleries) Unlock(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.findGallery(w, r)
+	if err != nil {
+		return
+	}
+	if !g.isLocked(r, gallery) {
+		http.Redirect(w, r, "/galleries/"+galleryRef(r, gallery), http.StatusFound)
+		return
+	}
+	g.renderUnlock(w, r, gallery)
+}
+
+// ProcessUnlock checks the password entered for a gallery. Visitors who enter
+// it get a cookie that unlocks that gallery and its albums only.
+func (g Galleries) ProcessUnlock(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.findGallery(w, r)
+	if err != nil {
+		return
+	}
+	galleryPath := "/galleries/" + galleryRef(r, gallery)
+	if !g.isLocked(r, gallery) {
+		http.Redirect(w, r, galleryPath, http.StatusFound)
+		return
+	}
+	// Attempts are limited per gallery and address, limiting them per
+	// gallery alone would let anyone lock out everyone else. Albums share
+	// the password of their root gallery, and its attempts.
+	key := fmt.Sprintf("%d/%s", gallery.RootID, clientIP(r))
+	if !g.PasswordAttempts.Allow(key) {
+		err = apperrors.Public(fmt.Errorf("too many password attempts"),
+			"Too many wrong passwords, please try again later.")
+		g.renderUnlock(w, r, gallery, err)
+		return
+	}
+	if !gallery.CheckPassword(r.FormValue("password")) {
+		g.PasswordAttempts.Fail(key)
+		err = apperrors.Public(fmt.Errorf("wrong gallery password"), "That password is incorrect.")
+		g.renderUnlock(w, r, gallery, err)
+		return
+	}
+	token, expiresAt := g.GalleryService.UnlockToken(gallery)
+	cookie := newGalleryCookie(CookieUnlock, gallery, token)
+	cookie.MaxAge = max(int(time.Until(expiresAt).Seconds()), 1)
+	http.SetCookie(w, cookie)
+	http.Redirect(w, r, galleryPath, http.StatusFound)
+}
+
+func (g Galleries) renderUnlock(w http.ResponseWriter, r *http.Request, gallery *models.Gallery, errs ...error) {
+	var data struct {
+		Ref   string
+		Title string
+	}
+	data.Ref = galleryRef(r, gallery)
+	data.Title = gallery.Title
+	g.Templates.Unlock.Execute(w, r, data, errs...)
+}
+
+// isLocked reports whether the user making the request still needs to enter
+// the password of gallery. The owner, collaborators and visitors using a
+// share link never do.
+func (g Galleries) isLocked(r *http.Request, gallery *models.Gallery) bool {
+	if !gallery.HasPassword() || g.roleIn(r, gallery).Includes(models.RoleViewer) {
+		return false
+	}
+	token, err := readCookie(r, galleryCookie(CookieUnlock, gallery))
+	if err == nil && g.GalleryService.CheckUnlockToken(gallery, token) {
+		return false
+	}
+	_, shared := g.sharedWith(r, gallery)
+	return !shared
+}
+
+// clientIP returns the address of the client making the request.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
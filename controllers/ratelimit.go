@@ -0,0 +1,63 @@
+package controllers
+
+import (
+	"sync"
+	"time"
+)
+
+// AttemptLimiter limits how often something can fail, per key, within a
+// sliding window of time. The zero value allows nothing to fail, Max and
+// Window need to be set.
+//
+// Failures are only kept in memory, by the process that saw them. Each
+// server process counts on its own when several are running, and a restart
+// forgets them all.
+type AttemptLimiter struct {
+	// Max is the number of failures allowed within Window.
+	Max    int
+	Window time.Duration
+
+	mu       sync.Mutex
+	failures map[string][]time.Time
+}
+
+// Allow reports whether another attempt can be made for key.
+func (l *AttemptLimiter) Allow(key string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.recent(key, time.Now())) < l.Max
+}
+
+// Fail records a failed attempt for key.
+func (l *AttemptLimiter) Fail(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	if l.failures == nil {
+		l.failures = make(map[string][]time.Time)
+	}
+	l.failures[key] = append(l.recent(key, now), now)
+	// Forget keys that have nothing recent, so the map doesn't keep growing.
+	for k := range l.failures {
+		if len(l.recent(k, now)) == 0 {
+			delete(l.failures, k)
+		}
+	}
+}
+
+// recent returns the failures for key within the window, dropping older
+// ones. The caller needs to hold l.mu.
+func (l *AttemptLimiter) recent(key string, now time.Time) []time.Time {
+	failures := l.failures[key]
+	i := 0
+	for i < len(failures) && now.Sub(failures[i]) >= l.Window {
+		i++
+	}
+	failures = failures[i:]
+	if len(failures) == 0 {
+		delete(l.failures, key)
+	} else {
+		l.failures[key] = failures
+	}
+	return failures
+}
@@ -0,0 +1,91 @@
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/Pupsichekk/lenslocked/context"
+	"github.com/Pupsichekk/lenslocked/models"
+	"github.com/go-chi/chi/v5"
+)
+
+// Sessions lists the clients the user is signed in on, so they can sign out
+// of the ones they don't recognize or no longer use.
+func (u Users) Sessions(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	type Session struct {
+		ID         int
+		UserAgent  string
+		IPAddress  string
+		CreatedAt  time.Time
+		LastSeenAt time.Time
+		Current    bool
+	}
+	var data struct {
+		Sessions []Session
+	}
+	sessions, err := u.SessionService.ByUserID(user.ID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	var currentHash string
+	if token, err := readCookie(r, CookieSession); err == nil {
+		currentHash = u.SessionService.Hash(token)
+	}
+	for _, session := range sessions {
+		data.Sessions = append(data.Sessions, Session{
+			ID:         session.ID,
+			UserAgent:  session.UserAgent,
+			IPAddress:  session.IPAddress,
+			CreatedAt:  session.CreatedAt,
+			LastSeenAt: session.LastSeenAt,
+			Current:    session.TokenHash == currentHash,
+		})
+	}
+	u.Templates.Sessions.Execute(w, r, data)
+}
+
+// RevokeSession signs the user out of one of their sessions. Revoking the
+// current session signs them out right away.
+func (u Users) RevokeSession(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, "Session not found", http.StatusNotFound)
+		return
+	}
+	err = u.SessionService.Revoke(user.ID, id)
+	if err != nil {
+		if errors.Is(err, models.ErrNotFound) {
+			http.Error(w, "Session not found", http.StatusNotFound)
+			return
+		}
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/users/me/sessions", http.StatusFound)
+}
+
+// RevokeOtherSessions signs the user out everywhere but the client making the
+// request.
+func (u Users) RevokeOtherSessions(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	token, err := readCookie(r, CookieSession)
+	if err != nil {
+		http.Redirect(w, r, "/signin", http.StatusFound)
+		return
+	}
+	err = u.SessionService.RevokeOthers(user.ID, token)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/users/me/sessions", http.StatusFound)
+}
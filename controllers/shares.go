@@ -0,0 +1,120 @@
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/Pupsichekk/lenslocked/models"
+	"github.com/go-chi/chi/v5"
+)
+
+// CreateShareLink creates a share link for a gallery. Its URL is shown on the
+// edit page right away, since only the hash of its token is stored.
+func (g Galleries) CreateShareLink(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryByID(w, r, g.userMustHaveRole(models.RoleOwner), galleryMustBeTopLevel)
+	if err != nil {
+		return
+	}
+	link := models.ShareLink{
+		GalleryID:     gallery.ID,
+		AllowDownload: r.FormValue("allow_download") == "true",
+	}
+	if days := r.FormValue("expires_in_days"); days != "" {
+		n, err := strconv.Atoi(days)
+		if err != nil || n < 1 {
+			http.Error(w, "Links need to expire after at least one day", http.StatusBadRequest)
+			return
+		}
+		expiresAt := time.Now().AddDate(0, 0, n)
+		link.ExpiresAt = &expiresAt
+	}
+	if views := r.FormValue("max_views"); views != "" {
+		link.MaxViews, err = strconv.Atoi(views)
+		if err != nil || link.MaxViews < 0 {
+			http.Error(w, "Invalid view limit", http.StatusBadRequest)
+			return
+		}
+	}
+	err = g.ShareService.Create(&link)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	shareURL := fmt.Sprintf("%s/share/%s", g.BaseURL, link.Token)
+	g.renderEdit(w, r, gallery, editNotices{ShareURL: shareURL})
+}
+
+func (g Galleries) RevokeShareLink(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryByID(w, r, g.userMustHaveRole(models.RoleOwner), galleryMustBeTopLevel)
+	if err != nil {
+		return
+	}
+	id, err := strconv.Atoi(chi.URLParam(r, "shareID"))
+	if err != nil {
+		http.Error(w, "Share link not found", http.StatusNotFound)
+		return
+	}
+	err = g.ShareService.Revoke(gallery.ID, id)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	editPath := fmt.Sprintf("/galleries/%d/edit", gallery.ID)
+	http.Redirect(w, r, editPath, http.StatusFound)
+}
+
+// OpenShareLink counts a view of a share link and redirects to its gallery.
+// The token of the view is kept in a cookie scoped to the gallery, so the
+// images of the gallery can be loaded without counting more views until the
+// view ends. The gallery is referenced by ID, which only works as long as the
+// view does, rather than by its slug.
+func (g Galleries) OpenShareLink(w http.ResponseWriter, r *http.Request) {
+	token := chi.URLParam(r, "token")
+	link, view, err := g.ShareService.Open(token)
+	if err != nil {
+		switch {
+		case errors.Is(err, models.ErrNotFound):
+			http.Error(w, "Share link not found", http.StatusNotFound)
+		case errors.Is(err, models.ErrLinkExpired):
+			http.Error(w, "This share link has expired", http.StatusGone)
+		default:
+			fmt.Println(err)
+			http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		}
+		return
+	}
+	gallery, err := g.GalleryService.ByID(link.GalleryID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	galleryPath := fmt.Sprintf("/galleries/%d", gallery.ID)
+	cookie := newGalleryCookie(CookieShare, gallery, view.Token)
+	cookie.MaxAge = max(int(time.Until(view.ExpiresAt).Seconds()), 1)
+	http.SetCookie(w, cookie)
+	http.Redirect(w, r, galleryPath, http.StatusFound)
+}
+
+// sharedWith returns the share link the user making the request opened
+// gallery with, if their view of it still grants access. Share links of a gallery grant
+// access to its albums as well.
+func (g Galleries) sharedWith(r *http.Request, gallery *models.Gallery) (*models.ShareLink, bool) {
+	token, err := readCookie(r, galleryCookie(CookieShare, gallery))
+	if err != nil {
+		return nil, false
+	}
+	link, err := g.ShareService.Check(token, gallery.RootID)
+	if err != nil {
+		if !errors.Is(err, models.ErrNotFound) && !errors.Is(err, models.ErrLinkExpired) {
+			fmt.Println(err)
+		}
+		return nil, false
+	}
+	return link, true
+}
@@ -0,0 +1,139 @@
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"github.com/Pupsichekk/lenslocked/context"
+	apperrors "github.com/Pupsichekk/lenslocked/errors"
+	"github.com/Pupsichekk/lenslocked/models"
+	"github.com/go-chi/chi/v5"
+)
+
+// StartTransfer emails the user a gallery is being transferred to a link to
+// accept it. The gallery stays with its owner until then.
+func (g Galleries) StartTransfer(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryByID(w, r, g.userMustHaveRole(models.RoleOwner), galleryMustBeTopLevel)
+	if err != nil {
+		return
+	}
+	if gallery.OrganizationID != 0 {
+		http.Error(w, "Galleries of organizations can't be transferred", http.StatusBadRequest)
+		return
+	}
+	transfer, err := g.TransferService.Start(gallery, r.FormValue("email"))
+	if err != nil {
+		switch {
+		case errors.Is(err, models.ErrNotFound):
+			err = apperrors.Public(err, "There is no account with that email address.")
+			g.renderEdit(w, r, gallery, editNotices{}, err)
+		case errors.Is(err, models.ErrTransferToSelf):
+			err = apperrors.Public(err, "You already own this gallery.")
+			g.renderEdit(w, r, gallery, editNotices{}, err)
+		default:
+			fmt.Println(err)
+			http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		}
+		return
+	}
+	acceptURL := fmt.Sprintf("%s/transfers/%s", g.BaseURL, url.PathEscape(transfer.Token))
+	err = g.EmailService.GalleryTransfer(transfer.ToEmail, transfer.FromEmail, gallery.Title, acceptURL)
+	if err != nil {
+		fmt.Println(err)
+		err = apperrors.Public(err, "The transfer email couldn't be sent, please try again later.")
+		g.renderEdit(w, r, gallery, editNotices{}, err)
+		return
+	}
+	editPath := fmt.Sprintf("/galleries/%d/edit", gallery.ID)
+	http.Redirect(w, r, editPath, http.StatusFound)
+}
+
+func (g Galleries) CancelTransfer(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryByID(w, r, g.userMustHaveRole(models.RoleOwner), galleryMustBeTopLevel)
+	if err != nil {
+		return
+	}
+	err = g.TransferService.Cancel(gallery.ID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	editPath := fmt.Sprintf("/galleries/%d/edit", gallery.ID)
+	http.Redirect(w, r, editPath, http.StatusFound)
+}
+
+// Transfer shows a gallery transfer to the user it was started for, so they
+// can accept it.
+func (g Galleries) Transfer(w http.ResponseWriter, r *http.Request) {
+	transfer, err := g.transferByToken(w, r)
+	if err != nil {
+		return
+	}
+	g.Templates.Transfer.Execute(w, r, transfer)
+}
+
+// AcceptTransfer makes the user making the request the owner of a gallery
+// transferred to them. The images of the gallery count towards their storage
+// from then on, so they need to have room for them.
+func (g Galleries) AcceptTransfer(w http.ResponseWriter, r *http.Request) {
+	transfer, err := g.transferByToken(w, r)
+	if err != nil {
+		return
+	}
+	user := context.User(r.Context())
+	used, err := g.GalleryService.StorageUsed(user.ID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	size, err := g.GalleryService.Size(transfer.GalleryID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	if !g.Limits.UserAllows(used, size) {
+		err = apperrors.Public(errStorageLimit, fmt.Sprintf(
+			"The images of this gallery take %s, which is more than you have room for.", formatBytes(size)))
+		g.Templates.Transfer.Execute(w, r, transfer, err)
+		return
+	}
+	_, err = g.TransferService.Accept(transfer.Token, user)
+	if err != nil {
+		if errors.Is(err, models.ErrNotFound) {
+			http.Error(w, "Transfer not found", http.StatusNotFound)
+			return
+		}
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	editPath := fmt.Sprintf("/galleries/%d/edit", transfer.GalleryID)
+	http.Redirect(w, r, editPath, http.StatusFound)
+}
+
+// transferByToken looks up the transfer in the URL. Users other than the one
+// it was started for get a 404, as if it didn't exist.
+func (g Galleries) transferByToken(w http.ResponseWriter, r *http.Request) (*models.Transfer, error) {
+	transfer, err := g.TransferService.Transfer(chi.URLParam(r, "token"))
+	if err == nil && transfer.ToUserID != context.User(r.Context()).ID {
+		err = models.ErrNotFound
+	}
+	if err != nil {
+		switch {
+		case errors.Is(err, models.ErrNotFound):
+			http.Error(w, "Transfer not found", http.StatusNotFound)
+		case errors.Is(err, models.ErrLinkExpired):
+			http.Error(w, "This transfer has expired", http.StatusGone)
+		default:
+			fmt.Println(err)
+			http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		}
+		return nil, err
+	}
+	return transfer, nil
+}
@@ -0,0 +1,213 @@
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/Pupsichekk/lenslocked/context"
+	apperrors "github.com/Pupsichekk/lenslocked/errors"
+	"github.com/Pupsichekk/lenslocked/models"
+	"rsc.io/qr"
+)
+
+// TwoFactor shows whether the user needs a code from an authenticator app
+// to sign in, and lets them set it up or turn it off.
+func (u Users) TwoFactor(w http.ResponseWriter, r *http.Request) {
+	u.renderTwoFactor(w, r, twoFactorNotices{})
+}
+
+// TwoFactorQR returns the QR code authenticator apps scan to add the
+// account of the user.
+func (u Users) TwoFactorQR(w http.ResponseWriter, r *http.Request) {
+	enrollment, err := u.TwoFactorService.Enroll(context.User(r.Context()))
+	if err != nil {
+		if errors.Is(err, models.ErrTwoFactorEnabled) {
+			http.Error(w, "Two-factor authentication is already enabled", http.StatusNotFound)
+			return
+		}
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	code, err := qr.Encode(enrollment.URL, qr.M)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	code.Scale = 6
+	png := code.PNG()
+	// The QR code holds the secret, it must not end up in any cache.
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("Content-Length", strconv.Itoa(len(png)))
+	w.Write(png)
+}
+
+// EnableTwoFactor turns on two-factor authentication once the user entered
+// a code from their app. Their recovery codes are shown once, right away.
+func (u Users) EnableTwoFactor(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	codes, err := u.TwoFactorService.Enable(user.ID, r.FormValue("code"))
+	if err != nil {
+		switch {
+		case errors.Is(err, models.ErrInvalidCode):
+			err = apperrors.Public(err, "That code is incorrect, make sure the time on your phone is right.")
+			u.renderTwoFactor(w, r, twoFactorNotices{}, err)
+		case errors.Is(err, models.ErrTwoFactorEnabled), errors.Is(err, models.ErrNotFound):
+			http.Redirect(w, r, "/users/me/two-factor", http.StatusFound)
+		default:
+			fmt.Println(err)
+			http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		}
+		return
+	}
+	u.renderTwoFactor(w, r, twoFactorNotices{
+		RecoveryCodes: codes,
+		Changed:       true,
+	})
+}
+
+// DisableTwoFactor turns off two-factor authentication. Users need to enter
+// their password again, so nobody can turn it off on a device someone left
+// signed in.
+func (u Users) DisableTwoFactor(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	_, err := u.UserService.Authenticate(user.Email, r.FormValue("password"))
+	if err != nil {
+		err = apperrors.Public(err, "That password is incorrect.")
+		u.renderTwoFactor(w, r, twoFactorNotices{}, err)
+		return
+	}
+	err = u.TwoFactorService.Disable(user.ID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	u.renderTwoFactor(w, r, twoFactorNotices{Changed: true})
+}
+
+// twoFactorNotices are shown on the two-factor authentication settings right
+// after they were changed.
+type twoFactorNotices struct {
+	// RecoveryCodes are shown once, when two-factor authentication was just
+	// enabled.
+	RecoveryCodes []string
+	// Changed offers to sign out of other sessions, in case the change was
+	// made because someone else got into the account.
+	Changed bool
+}
+
+// renderTwoFactor renders the two-factor authentication settings, along
+// with notices about a change that was just made.
+func (u Users) renderTwoFactor(w http.ResponseWriter, r *http.Request, notices twoFactorNotices, errs ...error) {
+	user := context.User(r.Context())
+	var data struct {
+		Enabled           bool
+		Secret            string
+		RecoveryCodesLeft int
+		twoFactorNotices
+	}
+	data.twoFactorNotices = notices
+	var err error
+	data.Enabled, err = u.TwoFactorService.Enabled(user.ID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	if data.Enabled {
+		data.RecoveryCodesLeft, err = u.TwoFactorService.RecoveryCodesLeft(user.ID)
+	} else {
+		var enrollment *models.Enrollment
+		enrollment, err = u.TwoFactorService.Enroll(user)
+		if err == nil {
+			data.Secret = enrollment.Secret
+		}
+	}
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	u.Templates.TwoFactor.Execute(w, r, data, errs...)
+}
+
+// SignInTwoFactor asks users who entered their password for a code from
+// their authenticator app.
+func (u Users) SignInTwoFactor(w http.ResponseWriter, r *http.Request) {
+	_, err := u.twoFactorChallenge(w, r)
+	if err != nil {
+		return
+	}
+	u.Templates.SignInTwoFactor.Execute(w, r, nil)
+}
+
+// ProcessSignInTwoFactor signs the user in once they entered a code from
+// their app, or one of their recovery codes.
+func (u Users) ProcessSignInTwoFactor(w http.ResponseWriter, r *http.Request) {
+	challenge, err := u.twoFactorChallenge(w, r)
+	if err != nil {
+		return
+	}
+	// Attempts are limited per user, a challenge is easily replaced by
+	// entering the password again.
+	key := strconv.Itoa(challenge.UserID)
+	if !u.TwoFactorAttempts.Allow(key) {
+		err = apperrors.Public(fmt.Errorf("too many two-factor attempts"),
+			"Too many wrong codes, please try again later.")
+		u.Templates.SignInTwoFactor.Execute(w, r, nil, err)
+		return
+	}
+	err = u.TwoFactorService.Verify(challenge.UserID, r.FormValue("code"))
+	if err != nil {
+		if errors.Is(err, models.ErrInvalidCode) {
+			u.TwoFactorAttempts.Fail(key)
+			err = apperrors.Public(err, "That code is incorrect.")
+			u.Templates.SignInTwoFactor.Execute(w, r, nil, err)
+			return
+		}
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	err = u.TwoFactorService.DeleteChallenge(challenge.ID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	deleteCookie(w, CookieTwoFactor)
+	err = u.signIn(w, r, challenge.UserID, challenge.Remember)
+	if err != nil {
+		fmt.Println(err)
+		http.Redirect(w, r, "/signin", http.StatusFound)
+		return
+	}
+	http.Redirect(w, r, "/galleries", http.StatusFound)
+}
+
+// twoFactorChallenge looks up the sign in waiting for a code. Users without
+// one, or who took too long, are sent back to enter their password.
+func (u Users) twoFactorChallenge(w http.ResponseWriter, r *http.Request) (*models.TwoFactorChallenge, error) {
+	token, err := readCookie(r, CookieTwoFactor)
+	if err != nil {
+		http.Redirect(w, r, "/signin", http.StatusFound)
+		return nil, err
+	}
+	challenge, err := u.TwoFactorService.Challenge(token)
+	if err != nil {
+		if errors.Is(err, models.ErrNotFound) || errors.Is(err, models.ErrLinkExpired) {
+			deleteCookie(w, CookieTwoFactor)
+			http.Redirect(w, r, "/signin", http.StatusFound)
+			return nil, err
+		}
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return nil, err
+	}
+	return challenge, nil
+}
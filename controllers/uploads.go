@@ -0,0 +1,261 @@
+package controllers
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/Pupsichekk/lenslocked/context"
+	"github.com/Pupsichekk/lenslocked/models"
+	"github.com/go-chi/chi/v5"
+)
+
+// The handlers in this file implement the core of the tus resumable upload
+// protocol (https://tus.io/protocols/resumable-upload), along with its
+// creation, expiration and termination extensions, under /galleries/{id}/uploads.
+
+const (
+	tusVersion    = "1.0.0"
+	tusExtensions = "creation,expiration,termination"
+)
+
+// UploadOptions tells tus clients which protocol version and extensions are
+// supported.
+func (g Galleries) UploadOptions(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Tus-Resumable", tusVersion)
+	w.Header().Set("Tus-Version", tusVersion)
+	w.Header().Set("Tus-Extension", tusExtensions)
+	w.Header().Set("Tus-Max-Size", strconv.FormatInt(g.UploadService.SizeLimit(), 10))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (g Galleries) CreateUpload(w http.ResponseWriter, r *http.Request) {
+	if !tusResumable(w, r) {
+		return
+	}
+	gallery, err := g.galleryByID(w, r, g.userMustHaveRole(models.RoleContributor))
+	if err != nil {
+		return
+	}
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		http.Error(w, "Invalid Upload-Length", http.StatusBadRequest)
+		return
+	}
+	filename := filepath.Base(tusMetadata(r.Header.Get("Upload-Metadata"))["filename"])
+	if filename == "." || filename == "/" {
+		http.Error(w, "Upload-Metadata needs to include a filename", http.StatusBadRequest)
+		return
+	}
+	user := context.User(r.Context())
+	// Images count towards the storage of the gallery owner, whoever
+	// uploads them.
+	used, err := g.GalleryService.StorageUsed(gallery.UserID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	if !g.Limits.UserAllows(used, length) {
+		g.uploadError(w, filename, errStorageLimit)
+		return
+	}
+	upload, err := g.UploadService.Create(gallery.ID, user.ID, filename, length)
+	if err != nil {
+		if errors.Is(err, models.ErrUploadSize) {
+			msg := fmt.Sprintf("%v is larger than the maximum of %s", filename, formatBytes(g.UploadService.SizeLimit()))
+			http.Error(w, msg, http.StatusRequestEntityTooLarge)
+			return
+		}
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Location", fmt.Sprintf("/galleries/%d/uploads/%s", gallery.ID, upload.ID))
+	w.Header().Set("Upload-Expires", upload.ExpiresAt.UTC().Format(http.TimeFormat))
+	w.WriteHeader(http.StatusCreated)
+}
+
+// UploadOffset tells a tus client how much of an upload was received, so it
+// knows where to resume.
+func (g Galleries) UploadOffset(w http.ResponseWriter, r *http.Request) {
+	if !tusResumable(w, r) {
+		return
+	}
+	_, upload, err := g.uploadByID(w, r)
+	if err != nil {
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Upload-Expires", upload.ExpiresAt.UTC().Format(http.TimeFormat))
+	w.Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(upload.Length, 10))
+	w.WriteHeader(http.StatusOK)
+}
+
+// ContinueUpload receives the next part of an upload. Once all of it has been
+// received, the file is added to the gallery like any other uploaded image.
+func (g Galleries) ContinueUpload(w http.ResponseWriter, r *http.Request) {
+	if !tusResumable(w, r) {
+		return
+	}
+	if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+		http.Error(w, "Content-Type must be application/offset+octet-stream", http.StatusUnsupportedMediaType)
+		return
+	}
+	gallery, upload, err := g.uploadByID(w, r)
+	if err != nil {
+		return
+	}
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid Upload-Offset", http.StatusBadRequest)
+		return
+	}
+	err = g.UploadService.Append(upload, offset, r.Body)
+	if err != nil {
+		switch {
+		case errors.Is(err, models.ErrUploadOffset):
+			http.Error(w, "Upload-Offset does not match the received data", http.StatusConflict)
+		case errors.Is(err, models.ErrUploadSize):
+			http.Error(w, "Upload exceeds its Upload-Length", http.StatusRequestEntityTooLarge)
+		case errors.Is(err, models.ErrNotFound):
+			http.Error(w, "Upload not found", http.StatusNotFound)
+		default:
+			// Most likely the connection dropped, the client can find out
+			// what was received and resume.
+			fmt.Println(err)
+			http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		}
+		return
+	}
+	if upload.Complete() {
+		err = g.completeUpload(gallery, upload)
+		if err != nil {
+			var fileError models.FileError
+			switch {
+			case errors.As(err, &fileError):
+				msg := fmt.Sprintf("%v has an invalid content type or extension. Only png, gif and jpg files can be uploaded", upload.Filename)
+				http.Error(w, msg, http.StatusUnprocessableEntity)
+			case errors.Is(err, errStorageLimit):
+				g.uploadError(w, upload.Filename, err)
+			default:
+				fmt.Println(err)
+				http.Error(w, "Something went wrong", http.StatusInternalServerError)
+			}
+			return
+		}
+	} else {
+		w.Header().Set("Upload-Expires", upload.ExpiresAt.UTC().Format(http.TimeFormat))
+	}
+	w.Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (g Galleries) CancelUpload(w http.ResponseWriter, r *http.Request) {
+	if !tusResumable(w, r) {
+		return
+	}
+	_, upload, err := g.uploadByID(w, r)
+	if err != nil {
+		return
+	}
+	err = g.UploadService.Delete(upload)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// completeUpload hands a fully received upload to the gallery service. The
+// upload is removed whether or not the file turns out to be a valid image.
+// The storage limit was checked when the upload was created, but other
+// images may have been added to the gallery since, so it is checked again.
+func (g Galleries) completeUpload(gallery *models.Gallery, upload *models.Upload) error {
+	defer func() {
+		err := g.UploadService.Delete(upload)
+		if err != nil {
+			fmt.Println(err)
+		}
+	}()
+	used, err := g.GalleryService.StorageUsed(gallery.UserID)
+	if err != nil {
+		return fmt.Errorf("complete upload: %w", err)
+	}
+	if !g.Limits.UserAllows(used, upload.Length) {
+		return fmt.Errorf("complete upload: %w", errStorageLimit)
+	}
+	file, err := g.UploadService.Open(upload)
+	if err != nil {
+		return fmt.Errorf("complete upload: %w", err)
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+	_, err = g.GalleryService.CreateImage(upload.GalleryID, upload.Filename, file)
+	if err != nil {
+		return fmt.Errorf("complete upload: %w", err)
+	}
+	return nil
+}
+
+// uploadByID looks up the upload in the URL along with its gallery, making
+// sure it belongs to the gallery in the URL and the user making the request,
+// who still needs to be allowed to add images to the gallery.
+func (g Galleries) uploadByID(w http.ResponseWriter, r *http.Request) (*models.Gallery, *models.Upload, error) {
+	gallery, err := g.galleryByID(w, r, g.userMustHaveRole(models.RoleContributor))
+	if err != nil {
+		return nil, nil, err
+	}
+	upload, err := g.UploadService.ByID(gallery.ID, chi.URLParam(r, "uploadID"))
+	if err == nil && upload.UserID != context.User(r.Context()).ID {
+		err = models.ErrNotFound
+	}
+	if err != nil {
+		if errors.Is(err, models.ErrNotFound) {
+			http.Error(w, "Upload not found", http.StatusNotFound)
+			return nil, nil, err
+		}
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return nil, nil, err
+	}
+	return gallery, upload, nil
+}
+
+// tusResumable sets the Tus-Resumable header every response needs and makes
+// sure the client speaks the same protocol version, writing an error
+// response if it doesn't.
+func tusResumable(w http.ResponseWriter, r *http.Request) bool {
+	w.Header().Set("Tus-Resumable", tusVersion)
+	if r.Header.Get("Tus-Resumable") != tusVersion {
+		w.Header().Set("Tus-Version", tusVersion)
+		http.Error(w, "Unsupported tus version", http.StatusPreconditionFailed)
+		return false
+	}
+	return true
+}
+
+// tusMetadata parses an Upload-Metadata header, which is a comma separated
+// list of keys, each followed by a space and a base64 encoded value.
+func tusMetadata(header string) map[string]string {
+	metadata := make(map[string]string)
+	for _, pair := range strings.Split(header, ",") {
+		key, encoded, _ := strings.Cut(strings.TrimSpace(pair), " ")
+		if key == "" {
+			continue
+		}
+		value, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			continue
+		}
+		metadata[key] = string(value)
+	}
+	return metadata
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"net/http"
 	"net/url"
+	"time"
 
 	"github.com/Pupsichekk/lenslocked/context"
 	apperrors "github.com/Pupsichekk/lenslocked/errors"
@@ -18,12 +19,27 @@ type Users struct {
 		ForgotPassword Template
 		CheckYourEmail Template
 		ResetPassword  Template
+		CurrentUser    Template
+		Sessions       Template
+		TwoFactor      Template
+		// SignInTwoFactor asks for a code after the password was entered.
+		SignInTwoFactor Template
+		Passkeys        Template
 	}
 	UserService          *models.UserService
 	SessionService       *models.SessionService
 	PasswordResetService *models.PasswordResetService
 	EmailService         *models.EmailService
 	GalleryService       *models.GalleryService
+	TwoFactorService     *models.TwoFactorService
+	PasskeyService       *models.PasskeyService
+	// TwoFactorAttempts limits how many wrong codes can be entered when
+	// signing in, and how many wrong passwords or codes when adding a
+	// passkey.
+	TwoFactorAttempts *AttemptLimiter
+	// BaseURL is the URL the site is served from, e.g.
+	// "https://example.com", used for links that are sent to people.
+	BaseURL string
 }
 
 func (u Users) New(w http.ResponseWriter, r *http.Request) {
@@ -50,12 +66,11 @@ func (u Users) Create(w http.ResponseWriter, r *http.Request) {
 		u.Templates.New.Execute(w, r, data, err)
 		return
 	}
-	session, err := u.SessionService.Create(user.ID)
+	err = u.signIn(w, r, user.ID, false)
 	if err != nil {
 		http.Redirect(w, r, "/signin", http.StatusFound)
 		return
 	}
-	setCookie(w, CookieSession, session.Token)
 	http.Redirect(w, r, "/users/me", http.StatusFound)
 }
 
@@ -76,20 +91,41 @@ func (u Users) ProcessSignIn(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "invalid password", http.StatusUnauthorized)
 		return
 	}
-	session, err := u.SessionService.Create(user.ID)
+	err = u.passwordVerified(w, r, user.ID, r.FormValue("remember") == "true")
 	if err != nil {
 		fmt.Println(err)
 		http.Error(w, "invalid cridentials", http.StatusUnauthorized)
 		return
 	}
-	setCookie(w, CookieSession, session.Token)
-	http.Redirect(w, r, "/galleries", http.StatusFound)
-	fmt.Fprintf(w, "Successfully signed in: %+v", user)
 }
 
 func (u Users) CurrentUser(w http.ResponseWriter, r *http.Request) {
 	user := context.User(r.Context())
-	fmt.Fprintf(w, "Current user: %+v", user.Email)
+	var data struct {
+		Email         string
+		StripMetadata bool
+	}
+	data.Email = user.Email
+	strip, err := u.UserService.StripsMetadata(user.ID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	data.StripMetadata = strip
+	u.Templates.CurrentUser.Execute(w, r, data)
+}
+
+func (u Users) UpdatePrivacy(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	strip := r.FormValue("strip_metadata") == "true"
+	err := u.UserService.UpdateStripMetadata(user.ID, strip)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/users/me", http.StatusFound)
 }
 
 func (u Users) ProcessSignOut(w http.ResponseWriter, r *http.Request) {
@@ -129,9 +165,7 @@ func (u Users) ProcessForgotPassword(w http.ResponseWriter, r *http.Request) {
 	vals := url.Values{
 		"token": {pwReset.TokenHash},
 	}
-	// Go has no way of knowing it's environment so for now this will do i guess????
-	// But it's ugly :(
-	resetURL := "https://localhost:443/reset-pw?" + vals.Encode()
+	resetURL := u.BaseURL + "/reset-pw?" + vals.Encode()
 	if err = u.EmailService.ForgotPassword(data.Email, resetURL); err != nil {
 		http.Error(w, "Something went wrong", http.StatusInternalServerError)
 		return
@@ -187,14 +221,55 @@ func (u Users) ProcessResetPassword(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Something went wrong", http.StatusInternalServerError)
 		return
 	}
-	session, err := u.SessionService.Create(user.ID)
+	// UpdatePassword signed the user out everywhere and removed their
+	// passkeys, including any session or passkey someone stole, which is
+	// often why passwords are reset. Only the session started here is left.
+	err = u.passwordVerified(w, r, user.ID, false)
 	if err != nil {
 		fmt.Println(err)
 		http.Redirect(w, r, "/signin", http.StatusFound)
 		return
 	}
-	setCookie(w, CookieSession, session.Token)
-	http.Redirect(w, r, "/galleries", http.StatusFound)
+}
+
+// passwordVerified continues signing in a user who entered their password.
+// Users with two-factor authentication are asked for a code before they get
+// a session, everyone else is signed in right away.
+func (u Users) passwordVerified(w http.ResponseWriter, r *http.Request, userID int, remember bool) error {
+	enabled, err := u.TwoFactorService.Enabled(userID)
+	if err != nil {
+		return err
+	}
+	if !enabled {
+		err = u.signIn(w, r, userID, remember)
+		if err != nil {
+			return err
+		}
+		http.Redirect(w, r, "/galleries", http.StatusFound)
+		return nil
+	}
+	challenge, err := u.TwoFactorService.StartChallenge(userID, remember)
+	if err != nil {
+		return err
+	}
+	setCookie(w, CookieTwoFactor, challenge.Token)
+	http.Redirect(w, r, "/signin/two-factor", http.StatusFound)
+	return nil
+}
+
+// signIn starts a new session for a user on the client making the request.
+// Sessions of users who asked to be remembered outlive the browser session.
+func (u Users) signIn(w http.ResponseWriter, r *http.Request, userID int, remember bool) error {
+	session, err := u.SessionService.Create(userID, r.UserAgent(), clientIP(r), remember)
+	if err != nil {
+		return err
+	}
+	var maxAge time.Duration
+	if session.Remember {
+		maxAge = u.SessionService.MaxAge(session)
+	}
+	setSessionCookie(w, session.Token, maxAge)
+	return nil
 }
 
 type UserMiddleware struct {
@@ -208,11 +283,19 @@ func (umw UserMiddleware) SetUser(next http.Handler) http.Handler {
 			next.ServeHTTP(w, r)
 			return
 		}
-		user, err := umw.SessionService.User(token)
+		user, session, err := umw.SessionService.User(token)
 		if err != nil {
+			if errors.Is(err, models.ErrNotFound) {
+				deleteCookie(w, CookieSession)
+			}
 			next.ServeHTTP(w, r)
 			return
 		}
+		// Remembered sessions only time out when they aren't used, so each
+		// use pushes back when their cookie expires.
+		if session.Remember {
+			setSessionCookie(w, token, umw.SessionService.MaxAge(session))
+		}
 		ctx := r.Context()
 		ctx = context.WithUser(ctx, user)
 		r = r.WithContext(ctx)
@@ -225,6 +308,7 @@ func (umw UserMiddleware) RequireUser(next http.Handler) http.Handler {
 		user := context.User(r.Context())
 		if user == nil {
 			http.Redirect(w, r, "/signin", http.StatusFound)
+			return
 		}
 		next.ServeHTTP(w, r)
 	})
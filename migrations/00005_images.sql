@@ -0,0 +1,20 @@
+-- +goose Up
+-- +goose StatementBegin
+create table images (
+  id serial primary key,
+  gallery_id int not null references galleries (id) on delete cascade,
+  filename text not null,
+  storage_key text not null,
+  size bigint not null,
+  content_type text not null,
+  width int not null,
+  height int not null,
+  uploaded_at timestamptz not null default now(),
+  unique (gallery_id, filename)
+);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+drop table images;
+-- +goose StatementEnd
@@ -0,0 +1,17 @@
+-- +goose Up
+-- +goose StatementBegin
+create table image_renditions (
+  id serial primary key,
+  image_id int not null references images (id) on delete cascade,
+  size int not null,
+  storage_key text not null,
+  width int not null,
+  height int not null,
+  unique (image_id, size)
+);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+drop table image_renditions;
+-- +goose StatementEnd
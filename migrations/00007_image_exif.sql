@@ -0,0 +1,21 @@
+-- +goose Up
+-- +goose StatementBegin
+create table image_exif (
+  image_id int primary key references images (id) on delete cascade,
+  taken_at timestamp,
+  camera_make text not null default '',
+  camera_model text not null default '',
+  lens_model text not null default '',
+  exposure_time text not null default '',
+  f_number real not null default 0,
+  iso int not null default 0,
+  focal_length real not null default 0,
+  latitude double precision,
+  longitude double precision
+);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+drop table image_exif;
+-- +goose StatementEnd
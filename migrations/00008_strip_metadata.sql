@@ -0,0 +1,15 @@
+-- +goose Up
+-- +goose StatementBegin
+alter table users
+  add column strip_metadata boolean not null default true;
+alter table galleries
+  add column strip_metadata boolean;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+alter table galleries
+  drop column strip_metadata;
+alter table users
+  drop column strip_metadata;
+-- +goose StatementEnd
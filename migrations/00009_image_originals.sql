@@ -0,0 +1,11 @@
+-- +goose Up
+-- +goose StatementBegin
+alter table images
+  add column original_key text not null default '';
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+alter table images
+  drop column original_key;
+-- +goose StatementEnd
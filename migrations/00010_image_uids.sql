@@ -0,0 +1,20 @@
+-- +goose Up
+-- +goose StatementBegin
+alter table images
+  add column uid text;
+update images
+  set uid = md5(random()::text || id::text);
+alter table images
+  alter column uid set not null,
+  add constraint images_uid_key unique (uid),
+  drop constraint images_gallery_id_filename_key;
+create index images_gallery_id_filename_idx on images (gallery_id, filename);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+drop index images_gallery_id_filename_idx;
+alter table images
+  drop column uid,
+  add constraint images_gallery_id_filename_key unique (gallery_id, filename);
+-- +goose StatementEnd
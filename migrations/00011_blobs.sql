@@ -0,0 +1,23 @@
+-- +goose Up
+-- +goose StatementBegin
+create table blobs (
+  hash text primary key,
+  storage_key text not null,
+  original_key text not null default '',
+  size bigint not null,
+  content_type text not null,
+  width int not null,
+  height int not null,
+  ref_count int not null
+);
+alter table images
+  add column blob_hash text references blobs (hash);
+create index images_blob_hash_idx on images (blob_hash);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+alter table images
+  drop column blob_hash;
+drop table blobs;
+-- +goose StatementEnd
@@ -0,0 +1,17 @@
+-- +goose Up
+-- +goose StatementBegin
+create table uploads (
+  id text primary key,
+  gallery_id int not null references galleries (id) on delete cascade,
+  user_id int not null references users (id) on delete cascade,
+  filename text not null,
+  length bigint not null,
+  upload_offset bigint not null default 0,
+  created_at timestamptz not null default now()
+);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+drop table uploads;
+-- +goose StatementEnd
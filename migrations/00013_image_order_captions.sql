@@ -0,0 +1,28 @@
+-- +goose Up
+-- +goose StatementBegin
+alter table images
+  add column position integer not null default 0,
+  add column caption text not null default '',
+  add column alt_text text not null default '';
+update images
+  set position = ordered.position
+  from (
+    select id, row_number() over (partition by gallery_id order by uploaded_at, id) as position
+    from images
+  ) as ordered
+  where images.id = ordered.id;
+create index images_gallery_id_position_idx on images (gallery_id, position);
+alter table galleries
+  add column cover_image_id integer references images (id) on delete set null;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+alter table galleries
+  drop column cover_image_id;
+drop index images_gallery_id_position_idx;
+alter table images
+  drop column position,
+  drop column caption,
+  drop column alt_text;
+-- +goose StatementEnd
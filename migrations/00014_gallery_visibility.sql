@@ -0,0 +1,24 @@
+-- +goose Up
+-- +goose StatementBegin
+-- Galleries that already exist stay public, so links to them keep working.
+-- New galleries are private until their owner shares them.
+alter table galleries
+  add column visibility text not null default 'public',
+  add column slug text,
+  add constraint galleries_visibility_check
+    check (visibility in ('private', 'unlisted', 'public'));
+alter table galleries
+  alter column visibility set default 'private';
+update galleries
+  set slug = md5(random()::text || id::text);
+alter table galleries
+  alter column slug set not null,
+  add constraint galleries_slug_key unique (slug);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+alter table galleries
+  drop column slug,
+  drop column visibility;
+-- +goose StatementEnd
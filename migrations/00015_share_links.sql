@@ -0,0 +1,19 @@
+-- +goose Up
+-- +goose StatementBegin
+create table share_links (
+  id serial primary key,
+  gallery_id int not null references galleries (id) on delete cascade,
+  token_hash text unique not null,
+  allow_download boolean not null default false,
+  expires_at timestamptz,
+  max_views int not null default 0,
+  views int not null default 0,
+  created_at timestamptz not null default now()
+);
+create index share_links_gallery_id_idx on share_links (gallery_id);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+drop table share_links;
+-- +goose StatementEnd
@@ -0,0 +1,16 @@
+-- +goose Up
+-- +goose StatementBegin
+create table gallery_collaborators (
+  gallery_id int not null references galleries (id) on delete cascade,
+  user_id int not null references users (id) on delete cascade,
+  role text not null check (role in ('viewer', 'contributor', 'editor')),
+  created_at timestamptz not null default now(),
+  primary key (gallery_id, user_id)
+);
+create index gallery_collaborators_user_id_idx on gallery_collaborators (user_id);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+drop table gallery_collaborators;
+-- +goose StatementEnd
@@ -0,0 +1,39 @@
+-- +goose Up
+-- +goose StatementBegin
+create table organizations (
+  id serial primary key,
+  name text not null,
+  created_at timestamptz not null default now()
+);
+create table organization_members (
+  organization_id int not null references organizations (id) on delete cascade,
+  user_id int not null references users (id) on delete cascade,
+  role text not null check (role in ('member', 'admin')),
+  created_at timestamptz not null default now(),
+  primary key (organization_id, user_id)
+);
+create index organization_members_user_id_idx on organization_members (user_id);
+create table organization_invitations (
+  id serial primary key,
+  organization_id int not null references organizations (id) on delete cascade,
+  email text not null,
+  role text not null check (role in ('member', 'admin')),
+  token_hash text unique not null,
+  invited_by int references users (id) on delete set null,
+  expires_at timestamptz not null,
+  created_at timestamptz not null default now(),
+  unique (organization_id, email)
+);
+alter table galleries
+  add column organization_id int references organizations (id) on delete set null;
+create index galleries_organization_id_idx on galleries (organization_id);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+alter table galleries
+  drop column organization_id;
+drop table organization_invitations;
+drop table organization_members;
+drop table organizations;
+-- +goose StatementEnd
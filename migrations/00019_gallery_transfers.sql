@@ -0,0 +1,29 @@
+-- +goose Up
+-- +goose StatementBegin
+create table gallery_transfers (
+  id serial primary key,
+  gallery_id int unique not null references galleries (id) on delete cascade,
+  from_user_id int not null references users (id) on delete cascade,
+  to_user_id int not null references users (id) on delete cascade,
+  token_hash text unique not null,
+  expires_at timestamptz not null,
+  created_at timestamptz not null default now()
+);
+-- Audit entries outlive the users and galleries they are about, so they
+-- don't reference them.
+create table audit_log (
+  id serial primary key,
+  action text not null,
+  actor_id int,
+  gallery_id int,
+  details jsonb not null default '{}',
+  created_at timestamptz not null default now()
+);
+create index audit_log_gallery_id_idx on audit_log (gallery_id);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+drop table audit_log;
+drop table gallery_transfers;
+-- +goose StatementEnd
@@ -0,0 +1,17 @@
+-- +goose Up
+-- +goose StatementBegin
+-- Albums are galleries inside other galleries. root_id is the top level
+-- gallery of an album, whose owner, visibility and password it shares.
+alter table galleries
+  add column parent_id int references galleries (id) on delete cascade,
+  add column root_id int references galleries (id) on delete cascade;
+create index galleries_parent_id_idx on galleries (parent_id);
+create index galleries_root_id_idx on galleries (root_id);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+alter table galleries
+  drop column root_id,
+  drop column parent_id;
+-- +goose StatementEnd
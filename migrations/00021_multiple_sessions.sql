@@ -0,0 +1,28 @@
+-- +goose Up
+-- +goose StatementBegin
+alter table sessions
+  drop constraint sessions_user_id_key,
+  add column user_agent text not null default '',
+  add column ip_address text not null default '',
+  add column created_at timestamptz not null default now(),
+  add column last_seen_at timestamptz not null default now();
+create index sessions_user_id_idx on sessions (user_id);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+-- Only the most recent session of each user can be kept.
+delete from sessions
+where id not in (
+  select max(id)
+  from sessions
+  group by user_id
+);
+drop index sessions_user_id_idx;
+alter table sessions
+  drop column last_seen_at,
+  drop column created_at,
+  drop column ip_address,
+  drop column user_agent,
+  add constraint sessions_user_id_key unique (user_id);
+-- +goose StatementEnd
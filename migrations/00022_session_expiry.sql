@@ -0,0 +1,20 @@
+-- +goose Up
+-- +goose StatementBegin
+alter table sessions
+  add column remember boolean not null default false,
+  add column expires_at timestamptz;
+-- Sessions from before expiry get a day, so nobody is signed out right away.
+update sessions
+set expires_at = now() + interval '1 day';
+alter table sessions
+  alter column expires_at set not null;
+create index sessions_expires_at_idx on sessions (expires_at);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+drop index sessions_expires_at_idx;
+alter table sessions
+  drop column expires_at,
+  drop column remember;
+-- +goose StatementEnd
@@ -0,0 +1,33 @@
+-- +goose Up
+-- +goose StatementBegin
+create table two_factor (
+  user_id int primary key references users (id) on delete cascade,
+  secret text not null,
+  -- enabled_at is null while the user is still setting up their app.
+  enabled_at timestamptz,
+  -- last_step is the time step of the last code used, so codes can't be
+  -- used twice.
+  last_step bigint not null default 0
+);
+create table recovery_codes (
+  id serial primary key,
+  user_id int not null references users (id) on delete cascade,
+  -- code_hash is a bcrypt hash, like password hashes.
+  code_hash text not null,
+  used_at timestamptz
+);
+create table two_factor_challenges (
+  id serial primary key,
+  user_id int not null references users (id) on delete cascade,
+  token_hash text unique not null,
+  remember boolean not null default false,
+  expires_at timestamptz not null
+);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+drop table two_factor_challenges;
+drop table recovery_codes;
+drop table two_factor;
+-- +goose StatementEnd
@@ -0,0 +1,34 @@
+-- +goose Up
+-- +goose StatementBegin
+-- passkey_handle identifies users to their authenticators without giving
+-- away their ID. It is set when they register their first passkey.
+alter table users
+  add column passkey_handle bytea unique;
+create table passkeys (
+  id serial primary key,
+  user_id int not null references users (id) on delete cascade,
+  name text not null default '',
+  credential_id bytea unique not null,
+  -- credential holds the public key, sign count and flags of the passkey.
+  credential jsonb not null,
+  created_at timestamptz not null default now(),
+  last_used_at timestamptz
+);
+create index passkeys_user_id_idx on passkeys (user_id);
+create table passkey_ceremonies (
+  id serial primary key,
+  -- user_id is null when signing in, the passkey tells who the user is.
+  user_id int references users (id) on delete cascade,
+  token_hash text unique not null,
+  session_data jsonb not null,
+  expires_at timestamptz not null
+);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+drop table passkey_ceremonies;
+drop table passkeys;
+alter table users
+  drop column passkey_handle;
+-- +goose StatementEnd
@@ -0,0 +1,20 @@
+-- +goose Up
+-- +goose StatementBegin
+-- 00014_gallery_visibility.sql kept galleries that already existed public and
+-- gave them slugs made with random(), 00010_image_uids.sql did the same for
+-- the UIDs of images that already existed. Those values can be predicted.
+-- Nobody chose to publish those galleries, so they become private, and their
+-- owners need to share them again. Galleries created since got slugs from
+-- rand.String, which never look like md5 sums, so they keep their visibility.
+create extension if not exists pgcrypto;
+update galleries
+  set visibility = 'private',
+    slug = translate(encode(gen_random_bytes(18), 'base64'), '+/', '-_')
+  where slug ~ '^[0-9a-f]{32}$';
+update images
+  set uid = translate(encode(gen_random_bytes(12), 'base64'), '+/', '-_')
+  where uid ~ '^[0-9a-f]{32}$';
+-- +goose StatementEnd
+
+-- +goose Down
+-- The old slugs and UIDs are gone for good, there is nothing to undo.
@@ -0,0 +1,16 @@
+-- +goose Up
+-- +goose StatementBegin
+-- Uploads that were abandoned are deleted once they expire. Those already
+-- in progress get a day to finish.
+alter table uploads
+  add column expires_at timestamptz not null default now() + interval '1 day';
+alter table uploads
+  alter column expires_at drop default;
+create index uploads_expires_at_idx on uploads (expires_at);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+alter table uploads
+  drop column expires_at;
+-- +goose StatementEnd
@@ -0,0 +1,18 @@
+-- +goose Up
+-- +goose StatementBegin
+-- Every time a share link is opened, the visitor gets a view of their own,
+-- which grants access until it expires. Cookies holding the token of the
+-- share link itself stop working.
+create table share_views (
+  id serial primary key,
+  share_link_id int not null references share_links (id) on delete cascade,
+  token_hash text unique not null,
+  expires_at timestamptz not null
+);
+create index share_views_expires_at_idx on share_views (expires_at);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+drop table share_views;
+-- +goose StatementEnd
@@ -0,0 +1,122 @@
+package models
+
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/Pupsichekk/lenslocked/rand"
+)
+
+// CreateAlbum creates an album inside parent. The album shares the owner,
+// organization, visibility and password of the root gallery of parent.
+func (service *GalleryService) CreateAlbum(parent *Gallery, title string) (*Gallery, error) {
+	slug, err := rand.String(bytesPerSlug)
+	if err != nil {
+		return nil, fmt.Errorf("create album: %w", err)
+	}
+	album := Gallery{
+		Title:          title,
+		UserID:         parent.UserID,
+		Visibility:     parent.Visibility,
+		Slug:           slug,
+		PasswordHash:   parent.PasswordHash,
+		OrganizationID: parent.OrganizationID,
+		ParentID:       parent.ID,
+		RootID:         parent.RootID,
+	}
+	row := service.DB.QueryRow(`
+	insert into galleries (title, user_id, visibility, slug, password_hash, organization_id,
+		parent_id, root_id)
+	values ($1, $2, $3, $4, nullif($5, ''), nullif($6, 0), $7, $8)
+	returning id;`, album.Title, album.UserID, album.Visibility, album.Slug,
+		album.PasswordHash, album.OrganizationID, album.ParentID, album.RootID)
+	err = row.Scan(&album.ID)
+	if err != nil {
+		return nil, fmt.Errorf("create album: %w", err)
+	}
+	return &album, nil
+}
+
+// Albums returns the albums directly inside a gallery, ordered by title.
+func (service *GalleryService) Albums(gallery *Gallery) ([]Gallery, error) {
+	rows, err := service.DB.Query(`
+	select id, title, coalesce(cover_image_id, 0), slug, strip_metadata
+	from galleries
+	where parent_id = $1
+	order by title, id;`, gallery.ID)
+	if err != nil {
+		return nil, fmt.Errorf("query albums: %w", err)
+	}
+	defer rows.Close()
+	var albums []Gallery
+	for rows.Next() {
+		// Albums share everything but their title and images with the root
+		// gallery.
+		album := Gallery{
+			UserID:         gallery.UserID,
+			Visibility:     gallery.Visibility,
+			PasswordHash:   gallery.PasswordHash,
+			OrganizationID: gallery.OrganizationID,
+			ParentID:       gallery.ID,
+			RootID:         gallery.RootID,
+		}
+		var stripMetadata sql.NullBool
+		err := rows.Scan(&album.ID, &album.Title, &album.CoverImageID, &album.Slug, &stripMetadata)
+		if err != nil {
+			return nil, fmt.Errorf("query albums: %w", err)
+		}
+		if stripMetadata.Valid {
+			album.StripMetadata = &stripMetadata.Bool
+		}
+		albums = append(albums, album)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("query albums: %w", err)
+	}
+	return albums, nil
+}
+
+// Ancestors returns the galleries an album is in, starting with its root
+// gallery and ending with its parent. Top level galleries have none.
+func (service *GalleryService) Ancestors(gallery *Gallery) ([]Gallery, error) {
+	if !gallery.IsAlbum() {
+		return nil, nil
+	}
+	rows, err := service.DB.Query(`
+	with recursive ancestors as (
+		select id, title, slug, parent_id, 1 as depth
+		from galleries
+		where id = $1
+		union all
+		select galleries.id, galleries.title, galleries.slug, galleries.parent_id,
+			ancestors.depth + 1
+		from galleries
+		join ancestors on galleries.id = ancestors.parent_id
+	)
+	select id, title, slug, coalesce(parent_id, 0)
+	from ancestors
+	order by depth desc;`, gallery.ParentID)
+	if err != nil {
+		return nil, fmt.Errorf("query ancestors: %w", err)
+	}
+	defer rows.Close()
+	var ancestors []Gallery
+	for rows.Next() {
+		ancestor := Gallery{
+			UserID:         gallery.UserID,
+			Visibility:     gallery.Visibility,
+			PasswordHash:   gallery.PasswordHash,
+			OrganizationID: gallery.OrganizationID,
+			RootID:         gallery.RootID,
+		}
+		err := rows.Scan(&ancestor.ID, &ancestor.Title, &ancestor.Slug, &ancestor.ParentID)
+		if err != nil {
+			return nil, fmt.Errorf("query ancestors: %w", err)
+		}
+		ancestors = append(ancestors, ancestor)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("query ancestors: %w", err)
+	}
+	return ancestors, nil
+}
@@ -0,0 +1,88 @@
+package models
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// AuditAction is what an audit entry records.
+type AuditAction string
+
+const (
+	// AuditGalleryTransferred records a gallery being transferred to
+	// another user. Its details hold the emails of both users.
+	AuditGalleryTransferred AuditAction = "gallery.transferred"
+	// AuditOrganizationDeleted records the organization a gallery belonged
+	// to being deleted, and the gallery going to the admin who deleted it.
+	// Its details hold the name of the organization and the admin's email.
+	AuditOrganizationDeleted AuditAction = "organization.deleted"
+)
+
+// AuditEntry records an action that changed who is responsible for
+// something, so it can be looked up later. Entries are kept after the users
+// and galleries they mention are deleted.
+type AuditEntry struct {
+	ID     int
+	Action AuditAction
+	// ActorID is the ID of the user who did the action.
+	ActorID   int
+	GalleryID int
+	Details   map[string]string
+	CreatedAt time.Time
+}
+
+type AuditService struct {
+	DB *sql.DB
+}
+
+// ByGalleryID returns the audit entries of a gallery, newest first.
+func (service *AuditService) ByGalleryID(galleryID int) ([]AuditEntry, error) {
+	rows, err := service.DB.Query(`
+	select id, action, coalesce(actor_id, 0), details, created_at
+	from audit_log
+	where gallery_id = $1
+	order by created_at desc, id desc;`, galleryID)
+	if err != nil {
+		return nil, fmt.Errorf("query audit log: %w", err)
+	}
+	defer rows.Close()
+	var entries []AuditEntry
+	for rows.Next() {
+		entry := AuditEntry{
+			GalleryID: galleryID,
+		}
+		var details []byte
+		err := rows.Scan(&entry.ID, &entry.Action, &entry.ActorID, &details, &entry.CreatedAt)
+		if err != nil {
+			return nil, fmt.Errorf("query audit log: %w", err)
+		}
+		err = json.Unmarshal(details, &entry.Details)
+		if err != nil {
+			return nil, fmt.Errorf("query audit log: %w", err)
+		}
+		entries = append(entries, entry)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("query audit log: %w", err)
+	}
+	return entries, nil
+}
+
+// recordAudit adds an entry to the audit log as part of tx, so the entry is
+// only kept if the action it records is.
+func recordAudit(tx *sql.Tx, entry AuditEntry) error {
+	details, err := json.Marshal(entry.Details)
+	if err != nil {
+		return fmt.Errorf("record audit: %w", err)
+	}
+	_, err = tx.Exec(`
+	insert into audit_log (action, actor_id, gallery_id, details)
+	values ($1, nullif($2, 0), nullif($3, 0), $4);`, entry.Action, entry.ActorID,
+		entry.GalleryID, details)
+	if err != nil {
+		return fmt.Errorf("record audit: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,194 @@
+package models
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Images with identical contents share a blob: the stored image, its archived
+// original and its renditions are only kept once, under blobPrefix, no matter
+// how many images reference them. A blob is removed once its reference count
+// drops to zero.
+
+// blobPrefix returns the storage key prefix of every file derived from the
+// uploaded contents with the given hash. The prefix includes the UID of the
+// image that created the blob, so a blob that is recreated right after being
+// released never shares files with the released one.
+func blobPrefix(hash, uid string) string {
+	return "blobs/" + hash + "/" + uid + "/"
+}
+
+// hashContents returns the hex encoded SHA-256 hash of r, seeking back to the
+// start afterwards.
+func hashContents(r io.ReadSeeker) (string, error) {
+	h := sha256.New()
+	_, err := io.Copy(h, r)
+	if err != nil {
+		return "", fmt.Errorf("hash contents: %w", err)
+	}
+	_, err = r.Seek(0, io.SeekStart)
+	if err != nil {
+		return "", fmt.Errorf("hash contents: %w", err)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// acquireBlob adds a reference to the blob with the given hash and fills in
+// the stored file details of img from it. If no such blob exists, ok is false.
+func (service *GalleryService) acquireBlob(tx *sql.Tx, img *Image, hash string) (bool, error) {
+	row := tx.QueryRow(`
+	update blobs
+	set ref_count = ref_count + 1
+	where hash = $1
+	returning storage_key, original_key, size, content_type, width, height;`, hash)
+	err := row.Scan(&img.Key, &img.OriginalKey, &img.Size, &img.ContentType,
+		&img.Width, &img.Height)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return false, nil
+		}
+		return false, fmt.Errorf("acquire blob: %w", err)
+	}
+	img.BlobHash = hash
+	return true, nil
+}
+
+// storeBlob stores contents as a new blob referenced by img. The decoded
+// image is returned so renditions can be created from it. If another upload
+// of the same contents created the blob in the meantime, a reference to that
+// blob is acquired instead and acquired is true.
+func (service *GalleryService) storeBlob(tx *sql.Tx, img *Image, hash string, contents io.ReadSeeker) (src image.Image, acquired bool, err error) {
+	src, _, err = image.Decode(contents)
+	if err != nil {
+		return nil, false, FileError{
+			Issue: fmt.Sprintf("unreadable image: %v", err),
+		}
+	}
+	size, err := contents.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, false, fmt.Errorf("store blob: %w", err)
+	}
+	_, err = contents.Seek(0, io.SeekStart)
+	if err != nil {
+		return nil, false, fmt.Errorf("store blob: %w", err)
+	}
+
+	prefix := blobPrefix(hash, img.UID)
+	ext := strings.ToLower(filepath.Ext(img.Filename))
+	img.Key = prefix + "image" + ext
+	img.OriginalKey = ""
+	img.Size = size
+	// Images that rely on their EXIF orientation to display upright are
+	// stored rotated, with the upload archived as the original.
+	var stored io.Reader = contents
+	if img.ContentType == "image/jpeg" {
+		rotated, normalized, ok, err := normalizeOrientation(src, contents)
+		if err != nil {
+			return nil, false, fmt.Errorf("store blob: %w", err)
+		}
+		_, err = contents.Seek(0, io.SeekStart)
+		if err != nil {
+			return nil, false, fmt.Errorf("store blob: %w", err)
+		}
+		if ok {
+			src = rotated
+			stored = bytes.NewReader(normalized)
+			img.Size = int64(len(normalized))
+			img.OriginalKey = prefix + "original" + ext
+		}
+	}
+	img.Width = src.Bounds().Dx()
+	img.Height = src.Bounds().Dy()
+
+	row := tx.QueryRow(`
+	insert into blobs (hash, storage_key, original_key, size, content_type, width, height, ref_count)
+	values ($1, $2, $3, $4, $5, $6, $7, 1) on conflict (hash) do nothing
+	returning hash;`, hash, img.Key, img.OriginalKey, img.Size, img.ContentType,
+		img.Width, img.Height)
+	err = row.Scan(&img.BlobHash)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			acquired, err = service.acquireBlob(tx, img, hash)
+			if err != nil {
+				return nil, false, fmt.Errorf("store blob: %w", err)
+			}
+			if !acquired {
+				return nil, false, fmt.Errorf("store blob: blob %v disappeared", hash)
+			}
+			return nil, true, nil
+		}
+		return nil, false, fmt.Errorf("store blob: %w", err)
+	}
+
+	if img.OriginalKey != "" {
+		err = service.storage().Put(img.OriginalKey, contents)
+		if err != nil {
+			return nil, false, fmt.Errorf("store original: %w", err)
+		}
+	}
+	err = service.storage().Put(img.Key, stored)
+	if err != nil {
+		return nil, false, fmt.Errorf("store blob: %w", err)
+	}
+	return src, false, nil
+}
+
+// releaseBlobs removes one reference to the blob of each given hash, hashes
+// may be repeated to remove several references. Blobs that are no longer
+// referenced are deleted and their storage key prefixes returned, so their
+// files can be removed once the transaction is committed. The images
+// referencing the blobs need to be deleted first.
+func (service *GalleryService) releaseBlobs(tx *sql.Tx, hashes []string) ([]string, error) {
+	counts := make(map[string]int)
+	for _, hash := range hashes {
+		counts[hash]++
+	}
+	var unused []string
+	for hash, count := range counts {
+		var refCount int
+		row := tx.QueryRow(`
+		update blobs
+		set ref_count = ref_count - $2
+		where hash = $1
+		returning ref_count;`, hash, count)
+		err := row.Scan(&refCount)
+		if err != nil {
+			return nil, fmt.Errorf("release blob: %w", err)
+		}
+		if refCount > 0 {
+			continue
+		}
+		var key string
+		row = tx.QueryRow(`
+		delete from blobs
+		where hash = $1
+		returning storage_key;`, hash)
+		err = row.Scan(&key)
+		if err != nil {
+			return nil, fmt.Errorf("release blob: %w", err)
+		}
+		unused = append(unused, path.Dir(key)+"/")
+	}
+	return unused, nil
+}
+
+// deleteBlobFiles removes the stored files of blobs that are no longer
+// referenced, given their storage key prefixes.
+func (service *GalleryService) deleteBlobFiles(prefixes []string) error {
+	for _, prefix := range prefixes {
+		err := service.storage().DeletePrefix(prefix)
+		if err != nil {
+			return fmt.Errorf("delete blob files: %w", err)
+		}
+	}
+	return nil
+}
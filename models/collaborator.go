@@ -0,0 +1,198 @@
+package models
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Role is what a user is allowed to do with a gallery. Every role includes
+// the ones before it.
+type Role string
+
+const (
+	// RoleNone is the role of users who have nothing to do with a gallery.
+	RoleNone Role = ""
+	// RoleViewer can see the gallery, whatever its visibility.
+	RoleViewer Role = "viewer"
+	// RoleContributor can add images to the gallery as well.
+	RoleContributor Role = "contributor"
+	// RoleEditor can curate the images of the gallery as well, editing,
+	// reordering and deleting them.
+	RoleEditor Role = "editor"
+	// RoleOwner can do anything with the gallery, including sharing and
+	// deleting it. Only the user the gallery belongs to, or the admins of its
+	// organization, have it.
+	RoleOwner Role = "owner"
+)
+
+var roleRanks = map[Role]int{
+	RoleViewer:      1,
+	RoleContributor: 2,
+	RoleEditor:      3,
+	RoleOwner:       4,
+}
+
+// Includes reports whether a user with role r is allowed to do what role
+// other allows.
+func (r Role) Includes(other Role) bool {
+	return roleRanks[r] >= roleRanks[other]
+}
+
+// Assignable reports whether r is a role collaborators can be given.
+func (r Role) Assignable() bool {
+	return r == RoleViewer || r == RoleContributor || r == RoleEditor
+}
+
+// Collaborator is a user who was given a role in a gallery they don't own.
+type Collaborator struct {
+	GalleryID int
+	UserID    int
+	Email     string
+	Role      Role
+}
+
+// Role returns the role of a user in gallery. Members of the organization a
+// gallery belongs to get the role their membership gives them, unless they
+// were made collaborators with a higher one. Users have the same role in an
+// album as in its root gallery.
+func (service *GalleryService) Role(gallery *Gallery, userID int) (Role, error) {
+	if gallery.OrganizationID == 0 && gallery.UserID == userID {
+		return RoleOwner, nil
+	}
+	var role Role
+	var orgRole OrganizationRole
+	row := service.DB.QueryRow(`
+	select
+		coalesce((
+			select role
+			from gallery_collaborators
+			where gallery_id = $1 and user_id = $2
+		), ''),
+		coalesce((
+			select role
+			from organization_members
+			where organization_id = $3 and user_id = $2
+		), '');`, gallery.RootID, userID, gallery.OrganizationID)
+	err := row.Scan(&role, &orgRole)
+	if err != nil {
+		return RoleNone, fmt.Errorf("gallery role: %w", err)
+	}
+	if orgRole.GalleryRole().Includes(role) {
+		return orgRole.GalleryRole(), nil
+	}
+	return role, nil
+}
+
+// Collaborators returns the collaborators of a gallery, ordered by email.
+func (service *GalleryService) Collaborators(galleryID int) ([]Collaborator, error) {
+	rows, err := service.DB.Query(`
+	select users.id, users.email, gallery_collaborators.role
+	from gallery_collaborators
+	join users on users.id = gallery_collaborators.user_id
+	where gallery_collaborators.gallery_id = $1
+	order by users.email;`, galleryID)
+	if err != nil {
+		return nil, fmt.Errorf("query collaborators: %w", err)
+	}
+	defer rows.Close()
+	var collaborators []Collaborator
+	for rows.Next() {
+		collaborator := Collaborator{
+			GalleryID: galleryID,
+		}
+		err := rows.Scan(&collaborator.UserID, &collaborator.Email, &collaborator.Role)
+		if err != nil {
+			return nil, fmt.Errorf("query collaborators: %w", err)
+		}
+		collaborators = append(collaborators, collaborator)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("query collaborators: %w", err)
+	}
+	return collaborators, nil
+}
+
+// AddCollaborator gives the user with the given email a role in gallery, or
+// changes the role they have. ErrNotFound is returned if there is no user
+// with that email.
+func (service *GalleryService) AddCollaborator(gallery *Gallery, email string, role Role) error {
+	if !role.Assignable() {
+		return fmt.Errorf("add collaborator: invalid role %q", role)
+	}
+	var userID int
+	row := service.DB.QueryRow(`
+	select id
+	from users
+	where email = $1;`, strings.ToLower(email))
+	err := row.Scan(&userID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return fmt.Errorf("add collaborator: %w", ErrNotFound)
+		}
+		return fmt.Errorf("add collaborator: %w", err)
+	}
+	if gallery.OrganizationID == 0 && userID == gallery.UserID {
+		return fmt.Errorf("add collaborator: user owns the gallery")
+	}
+	_, err = service.DB.Exec(`
+	insert into gallery_collaborators (gallery_id, user_id, role)
+	values ($1, $2, $3) on conflict (gallery_id, user_id) do
+	update
+	set role = $3;`, gallery.ID, userID, role)
+	if err != nil {
+		return fmt.Errorf("add collaborator: %w", err)
+	}
+	return nil
+}
+
+func (service *GalleryService) RemoveCollaborator(galleryID, userID int) error {
+	_, err := service.DB.Exec(`
+	delete from gallery_collaborators
+	where gallery_id = $1 and user_id = $2;`, galleryID, userID)
+	if err != nil {
+		return fmt.Errorf("remove collaborator: %w", err)
+	}
+	return nil
+}
+
+// ByCollaborator returns the galleries a user was given a role in, along
+// with that role. Galleries of organizations the user is a member of are
+// left out, ByUserID returns them already.
+func (service *GalleryService) ByCollaborator(userID int) ([]Gallery, []Role, error) {
+	rows, err := service.DB.Query(`
+	select galleries.id, galleries.user_id, galleries.title,
+		coalesce(galleries.cover_image_id, 0), galleries.visibility, galleries.slug,
+		coalesce(galleries.organization_id, 0), gallery_collaborators.role
+	from gallery_collaborators
+	join galleries on galleries.id = gallery_collaborators.gallery_id
+	where gallery_collaborators.user_id = $1 and galleries.parent_id is null
+		and (galleries.organization_id is null or galleries.organization_id not in (
+			select organization_id
+			from organization_members
+			where user_id = $1
+		))
+	order by galleries.title, galleries.id;`, userID)
+	if err != nil {
+		return nil, nil, fmt.Errorf("query galleries by collaborator: %w", err)
+	}
+	defer rows.Close()
+	var galleries []Gallery
+	var roles []Role
+	for rows.Next() {
+		var gallery Gallery
+		var role Role
+		err := rows.Scan(&gallery.ID, &gallery.UserID, &gallery.Title, &gallery.CoverImageID,
+			&gallery.Visibility, &gallery.Slug, &gallery.OrganizationID, &role)
+		if err != nil {
+			return nil, nil, fmt.Errorf("query galleries by collaborator: %w", err)
+		}
+		galleries = append(galleries, gallery)
+		roles = append(roles, role)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, nil, fmt.Errorf("query galleries by collaborator: %w", err)
+	}
+	return galleries, roles, nil
+}
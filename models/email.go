@@ -2,6 +2,7 @@ package models
 
 import (
 	"fmt"
+	"html"
 	"os"
 
 	"github.com/go-mail/mail/v2"
@@ -80,6 +81,45 @@ func (es *EmailService) ForgotPassword(to, resetURL string) error {
 
 }
 
+// OrganizationInvitation sends an invitation to join an organization. The
+// link in it needs to be opened while signed in to an account with the email
+// the invitation was sent to.
+func (es *EmailService) OrganizationInvitation(to, orgName, inviteURL string) error {
+	email := Email{
+		From:    DefaultSender,
+		Subject: "You're invited to join " + orgName + " on Lenslocked",
+		To:      to,
+		Plaintext: "You've been invited to join " + orgName + " on Lenslocked. " +
+			"To accept the invitation, sign in or sign up with this email address and visit the following link: " +
+			inviteURL,
+		HTML: `<p>You've been invited to join ` + html.EscapeString(orgName) + ` on Lenslocked.</p>` +
+			`<p>To accept the invitation, sign in or sign up with this email address and visit the following link: ` +
+			`<a href="` + inviteURL + `">` + inviteURL + `</a></p>`,
+	}
+	if err := es.Send(email); err != nil {
+		return fmt.Errorf("organization invitation email: %w", err)
+	}
+	return nil
+}
+
+// GalleryTransfer asks a user to accept becoming the owner of a gallery.
+func (es *EmailService) GalleryTransfer(to, fromEmail, galleryTitle, acceptURL string) error {
+	email := Email{
+		From:    DefaultSender,
+		Subject: fromEmail + " wants to transfer a gallery to you",
+		To:      to,
+		Plaintext: fromEmail + " wants to make you the owner of their gallery " + galleryTitle + ". " +
+			"To accept it, please visit the following link: " + acceptURL,
+		HTML: `<p>` + html.EscapeString(fromEmail) + ` wants to make you the owner of their gallery ` +
+			html.EscapeString(galleryTitle) + `.</p>` +
+			`<p>To accept it, please visit the following link: <a href="` + acceptURL + `">` + acceptURL + `</a></p>`,
+	}
+	if err := es.Send(email); err != nil {
+		return fmt.Errorf("gallery transfer email: %w", err)
+	}
+	return nil
+}
+
 func (es *EmailService) setFrom(msg *mail.Message, email Email) {
 	DefaultSender = os.Getenv("SMTP_DEFAULT_SENDER")
 	var from string
@@ -22,24 +22,26 @@ func (fe FileError) Error() string {
 	return fmt.Sprintf("invalid file: %v", fe.Issue)
 }
 
-func checkContentType(r io.ReadSeeker, allowedTypes []string) error {
+// checkContentType detects the content type of r and makes sure it is one of
+// allowedTypes. The detected content type is returned.
+func checkContentType(r io.ReadSeeker, allowedTypes []string) (string, error) {
 	testBytes := make([]byte, 512)
-	_, err := r.Read(testBytes)
+	n, err := r.Read(testBytes)
 	if err != nil {
-		return fmt.Errorf("checking content type: %w", err)
+		return "", fmt.Errorf("checking content type: %w", err)
 	}
 	// Reset file to the starting position after reading from it
 	_, err = r.Seek(0, 0)
 	if err != nil {
-		return fmt.Errorf("checking content type: %w", err)
+		return "", fmt.Errorf("checking content type: %w", err)
 	}
-	contentType := http.DetectContentType(testBytes)
+	contentType := http.DetectContentType(testBytes[:n])
 	for _, t := range allowedTypes {
 		if contentType == t {
-			return nil
+			return contentType, nil
 		}
 	}
-	return FileError{
+	return "", FileError{
 		Issue: fmt.Sprintf("invalid content type: %v", contentType),
 	}
 }
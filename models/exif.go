@@ -0,0 +1,149 @@
+package models
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/rwcarlsen/goexif/exif"
+)
+
+// Exif holds the EXIF metadata that was read from an uploaded image. Fields
+// the camera didn't record are left at their zero value.
+type Exif struct {
+	// TakenAt is the capture time as recorded by the camera, which doesn't
+	// know its time zone, so it should be displayed as is.
+	TakenAt     time.Time
+	CameraMake  string
+	CameraModel string
+	LensModel   string
+	// ExposureTime is formatted the way cameras display it, like "1/250".
+	ExposureTime string
+	FNumber      float64
+	ISO          int
+	// FocalLength is in millimeters.
+	FocalLength float64
+
+	HasLocation bool
+	Latitude    float64
+	Longitude   float64
+}
+
+// readExif parses the EXIF metadata of r. A nil Exif is returned if r has no
+// EXIF metadata, which is the case for every PNG and GIF file.
+func readExif(r io.Reader) *Exif {
+	x, err := exif.Decode(r)
+	if err != nil {
+		return nil
+	}
+	var e Exif
+	if t, err := x.DateTime(); err == nil {
+		e.TakenAt = t
+	}
+	e.CameraMake = exifString(x, exif.Make)
+	e.CameraModel = exifString(x, exif.Model)
+	e.LensModel = exifString(x, exif.LensModel)
+	if tag, err := x.Get(exif.ExposureTime); err == nil {
+		if num, denom, err := tag.Rat2(0); err == nil && num > 0 && denom > 0 {
+			if num >= denom {
+				e.ExposureTime = fmt.Sprintf("%gs", float64(num)/float64(denom))
+			} else {
+				e.ExposureTime = fmt.Sprintf("1/%.0f", float64(denom)/float64(num))
+			}
+		}
+	}
+	e.FNumber = exifRat(x, exif.FNumber)
+	if tag, err := x.Get(exif.ISOSpeedRatings); err == nil {
+		if iso, err := tag.Int(0); err == nil {
+			e.ISO = iso
+		}
+	}
+	e.FocalLength = exifRat(x, exif.FocalLength)
+	if lat, long, err := x.LatLong(); err == nil {
+		e.HasLocation = true
+		e.Latitude = lat
+		e.Longitude = long
+	}
+	return &e
+}
+
+func exifString(x *exif.Exif, name exif.FieldName) string {
+	tag, err := x.Get(name)
+	if err != nil {
+		return ""
+	}
+	s, err := tag.StringVal()
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(strings.TrimRight(s, "\x00"))
+}
+
+func exifRat(x *exif.Exif, name exif.FieldName) float64 {
+	tag, err := x.Get(name)
+	if err != nil {
+		return 0
+	}
+	num, denom, err := tag.Rat2(0)
+	if err != nil || denom == 0 {
+		return 0
+	}
+	return float64(num) / float64(denom)
+}
+
+func (service *GalleryService) storeExif(tx *sql.Tx, imageID int, e *Exif) error {
+	if e == nil {
+		return nil
+	}
+	var takenAt sql.NullTime
+	if !e.TakenAt.IsZero() {
+		takenAt = sql.NullTime{Time: e.TakenAt, Valid: true}
+	}
+	var latitude, longitude sql.NullFloat64
+	if e.HasLocation {
+		latitude = sql.NullFloat64{Float64: e.Latitude, Valid: true}
+		longitude = sql.NullFloat64{Float64: e.Longitude, Valid: true}
+	}
+	_, err := tx.Exec(`
+	insert into image_exif (image_id, taken_at, camera_make, camera_model, lens_model,
+		exposure_time, f_number, iso, focal_length, latitude, longitude)
+	values ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11);`, imageID, takenAt,
+		e.CameraMake, e.CameraModel, e.LensModel, e.ExposureTime, e.FNumber, e.ISO,
+		e.FocalLength, latitude, longitude)
+	if err != nil {
+		return fmt.Errorf("store exif: %w", err)
+	}
+	return nil
+}
+
+// exif loads the EXIF metadata of image, leaving image.Exif nil if the image
+// has none.
+func (service *GalleryService) exif(image *Image) error {
+	var e Exif
+	var takenAt sql.NullTime
+	var latitude, longitude sql.NullFloat64
+	row := service.DB.QueryRow(`
+	select taken_at, camera_make, camera_model, lens_model, exposure_time,
+		f_number, iso, focal_length, latitude, longitude
+	from image_exif
+	where image_id = $1;`, image.ID)
+	err := row.Scan(&takenAt, &e.CameraMake, &e.CameraModel, &e.LensModel,
+		&e.ExposureTime, &e.FNumber, &e.ISO, &e.FocalLength, &latitude, &longitude)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil
+		}
+		return fmt.Errorf("query exif: %w", err)
+	}
+	e.TakenAt = takenAt.Time
+	if latitude.Valid && longitude.Valid {
+		e.HasLocation = true
+		e.Latitude = latitude.Float64
+		e.Longitude = longitude.Float64
+	}
+	image.Exif = &e
+	return nil
+}
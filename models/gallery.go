@@ -4,48 +4,128 @@ import (
 	"database/sql"
 	"errors"
 	"fmt"
-	"io"
-	"io/fs"
-	"os"
 	"path/filepath"
 	"strings"
+	"time"
+
+	"github.com/Pupsichekk/lenslocked/rand"
+)
+
+// Visibility controls who can see a gallery besides its owner.
+type Visibility string
+
+const (
+	// VisibilityPrivate galleries can only be seen by their owner.
+	VisibilityPrivate Visibility = "private"
+	// VisibilityUnlisted galleries can be seen by anyone who knows their
+	// slug.
+	VisibilityUnlisted Visibility = "unlisted"
+	// VisibilityPublic galleries can be seen by anyone.
+	VisibilityPublic Visibility = "public"
 )
 
-type Image struct {
-	GalleryID int
-	Path      string
-	Filename  string
+// Valid reports whether v is one of the known visibility levels.
+func (v Visibility) Valid() bool {
+	switch v {
+	case VisibilityPrivate, VisibilityUnlisted, VisibilityPublic:
+		return true
+	}
+	return false
 }
 
+const (
+	// bytesPerSlug is the number of random bytes used for gallery slugs.
+	bytesPerSlug = 18
+)
+
 type Gallery struct {
 	ID     int
 	UserID int
 	Title  string
+	// Visibility controls who can see the gallery, new galleries are
+	// private.
+	Visibility Visibility
+	// Slug is the unguessable identifier used to share unlisted galleries.
+	Slug string
+	// PasswordHash is the bcrypt hash of the password visitors need to
+	// enter to see the gallery, empty if it has none.
+	PasswordHash string
+	// StripMetadata overrides the owner's setting for removing private
+	// metadata from the images served to visitors. When nil, the owner's
+	// setting is used.
+	StripMetadata *bool
+	// CoverImageID is the ID of the image chosen to represent the gallery,
+	// zero if none was chosen.
+	CoverImageID int
+	// OrganizationID is the ID of the organization the gallery belongs to,
+	// zero for personal galleries. UserID is the user who created an
+	// organization gallery, it is the organization's members who own it.
+	OrganizationID int
+	// ParentID is the ID of the gallery an album is in, zero for top level
+	// galleries.
+	ParentID int
+	// RootID is the ID of the top level gallery an album is in, or the ID of
+	// the gallery itself for top level galleries. Albums share the owner,
+	// organization, visibility and password of their root gallery.
+	RootID int
+}
+
+// IsAlbum reports whether the gallery is an album inside another gallery.
+func (gallery *Gallery) IsAlbum() bool {
+	return gallery.ParentID != 0
 }
 
 type GalleryService struct {
 	DB *sql.DB
 
-	// Used to store and locate images, if not set, value is defaulted to images directory
+	// Storage is used to store and locate images, if not set, value is
+	// defaulted to a LocalStorage rooted at ImagesDir
+	Storage Storage
+
+	// Used to store and locate images when Storage is not set, if not set,
+	// value is defaulted to images directory
 	ImagesDir string
+
+	// RenditionSizes are the longest edge lengths, in pixels, of the resized
+	// copies generated for every uploaded image. Defaults to
+	// DefaultRenditionSizes
+	RenditionSizes []int
+
+	// UnlockKey signs the tokens proving the password of a gallery was
+	// entered. Without it, no token is valid.
+	UnlockKey []byte
+	// UnlockDuration is how long those tokens are valid. Defaults to
+	// DefaultUnlockDuration.
+	UnlockDuration time.Duration
 }
 
-func (service *GalleryService) Create(title string, userID int) (*Gallery, error) {
+// Create creates a gallery for a user, or for an organization if
+// organizationID isn't zero.
+func (service *GalleryService) Create(title string, userID, organizationID int) (*Gallery, error) {
 	if userID < 0 {
 		return nil, fmt.Errorf("invalid id")
 	}
+	slug, err := rand.String(bytesPerSlug)
+	if err != nil {
+		return nil, fmt.Errorf("create gallery: %w", err)
+	}
 	gallery := Gallery{
-		Title:  title,
-		UserID: userID,
+		Title:          title,
+		UserID:         userID,
+		Visibility:     VisibilityPrivate,
+		Slug:           slug,
+		OrganizationID: organizationID,
 	}
 	row := service.DB.QueryRow(`
-	insert into galleries (title, user_id)
-	values($1, $2) 
-	returning id;`, gallery.Title, gallery.UserID)
-	err := row.Scan(&gallery.ID)
+	insert into galleries (title, user_id, visibility, slug, organization_id)
+	values($1, $2, $3, $4, nullif($5, 0)) 
+	returning id;`, gallery.Title, gallery.UserID, gallery.Visibility, gallery.Slug,
+		gallery.OrganizationID)
+	err = row.Scan(&gallery.ID)
 	if err != nil {
 		return nil, fmt.Errorf("create gallery: %w", err)
 	}
+	gallery.RootID = gallery.ID
 	return &gallery, nil
 }
 
@@ -53,43 +133,88 @@ func (service *GalleryService) ByID(id int) (*Gallery, error) {
 	if id < 0 {
 		return nil, fmt.Errorf("invalid id")
 	}
-
-	gallery := Gallery{
-		ID: id,
-	}
 	row := service.DB.QueryRow(`
-	select title, user_id
+	select id, title, user_id, strip_metadata, cover_image_id, visibility, slug,
+		coalesce(password_hash, ''), coalesce(organization_id, 0), coalesce(parent_id, 0),
+		coalesce(root_id, id)
 	from galleries
-	where id = $1;`, gallery.ID)
-	err := row.Scan(&gallery.Title, &gallery.UserID)
+	where id = $1;`, id)
+	gallery, err := scanGallery(row)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return nil, ErrNotFound
 		}
 		return nil, fmt.Errorf("id query gallery: %w", err)
 	}
+	return gallery, nil
+}
+
+// BySlug looks up a gallery by the slug it is shared with.
+func (service *GalleryService) BySlug(slug string) (*Gallery, error) {
+	row := service.DB.QueryRow(`
+	select id, title, user_id, strip_metadata, cover_image_id, visibility, slug,
+		coalesce(password_hash, ''), coalesce(organization_id, 0), coalesce(parent_id, 0),
+		coalesce(root_id, id)
+	from galleries
+	where slug = $1;`, slug)
+	gallery, err := scanGallery(row)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("slug query gallery: %w", err)
+	}
+	return gallery, nil
+}
+
+func scanGallery(row *sql.Row) (*Gallery, error) {
+	var gallery Gallery
+	var stripMetadata sql.NullBool
+	var coverImageID sql.NullInt64
+	err := row.Scan(&gallery.ID, &gallery.Title, &gallery.UserID, &stripMetadata,
+		&coverImageID, &gallery.Visibility, &gallery.Slug, &gallery.PasswordHash,
+		&gallery.OrganizationID, &gallery.ParentID, &gallery.RootID)
+	if err != nil {
+		return nil, err
+	}
+	if stripMetadata.Valid {
+		gallery.StripMetadata = &stripMetadata.Bool
+	}
+	gallery.CoverImageID = int(coverImageID.Int64)
 	return &gallery, nil
 }
 
+// ByUserID returns the personal top level galleries of a user along with the
+// top level galleries of the organizations they are a member of.
 func (service *GalleryService) ByUserID(userID int) ([]Gallery, error) {
 	// TODO: Will need to tweak this so some galleries will be passed instead of 0
 	// in case of error
 	rows, err := service.DB.Query(`
-	select id, title
+	select id, user_id, title, coalesce(cover_image_id, 0), visibility, slug,
+		coalesce(password_hash, ''), coalesce(organization_id, 0)
 	from galleries
-	where user_id = $1;`, userID)
+	where parent_id is null and (
+		(user_id = $1 and organization_id is null)
+		or organization_id in (
+			select organization_id
+			from organization_members
+			where user_id = $1
+		)
+	)
+	order by organization_id nulls first, id;`, userID)
 	if err != nil {
 		return nil, fmt.Errorf("query galleries by user: %w", err)
 	}
 	defer rows.Close()
 	galleries := make([]Gallery, 0)
 	for rows.Next() {
-		gallery := Gallery{
-			UserID: userID,
-		}
-		if err := rows.Scan(&gallery.ID, &gallery.Title); err != nil {
+		var gallery Gallery
+		if err := rows.Scan(&gallery.ID, &gallery.UserID, &gallery.Title, &gallery.CoverImageID,
+			&gallery.Visibility, &gallery.Slug, &gallery.PasswordHash,
+			&gallery.OrganizationID); err != nil {
 			return nil, fmt.Errorf("query galleries by user: %w", err)
 		}
+		gallery.RootID = gallery.ID
 		galleries = append(galleries, gallery)
 	}
 	if rows.Err() != nil {
@@ -99,121 +224,187 @@ func (service *GalleryService) ByUserID(userID int) ([]Gallery, error) {
 }
 
 func (service *GalleryService) Update(gallery *Gallery) error {
+	if !gallery.Visibility.Valid() {
+		return fmt.Errorf("update gallery: invalid visibility %q", gallery.Visibility)
+	}
+	// The cover image has to belong to the gallery, anything else clears it.
 	_, err := service.DB.Exec(`
 	update galleries 
-	set title = $2 
-	where id = $1;`, gallery.ID, gallery.Title)
+	set title = $2, strip_metadata = $3,
+		cover_image_id = (select id from images where id = $4 and gallery_id = $1),
+		visibility = $5
+	where id = $1;`, gallery.ID, gallery.Title, gallery.StripMetadata, gallery.CoverImageID,
+		gallery.Visibility)
 	if err != nil {
 		return fmt.Errorf("update gallery: %w", err)
 	}
-	return nil
-}
-
-func (service *GalleryService) Delete(galleryID int) error {
-	_, err := service.DB.Exec(`
-	delete from galleries
-	where id = $1;`, galleryID)
-	if err != nil {
-		return fmt.Errorf("delete gallery: %w", err)
-	}
-	err = os.RemoveAll(service.galleryDir(galleryID))
+	// Albums can be seen by whoever can see their root gallery.
+	_, err = service.DB.Exec(`
+	update galleries
+	set visibility = $2
+	where root_id = $1;`, gallery.ID, gallery.Visibility)
 	if err != nil {
-		return fmt.Errorf("delete gallery directory: %w", err)
+		return fmt.Errorf("update gallery: %w", err)
 	}
 	return nil
 }
 
-func (service *GalleryService) extensions() []string {
-	return []string{".png", ".jpg", ".jpeg", ".gif"}
-}
-
-func (service *GalleryService) imageContentTypes() []string {
-	return []string{"image/png", "image/jpeg", "image/gif"}
-}
-
-func (service *GalleryService) Image(galleryID int, filename string) (Image, error) {
-	imagePath := filepath.Join(service.galleryDir(galleryID), filename)
-	_, err := os.Stat(imagePath)
+// Cover returns the image representing gallery, which is the chosen cover
+// image, or the first image if none was chosen. ErrNotFound is returned for
+// galleries without images.
+func (service *GalleryService) Cover(gallery *Gallery) (Image, error) {
+	var uid string
+	row := service.DB.QueryRow(`
+	select uid
+	from images
+	where gallery_id = $1
+	order by id = $2 desc, position, id
+	limit 1;`, gallery.ID, gallery.CoverImageID)
+	err := row.Scan(&uid)
 	if err != nil {
-		if errors.Is(err, fs.ErrNotExist) {
+		if errors.Is(err, sql.ErrNoRows) {
 			return Image{}, ErrNotFound
 		}
-		return Image{}, fmt.Errorf("querying for image: %w", err)
+		return Image{}, fmt.Errorf("gallery cover: %w", err)
 	}
-
-	return Image{
-		Filename:  filename,
-		GalleryID: galleryID,
-		Path:      imagePath,
-	}, nil
+	return service.Image(gallery.ID, uid)
 }
 
-func (service *GalleryService) DeleteImage(galleryID int, filename string) error {
-	image, err := service.Image(galleryID, filename)
-	if err != nil {
-		return fmt.Errorf("deleting image: %w", err)
+// StripsMetadata reports whether private metadata should be removed from the
+// images of gallery before serving them to visitors, taking the owner's
+// setting into account when the gallery doesn't override it.
+func (service *GalleryService) StripsMetadata(gallery *Gallery) (bool, error) {
+	if gallery.StripMetadata != nil {
+		return *gallery.StripMetadata, nil
 	}
-	err = os.Remove(image.Path)
+	var strip bool
+	row := service.DB.QueryRow(`
+	select strip_metadata
+	from users
+	where id = $1;`, gallery.UserID)
+	err := row.Scan(&strip)
 	if err != nil {
-		return fmt.Errorf("deleting image: %w", err)
+		return false, fmt.Errorf("strips metadata: %w", err)
 	}
-	return nil
+	return strip, nil
 }
 
-func (service *GalleryService) CreateImage(galleryID int, filename string, contents io.ReadSeeker) error {
-	err := checkContentType(contents, service.imageContentTypes())
+// Delete deletes a gallery along with the albums inside it.
+func (service *GalleryService) Delete(galleryID int) error {
+	tx, err := service.DB.Begin()
 	if err != nil {
-		return fmt.Errorf("creating image %v: %w", filename, err)
+		return fmt.Errorf("delete gallery: %w", err)
 	}
-	err = checkExtension(filename, service.extensions())
+	defer tx.Rollback()
+	galleryIDs, err := service.descendants(tx, galleryID)
 	if err != nil {
-		return fmt.Errorf("creating image %v: %w", filename, err)
+		return fmt.Errorf("delete gallery: %w", err)
 	}
-
-	galleryDir := service.galleryDir(galleryID)
-	err = os.MkdirAll(galleryDir, 0755)
+	rows, err := tx.Query(`
+	select blob_hash
+	from images
+	where gallery_id = any($1::int[]) and blob_hash is not null;`, galleryIDs)
 	if err != nil {
-		return fmt.Errorf("creating gallery %d images directory: %w", galleryID, err)
+		return fmt.Errorf("delete gallery: %w", err)
 	}
-	imagePath := filepath.Join(galleryDir, filename)
-	dst, err := os.Create(imagePath)
+	var hashes []string
+	for rows.Next() {
+		var hash string
+		if err := rows.Scan(&hash); err != nil {
+			rows.Close()
+			return fmt.Errorf("delete gallery: %w", err)
+		}
+		hashes = append(hashes, hash)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("delete gallery: %w", err)
+	}
+	// The albums are deleted along with the gallery.
+	_, err = tx.Exec(`
+	delete from galleries
+	where id = $1;`, galleryID)
 	if err != nil {
-		return fmt.Errorf("creating image file: %w", err)
+		return fmt.Errorf("delete gallery: %w", err)
 	}
-	defer dst.Close()
-
-	_, err = io.Copy(dst, contents)
+	unused, err := service.releaseBlobs(tx, hashes)
+	if err != nil {
+		return fmt.Errorf("delete gallery: %w", err)
+	}
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("delete gallery: %w", err)
+	}
+	err = service.deleteBlobFiles(unused)
 	if err != nil {
-		return fmt.Errorf("copying image data: %w", err)
+		return fmt.Errorf("delete gallery images: %w", err)
+	}
+	// Images uploaded before blobs existed are stored in the gallery's own
+	// directory.
+	for _, id := range galleryIDs {
+		err = service.storage().DeletePrefix(service.galleryPrefix(id))
+		if err != nil {
+			return fmt.Errorf("delete gallery images: %w", err)
+		}
 	}
 	return nil
 }
 
-func (service *GalleryService) Images(galleryID int) ([]Image, error) {
-	globPattern := filepath.Join(service.galleryDir(galleryID), "*")
-	allFiles, err := filepath.Glob(globPattern)
+// descendants returns the ID of a gallery along with the IDs of all the
+// albums inside it, however deeply nested.
+func (service *GalleryService) descendants(tx *sql.Tx, galleryID int) ([]int, error) {
+	rows, err := tx.Query(`
+	with recursive tree as (
+		select id
+		from galleries
+		where id = $1
+		union all
+		select galleries.id
+		from galleries
+		join tree on galleries.parent_id = tree.id
+	)
+	select id from tree;`, galleryID)
 	if err != nil {
-		return nil, fmt.Errorf("retrieving gallery images: %w", err)
+		return nil, fmt.Errorf("query descendants: %w", err)
 	}
-	var images []Image
-	for _, file := range allFiles {
-		if hasExtension(file, service.extensions()) {
-			images = append(images, Image{
-				GalleryID: galleryID,
-				Path:      file,
-				Filename:  filepath.Base(file),
-			})
+	defer rows.Close()
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, fmt.Errorf("query descendants: %w", err)
 		}
+		ids = append(ids, id)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("query descendants: %w", err)
 	}
-	return images, nil
+	return ids, nil
 }
 
-func (service *GalleryService) galleryDir(galleryID int) string {
-	imagesDir := service.ImagesDir
-	if imagesDir == "" {
-		imagesDir = "images"
+func (service *GalleryService) extensions() []string {
+	return []string{".png", ".jpg", ".jpeg", ".gif"}
+}
+
+func (service *GalleryService) imageContentTypes() []string {
+	return []string{"image/png", "image/jpeg", "image/gif"}
+}
+
+// storage returns the Storage images are kept in. It doesn't set Storage
+// when it isn't set, as handlers share the service.
+func (service *GalleryService) storage() Storage {
+	if service.Storage == nil {
+		return &LocalStorage{
+			Dir: service.ImagesDir,
+		}
 	}
-	return filepath.Join(imagesDir, fmt.Sprintf("gallery-%d", galleryID))
+	return service.Storage
+}
+
+// galleryPrefix returns the storage key prefix shared by all images of a
+// gallery.
+func (service *GalleryService) galleryPrefix(galleryID int) string {
+	return fmt.Sprintf("gallery-%d/", galleryID)
 }
 
 func hasExtension(file string, extensions []string) bool {
@@ -226,3 +417,56 @@ func hasExtension(file string, extensions []string) bool {
 	}
 	return false
 }
+
+// ResetSlug gives gallery and all albums in it new slugs, so links shared
+// with the old ones stop working.
+func (service *GalleryService) ResetSlug(gallery *Gallery) error {
+	tx, err := service.DB.Begin()
+	if err != nil {
+		return fmt.Errorf("reset slug: %w", err)
+	}
+	defer tx.Rollback()
+	rows, err := tx.Query(`
+	select id
+	from galleries
+	where id = $1 or root_id = $1
+	for update;`, gallery.ID)
+	if err != nil {
+		return fmt.Errorf("reset slug: %w", err)
+	}
+	var ids []int
+	for rows.Next() {
+		var id int
+		err = rows.Scan(&id)
+		if err != nil {
+			rows.Close()
+			return fmt.Errorf("reset slug: %w", err)
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("reset slug: %w", err)
+	}
+	for _, id := range ids {
+		slug, err := rand.String(bytesPerSlug)
+		if err != nil {
+			return fmt.Errorf("reset slug: %w", err)
+		}
+		_, err = tx.Exec(`
+		update galleries
+		set slug = $2
+		where id = $1;`, id, slug)
+		if err != nil {
+			return fmt.Errorf("reset slug: %w", err)
+		}
+		if id == gallery.ID {
+			gallery.Slug = slug
+		}
+	}
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("reset slug: %w", err)
+	}
+	return nil
+}
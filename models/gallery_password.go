@@ -0,0 +1,103 @@
+package models
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	// DefaultUnlockDuration is how long visitors who entered the password of
+	// a gallery can see it, when GalleryService doesn't specify its own
+	// duration.
+	DefaultUnlockDuration = 24 * time.Hour
+)
+
+// UpdatePassword sets the password visitors need to enter to see gallery and
+// the albums inside it. An empty password removes it.
+func (service *GalleryService) UpdatePassword(gallery *Gallery, password string) error {
+	var passwordHash string
+	if password != "" {
+		hashedBytes, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+		if err != nil {
+			return fmt.Errorf("update gallery password: %w", err)
+		}
+		passwordHash = string(hashedBytes)
+	}
+	_, err := service.DB.Exec(`
+	update galleries
+	set password_hash = nullif($2, '')
+	where id = $1 or root_id = $1;`, gallery.ID, passwordHash)
+	if err != nil {
+		return fmt.Errorf("update gallery password: %w", err)
+	}
+	gallery.PasswordHash = passwordHash
+	return nil
+}
+
+// HasPassword reports whether visitors need to enter a password to see the
+// gallery.
+func (gallery *Gallery) HasPassword() bool {
+	return gallery.PasswordHash != ""
+}
+
+// CheckPassword reports whether password is the password of gallery.
+func (gallery *Gallery) CheckPassword(password string) bool {
+	if !gallery.HasPassword() {
+		return false
+	}
+	err := bcrypt.CompareHashAndPassword([]byte(gallery.PasswordHash), []byte(password))
+	return err == nil
+}
+
+// UnlockToken returns the token given to visitors who entered the password of
+// gallery, to prove it on later requests, along with when it expires. The
+// token is signed with UnlockKey and covers the password hash, so tokens stop
+// working once the password is changed or removed. The token of an album
+// works for its root gallery and the other albums inside it.
+func (service *GalleryService) UnlockToken(gallery *Gallery) (string, time.Time) {
+	duration := service.UnlockDuration
+	if duration <= 0 {
+		duration = DefaultUnlockDuration
+	}
+	expiresAt := time.Now().Add(duration).Truncate(time.Second)
+	return service.unlockToken(gallery, expiresAt), expiresAt
+}
+
+// CheckUnlockToken reports whether token was returned by UnlockToken for
+// gallery, or another gallery with the same root, and hasn't expired yet.
+func (service *GalleryService) CheckUnlockToken(gallery *Gallery, token string) bool {
+	expires, _, ok := strings.Cut(token, ".")
+	if !ok {
+		return false
+	}
+	unix, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil {
+		return false
+	}
+	expiresAt := time.Unix(unix, 0)
+	if !time.Now().Before(expiresAt) {
+		return false
+	}
+	want := service.unlockToken(gallery, expiresAt)
+	return want != "" && hmac.Equal([]byte(token), []byte(want))
+}
+
+// unlockToken returns the unlock token of gallery expiring at expiresAt. It
+// is empty if the gallery has no password, or if there is no UnlockKey to
+// sign it with.
+func (service *GalleryService) unlockToken(gallery *Gallery, expiresAt time.Time) string {
+	if !gallery.HasPassword() || len(service.UnlockKey) == 0 {
+		return ""
+	}
+	expires := strconv.FormatInt(expiresAt.Unix(), 10)
+	mac := hmac.New(sha256.New, service.UnlockKey)
+	fmt.Fprintf(mac, "gallery-unlock:%d:%s:%s", gallery.RootID, gallery.PasswordHash, expires)
+	return expires + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,49 @@
+package models
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUnlockToken(t *testing.T) {
+	service := &GalleryService{UnlockKey: []byte("secret")}
+	gallery := &Gallery{ID: 2, RootID: 1, PasswordHash: "$2a$10$hash"}
+	token, expiresAt := service.UnlockToken(gallery)
+	if !expiresAt.After(time.Now().Add(DefaultUnlockDuration - time.Minute)) {
+		t.Errorf("UnlockToken() expires at %v, want in %v", expiresAt, DefaultUnlockDuration)
+	}
+
+	if !service.CheckUnlockToken(gallery, token) {
+		t.Errorf("CheckUnlockToken() = false, want true")
+	}
+	album := &Gallery{ID: 3, RootID: 1, PasswordHash: gallery.PasswordHash}
+	if !service.CheckUnlockToken(album, token) {
+		t.Errorf("CheckUnlockToken() of an album in the gallery = false, want true")
+	}
+
+	expired := service.unlockToken(gallery, time.Now().Add(-time.Second))
+	_, mac, _ := strings.Cut(token, ".")
+	later := strconv.FormatInt(expiresAt.Add(time.Hour).Unix(), 10) + "." + mac
+	tests := map[string]struct {
+		service *GalleryService
+		gallery *Gallery
+		token   string
+	}{
+		"expired":          {service, gallery, expired},
+		"expiry changed":   {service, gallery, later},
+		"password changed": {service, &Gallery{ID: 2, RootID: 1, PasswordHash: "$2a$10$other"}, token},
+		"password removed": {service, &Gallery{ID: 2, RootID: 1}, token},
+		"other gallery":    {service, &Gallery{ID: 4, RootID: 4, PasswordHash: gallery.PasswordHash}, token},
+		"other key":        {&GalleryService{UnlockKey: []byte("other")}, gallery, token},
+		"no key":           {&GalleryService{}, gallery, token},
+		"empty":            {service, gallery, ""},
+		"malformed":        {service, gallery, "abc"},
+	}
+	for name, tt := range tests {
+		if tt.service.CheckUnlockToken(tt.gallery, tt.token) {
+			t.Errorf("CheckUnlockToken() %s = true, want false", name)
+		}
+	}
+}
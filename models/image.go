@@ -0,0 +1,473 @@
+package models
+
+import (
+	"bytes"
+	"database/sql"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"net/http"
+	"path"
+	"regexp"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/Pupsichekk/lenslocked/rand"
+)
+
+const (
+	// bytesPerImageUID is the number of random bytes used for image UIDs.
+	bytesPerImageUID = 12
+)
+
+type Image struct {
+	ID int
+	// UID is the stable identifier used to refer to the image in URLs and
+	// storage keys, so images with the same filename don't collide.
+	UID       string
+	GalleryID int
+	// Filename is the name of the uploaded file, used for display and as the
+	// name of downloads.
+	Filename string
+	// BlobHash is the hash of the contents shared by all images uploaded
+	// with the same bytes. Empty for images uploaded before contents were
+	// shared, which own their files.
+	BlobHash string
+	// Key is the key the image is stored under in the gallery storage.
+	Key string
+	// OriginalKey is the key of the file as it was uploaded, if it had to be
+	// changed before storing it under Key. Empty otherwise.
+	OriginalKey string
+	Size        int64
+	ContentType string
+	Width       int
+	Height      int
+	UploadedAt  time.Time
+	// Position orders the images of a gallery, starting at 1.
+	Position int
+	Caption  string
+	// AltText describes the image for people who can't see it.
+	AltText string
+	// Renditions are the resized copies of the image, ordered by size.
+	Renditions []Rendition
+	// Exif is only loaded when looking up a single image, and is nil if the
+	// image has no EXIF metadata.
+	Exif *Exif
+}
+
+// Image looks up an image of a gallery by its UID. Images uploaded before
+// they had UIDs were referenced by filename, so filenames are accepted as
+// well, resolving to the earliest image uploaded with that name.
+func (service *GalleryService) Image(galleryID int, ref string) (Image, error) {
+	image := Image{
+		GalleryID: galleryID,
+	}
+	row := service.DB.QueryRow(`
+	select id, uid, filename, coalesce(blob_hash, ''), storage_key, original_key,
+		size, content_type, width, height, uploaded_at, position, caption, alt_text
+	from images
+	where gallery_id = $1 and (uid = $2 or filename = $2)
+	order by uid = $2 desc, id
+	limit 1;`, galleryID, ref)
+	err := row.Scan(&image.ID, &image.UID, &image.Filename, &image.BlobHash,
+		&image.Key, &image.OriginalKey, &image.Size, &image.ContentType,
+		&image.Width, &image.Height, &image.UploadedAt, &image.Position,
+		&image.Caption, &image.AltText)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return Image{}, ErrNotFound
+		}
+		return Image{}, fmt.Errorf("querying for image: %w", err)
+	}
+	images := []Image{image}
+	err = service.renditions(images)
+	if err != nil {
+		return Image{}, fmt.Errorf("querying for image: %w", err)
+	}
+	err = service.exif(&images[0])
+	if err != nil {
+		return Image{}, fmt.Errorf("querying for image: %w", err)
+	}
+	return images[0], nil
+}
+
+// ImageContent opens the stored contents of image. If size is greater than
+// zero, the smallest rendition that is at least size pixels along its longest
+// edge is opened instead, falling back to the original. Callers need to close
+// the returned object.
+func (service *GalleryService) ImageContent(image Image, size int) (*StorageObject, error) {
+	key := image.Key
+	if rendition, ok := image.Rendition(size); ok && size > 0 {
+		key = rendition.Key
+	}
+	obj, err := service.storage().Get(key)
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("opening image: %w", err)
+	}
+	return obj, nil
+}
+
+// OriginalContent opens the image exactly as it was uploaded. Callers need to
+// close the returned object.
+func (service *GalleryService) OriginalContent(image Image) (*StorageObject, error) {
+	key := image.Key
+	if image.OriginalKey != "" {
+		key = image.OriginalKey
+	}
+	obj, err := service.storage().Get(key)
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("opening original image: %w", err)
+	}
+	return obj, nil
+}
+
+func (service *GalleryService) DeleteImage(galleryID int, ref string) error {
+	image, err := service.Image(galleryID, ref)
+	if err != nil {
+		return fmt.Errorf("deleting image: %w", err)
+	}
+	tx, err := service.DB.Begin()
+	if err != nil {
+		return fmt.Errorf("deleting image: %w", err)
+	}
+	defer tx.Rollback()
+	_, err = tx.Exec(`
+	delete from images
+	where id = $1;`, image.ID)
+	if err != nil {
+		return fmt.Errorf("deleting image: %w", err)
+	}
+	var unused []string
+	if image.BlobHash != "" {
+		unused, err = service.releaseBlobs(tx, []string{image.BlobHash})
+		if err != nil {
+			return fmt.Errorf("deleting image: %w", err)
+		}
+	}
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("deleting image: %w", err)
+	}
+	if image.BlobHash != "" {
+		return service.deleteBlobFiles(unused)
+	}
+
+	// Images uploaded before blobs existed own their files.
+	err = service.storage().Delete(image.Key)
+	if err != nil {
+		return fmt.Errorf("deleting image: %w", err)
+	}
+	if image.OriginalKey != "" {
+		err = service.storage().Delete(image.OriginalKey)
+		if err != nil {
+			return fmt.Errorf("deleting original image: %w", err)
+		}
+	}
+	for _, rendition := range image.Renditions {
+		err = service.storage().Delete(rendition.Key)
+		if err != nil {
+			return fmt.Errorf("deleting image rendition: %w", err)
+		}
+	}
+	return nil
+}
+
+// CreateImage validates and stores an uploaded image, placing it after the
+// other images of the gallery. Contents that were uploaded before, to any
+// gallery, are not stored again but shared.
+func (service *GalleryService) CreateImage(galleryID int, filename string, contents io.ReadSeeker) (Image, error) {
+	contentType, err := checkContentType(contents, service.imageContentTypes())
+	if err != nil {
+		return Image{}, fmt.Errorf("creating image %v: %w", filename, err)
+	}
+	err = checkExtension(filename, service.extensions())
+	if err != nil {
+		return Image{}, fmt.Errorf("creating image %v: %w", filename, err)
+	}
+	hash, err := hashContents(contents)
+	if err != nil {
+		return Image{}, fmt.Errorf("creating image %v: %w", filename, err)
+	}
+	meta := readExif(contents)
+	_, err = contents.Seek(0, io.SeekStart)
+	if err != nil {
+		return Image{}, fmt.Errorf("creating image %v: %w", filename, err)
+	}
+	uid, err := rand.String(bytesPerImageUID)
+	if err != nil {
+		return Image{}, fmt.Errorf("creating image %v: %w", filename, err)
+	}
+	img := Image{
+		UID:         uid,
+		GalleryID:   galleryID,
+		Filename:    filename,
+		ContentType: contentType,
+	}
+
+	// The rows are written in a transaction that is only committed once the
+	// image and its renditions have been stored, so the tables never
+	// reference missing files.
+	tx, err := service.DB.Begin()
+	if err != nil {
+		return Image{}, fmt.Errorf("creating image %v: %w", filename, err)
+	}
+	defer tx.Rollback()
+	var src image.Image
+	shared, err := service.acquireBlob(tx, &img, hash)
+	if err != nil {
+		return Image{}, fmt.Errorf("creating image %v: %w", filename, err)
+	}
+	if !shared {
+		src, shared, err = service.storeBlob(tx, &img, hash, contents)
+		if err != nil {
+			return Image{}, fmt.Errorf("creating image %v: %w", filename, err)
+		}
+	}
+	row := tx.QueryRow(`
+	insert into images (uid, gallery_id, filename, blob_hash, storage_key, original_key,
+		size, content_type, width, height, position)
+	values ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10,
+		(select coalesce(max(position), 0) + 1 from images where gallery_id = $2))
+	returning id, uploaded_at, position;`, img.UID, img.GalleryID, img.Filename, img.BlobHash,
+		img.Key, img.OriginalKey, img.Size, img.ContentType, img.Width, img.Height)
+	err = row.Scan(&img.ID, &img.UploadedAt, &img.Position)
+	if err != nil {
+		return Image{}, fmt.Errorf("creating image %v: %w", filename, err)
+	}
+	if shared {
+		err = service.shareRenditions(tx, &img)
+	} else {
+		err = service.createRenditions(tx, &img, src)
+	}
+	if err != nil {
+		return Image{}, fmt.Errorf("creating image %v: %w", filename, err)
+	}
+	err = service.storeExif(tx, img.ID, meta)
+	if err != nil {
+		return Image{}, fmt.Errorf("creating image %v: %w", filename, err)
+	}
+	err = tx.Commit()
+	if err != nil {
+		return Image{}, fmt.Errorf("creating image %v: %w", filename, err)
+	}
+	img.Exif = meta
+	return img, nil
+}
+
+// UpdateImage saves the caption and alt text of image.
+func (service *GalleryService) UpdateImage(image *Image) error {
+	_, err := service.DB.Exec(`
+	update images
+	set caption = $2, alt_text = $3
+	where id = $1;`, image.ID, image.Caption, image.AltText)
+	if err != nil {
+		return fmt.Errorf("update image: %w", err)
+	}
+	return nil
+}
+
+// ReorderImages puts the images of a gallery in the order of uids. Images
+// that are not listed keep their relative order after the listed ones, and
+// UIDs of images in other galleries are ignored.
+func (service *GalleryService) ReorderImages(galleryID int, uids []string) error {
+	tx, err := service.DB.Begin()
+	if err != nil {
+		return fmt.Errorf("reorder images: %w", err)
+	}
+	defer tx.Rollback()
+	rows, err := tx.Query(`
+	select uid
+	from images
+	where gallery_id = $1
+	order by array_position($2::text[], uid), position, id
+	for update;`, galleryID, uids)
+	if err != nil {
+		return fmt.Errorf("reorder images: %w", err)
+	}
+	var ordered []string
+	for rows.Next() {
+		var uid string
+		err = rows.Scan(&uid)
+		if err != nil {
+			rows.Close()
+			return fmt.Errorf("reorder images: %w", err)
+		}
+		ordered = append(ordered, uid)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("reorder images: %w", err)
+	}
+	for i, uid := range ordered {
+		_, err = tx.Exec(`
+		update images
+		set position = $3
+		where gallery_id = $1 and uid = $2;`, galleryID, uid, i+1)
+		if err != nil {
+			return fmt.Errorf("reorder images: %w", err)
+		}
+	}
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("reorder images: %w", err)
+	}
+	return nil
+}
+
+func (service *GalleryService) Images(galleryID int) ([]Image, error) {
+	rows, err := service.DB.Query(`
+	select id, uid, filename, coalesce(blob_hash, ''), storage_key, original_key,
+		size, content_type, width, height, uploaded_at, position, caption, alt_text
+	from images
+	where gallery_id = $1
+	order by position, id;`, galleryID)
+	if err != nil {
+		return nil, fmt.Errorf("retrieving gallery images: %w", err)
+	}
+	defer rows.Close()
+	var images []Image
+	for rows.Next() {
+		image := Image{
+			GalleryID: galleryID,
+		}
+		err := rows.Scan(&image.ID, &image.UID, &image.Filename, &image.BlobHash,
+			&image.Key, &image.OriginalKey, &image.Size, &image.ContentType,
+			&image.Width, &image.Height, &image.UploadedAt, &image.Position,
+			&image.Caption, &image.AltText)
+		if err != nil {
+			return nil, fmt.Errorf("retrieving gallery images: %w", err)
+		}
+		images = append(images, image)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("retrieving gallery images: %w", err)
+	}
+	err = service.renditions(images)
+	if err != nil {
+		return nil, fmt.Errorf("retrieving gallery images: %w", err)
+	}
+	return images, nil
+}
+
+// legacyImageKey matches the keys images were stored under before they were
+// recorded in the images table, "gallery-1/photo.jpg" for example.
+var legacyImageKey = regexp.MustCompile(`^gallery-([0-9]+)/([^/]+)$`)
+
+// ImportLegacyImages records the images that were stored before the images
+// table existed, so they show up in their galleries again. Files that are
+// recorded already are skipped, so it is safe to run more than once. The
+// imported images keep their storage keys and get no renditions, the
+// original is served at every size. It returns how many images were
+// imported.
+func (service *GalleryService) ImportLegacyImages() (int, error) {
+	keys, err := service.storage().List("gallery-")
+	if err != nil {
+		return 0, fmt.Errorf("import legacy images: %w", err)
+	}
+	imported := 0
+	for _, key := range keys {
+		match := legacyImageKey.FindStringSubmatch(key)
+		if match == nil || !hasExtension(key, service.extensions()) {
+			continue
+		}
+		galleryID, err := strconv.Atoi(match[1])
+		if err != nil {
+			continue
+		}
+		ok, err := service.importLegacyImage(galleryID, key)
+		if err != nil {
+			return imported, fmt.Errorf("import legacy images: %w", err)
+		}
+		if ok {
+			imported++
+		}
+	}
+	return imported, nil
+}
+
+// HasImages reports whether any image was recorded yet.
+func (service *GalleryService) HasImages() (bool, error) {
+	var exists bool
+	row := service.DB.QueryRow(`
+	select exists (select 1 from images);`)
+	err := row.Scan(&exists)
+	if err != nil {
+		return false, fmt.Errorf("has images: %w", err)
+	}
+	return exists, nil
+}
+
+// importLegacyImage records the image stored under key in the gallery with
+// the given ID. ok is false if the file is recorded already, if the gallery
+// was deleted or if the file isn't an image.
+func (service *GalleryService) importLegacyImage(galleryID int, key string) (ok bool, err error) {
+	var skip bool
+	row := service.DB.QueryRow(`
+	select not exists (select 1 from galleries where id = $1)
+		or exists (select 1 from images where storage_key = $2 or original_key = $2)
+		or exists (select 1 from image_renditions where storage_key = $2);`, galleryID, key)
+	err = row.Scan(&skip)
+	if err != nil {
+		return false, fmt.Errorf("import %v: %w", key, err)
+	}
+	if skip {
+		return false, nil
+	}
+	obj, err := service.storage().Get(key)
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			return false, nil
+		}
+		return false, fmt.Errorf("import %v: %w", key, err)
+	}
+	defer obj.Close()
+	img := Image{
+		GalleryID:  galleryID,
+		Filename:   path.Base(key),
+		Key:        key,
+		Size:       obj.Size,
+		UploadedAt: obj.ModTime,
+	}
+	// Only the header is needed for the content type and dimensions.
+	head := make([]byte, 512)
+	n, err := io.ReadFull(obj, head)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return false, fmt.Errorf("import %v: %w", key, err)
+	}
+	head = head[:n]
+	img.ContentType = http.DetectContentType(head)
+	if !slices.Contains(service.imageContentTypes(), img.ContentType) {
+		return false, nil
+	}
+	config, _, err := image.DecodeConfig(io.MultiReader(bytes.NewReader(head), obj))
+	if err != nil {
+		return false, nil
+	}
+	img.Width, img.Height = config.Width, config.Height
+	img.UID, err = rand.String(bytesPerImageUID)
+	if err != nil {
+		return false, fmt.Errorf("import %v: %w", key, err)
+	}
+	_, err = service.DB.Exec(`
+	insert into images (uid, gallery_id, filename, storage_key, original_key,
+		size, content_type, width, height, uploaded_at, position)
+	values ($1, $2, $3, $4, '', $5, $6, $7, $8, $9,
+		(select coalesce(max(position), 0) + 1 from images where gallery_id = $2));`,
+		img.UID, img.GalleryID, img.Filename, img.Key, img.Size, img.ContentType,
+		img.Width, img.Height, img.UploadedAt)
+	if err != nil {
+		return false, fmt.Errorf("import %v: %w", key, err)
+	}
+	return true, nil
+}
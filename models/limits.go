@@ -0,0 +1,104 @@
+package models
+
+import "fmt"
+
+const (
+	// DefaultMaxFileSize is the largest file, in bytes, a form upload accepts
+	// when UploadLimits doesn't specify its own.
+	DefaultMaxFileSize = 20 << 20
+	// DefaultMaxRequestSize is the largest form upload request, in bytes,
+	// when UploadLimits doesn't specify its own.
+	DefaultMaxRequestSize = 200 << 20
+	// DefaultMaxArchiveSize is the most bytes, in total, extracted from a
+	// single uploaded archive when UploadLimits doesn't specify its own.
+	DefaultMaxArchiveSize = 1 << 30
+	// DefaultMaxArchiveEntries is the most entries read from a single
+	// uploaded archive when UploadLimits doesn't specify its own.
+	DefaultMaxArchiveEntries = 1000
+)
+
+// UploadLimits restrict how much can be uploaded through the upload form.
+type UploadLimits struct {
+	// MaxFileSize is the largest single file, in bytes. Defaults to
+	// DefaultMaxFileSize.
+	MaxFileSize int64
+	// MaxRequestSize is the largest request body, in bytes, which may hold
+	// several files. Defaults to DefaultMaxRequestSize.
+	MaxRequestSize int64
+	// MaxUserSize is the total size, in bytes, of the images a user can keep
+	// across all their galleries. Zero means there is no limit.
+	MaxUserSize int64
+	// MaxArchiveSize is the most bytes extracted from an uploaded archive,
+	// across all its entries. Each entry is limited by MaxFileSize as well.
+	// Defaults to DefaultMaxArchiveSize.
+	MaxArchiveSize int64
+	// MaxArchiveEntries is the most entries read from an uploaded archive.
+	// Defaults to DefaultMaxArchiveEntries.
+	MaxArchiveEntries int
+}
+
+func (limits UploadLimits) FileLimit() int64 {
+	if limits.MaxFileSize <= 0 {
+		return DefaultMaxFileSize
+	}
+	return limits.MaxFileSize
+}
+
+func (limits UploadLimits) RequestLimit() int64 {
+	if limits.MaxRequestSize <= 0 {
+		return DefaultMaxRequestSize
+	}
+	return limits.MaxRequestSize
+}
+
+func (limits UploadLimits) ArchiveLimit() int64 {
+	if limits.MaxArchiveSize <= 0 {
+		return DefaultMaxArchiveSize
+	}
+	return limits.MaxArchiveSize
+}
+
+func (limits UploadLimits) ArchiveEntryLimit() int {
+	if limits.MaxArchiveEntries <= 0 {
+		return DefaultMaxArchiveEntries
+	}
+	return limits.MaxArchiveEntries
+}
+
+// UserAllows reports whether a user who already stores used bytes of images
+// can upload another size bytes.
+func (limits UploadLimits) UserAllows(used, size int64) bool {
+	return limits.MaxUserSize <= 0 || used+size <= limits.MaxUserSize
+}
+
+// StorageUsed returns the total size, in bytes, of the images in all the
+// galleries of a user.
+func (service *GalleryService) StorageUsed(userID int) (int64, error) {
+	var used int64
+	row := service.DB.QueryRow(`
+	select coalesce(sum(images.size), 0)
+	from images
+	join galleries on galleries.id = images.gallery_id
+	where galleries.user_id = $1;`, userID)
+	err := row.Scan(&used)
+	if err != nil {
+		return 0, fmt.Errorf("storage used: %w", err)
+	}
+	return used, nil
+}
+
+// Size returns the total size, in bytes, of the images in a top level
+// gallery and the albums inside it.
+func (service *GalleryService) Size(galleryID int) (int64, error) {
+	var size int64
+	row := service.DB.QueryRow(`
+	select coalesce(sum(images.size), 0)
+	from images
+	join galleries on galleries.id = images.gallery_id
+	where galleries.id = $1 or galleries.root_id = $1;`, galleryID)
+	err := row.Scan(&size)
+	if err != nil {
+		return 0, fmt.Errorf("gallery size: %w", err)
+	}
+	return size, nil
+}
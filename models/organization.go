@@ -0,0 +1,545 @@
+package models
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/Pupsichekk/lenslocked/rand"
+)
+
+const (
+	// DefaultInvitationDuration is how long an invitation to join an
+	// organization can be accepted when OrganizationService doesn't specify
+	// its own.
+	DefaultInvitationDuration = 7 * 24 * time.Hour
+)
+
+var (
+	ErrLastAdmin = errors.New("models: organizations need at least one admin")
+)
+
+// OrganizationRole is what a member is allowed to do in an organization.
+type OrganizationRole string
+
+const (
+	// OrganizationNone is the role of users who aren't members of an
+	// organization.
+	OrganizationNone OrganizationRole = ""
+	// OrganizationMember can create galleries for the organization and
+	// curate the images of all of them.
+	OrganizationMember OrganizationRole = "member"
+	// OrganizationAdmin can do anything with the galleries of the
+	// organization, and manage its members as well.
+	OrganizationAdmin OrganizationRole = "admin"
+)
+
+// Valid reports whether r is one of the roles members can be given.
+func (r OrganizationRole) Valid() bool {
+	return r == OrganizationMember || r == OrganizationAdmin
+}
+
+// GalleryRole returns the role a member with role r has in every gallery of
+// the organization.
+func (r OrganizationRole) GalleryRole() Role {
+	switch r {
+	case OrganizationAdmin:
+		return RoleOwner
+	case OrganizationMember:
+		return RoleEditor
+	}
+	return RoleNone
+}
+
+// Organization is a group of users sharing the galleries that belong to it.
+type Organization struct {
+	ID   int
+	Name string
+	// Role is the role of the user the organization was looked up for, if
+	// it was looked up for one.
+	Role OrganizationRole
+}
+
+type Member struct {
+	OrganizationID int
+	UserID         int
+	Email          string
+	Role           OrganizationRole
+}
+
+// Invitation lets the user with its email join an organization.
+type Invitation struct {
+	ID               int
+	OrganizationID   int
+	OrganizationName string
+	Email            string
+	Role             OrganizationRole
+	// Token is only set when creating a new invitation, only its hash is
+	// stored.
+	Token     string
+	TokenHash string
+	ExpiresAt time.Time
+}
+
+type OrganizationService struct {
+	DB *sql.DB
+	// BytesPerToken is used to determine how many bytes are used to generate
+	// invitation tokens. If specified bytes are less than MinBytesPerToken
+	// MinBytesPerToken will be used instead.
+	BytesPerToken int
+	// InvitationDuration is how long invitations can be accepted. Defaults to
+	// DefaultInvitationDuration.
+	InvitationDuration time.Duration
+}
+
+// Create creates an organization with the user as its only admin.
+func (service *OrganizationService) Create(name string, userID int) (*Organization, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return nil, fmt.Errorf("create organization: name is required")
+	}
+	tx, err := service.DB.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("create organization: %w", err)
+	}
+	defer tx.Rollback()
+	org := Organization{
+		Name: name,
+		Role: OrganizationAdmin,
+	}
+	row := tx.QueryRow(`
+	insert into organizations (name)
+	values ($1)
+	returning id;`, org.Name)
+	err = row.Scan(&org.ID)
+	if err != nil {
+		return nil, fmt.Errorf("create organization: %w", err)
+	}
+	_, err = tx.Exec(`
+	insert into organization_members (organization_id, user_id, role)
+	values ($1, $2, $3);`, org.ID, userID, org.Role)
+	if err != nil {
+		return nil, fmt.Errorf("create organization: %w", err)
+	}
+	err = tx.Commit()
+	if err != nil {
+		return nil, fmt.Errorf("create organization: %w", err)
+	}
+	return &org, nil
+}
+
+// ByID looks up an organization along with the role of the user in it.
+// ErrNotFound is returned if the user isn't a member.
+func (service *OrganizationService) ByID(id, userID int) (*Organization, error) {
+	org := Organization{
+		ID: id,
+	}
+	row := service.DB.QueryRow(`
+	select organizations.name, organization_members.role
+	from organizations
+	join organization_members on organization_members.organization_id = organizations.id
+	where organizations.id = $1 and organization_members.user_id = $2;`, id, userID)
+	err := row.Scan(&org.Name, &org.Role)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("query organization: %w", err)
+	}
+	return &org, nil
+}
+
+// ByUserID returns the organizations a user is a member of, ordered by name.
+func (service *OrganizationService) ByUserID(userID int) ([]Organization, error) {
+	rows, err := service.DB.Query(`
+	select organizations.id, organizations.name, organization_members.role
+	from organizations
+	join organization_members on organization_members.organization_id = organizations.id
+	where organization_members.user_id = $1
+	order by organizations.name, organizations.id;`, userID)
+	if err != nil {
+		return nil, fmt.Errorf("query organizations by user: %w", err)
+	}
+	defer rows.Close()
+	var orgs []Organization
+	for rows.Next() {
+		var org Organization
+		err := rows.Scan(&org.ID, &org.Name, &org.Role)
+		if err != nil {
+			return nil, fmt.Errorf("query organizations by user: %w", err)
+		}
+		orgs = append(orgs, org)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("query organizations by user: %w", err)
+	}
+	return orgs, nil
+}
+
+// Members returns the members of an organization, ordered by email.
+func (service *OrganizationService) Members(orgID int) ([]Member, error) {
+	rows, err := service.DB.Query(`
+	select users.id, users.email, organization_members.role
+	from organization_members
+	join users on users.id = organization_members.user_id
+	where organization_members.organization_id = $1
+	order by users.email;`, orgID)
+	if err != nil {
+		return nil, fmt.Errorf("query members: %w", err)
+	}
+	defer rows.Close()
+	var members []Member
+	for rows.Next() {
+		member := Member{
+			OrganizationID: orgID,
+		}
+		err := rows.Scan(&member.UserID, &member.Email, &member.Role)
+		if err != nil {
+			return nil, fmt.Errorf("query members: %w", err)
+		}
+		members = append(members, member)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("query members: %w", err)
+	}
+	return members, nil
+}
+
+// RemoveMember removes a user from an organization. ErrLastAdmin is returned
+// if they are its only admin.
+func (service *OrganizationService) RemoveMember(orgID, userID int) error {
+	tx, err := service.DB.Begin()
+	if err != nil {
+		return fmt.Errorf("remove member: %w", err)
+	}
+	defer tx.Rollback()
+	err = lockLastAdmin(tx, orgID, userID)
+	if err != nil {
+		return fmt.Errorf("remove member: %w", err)
+	}
+	_, err = tx.Exec(`
+	delete from organization_members
+	where organization_id = $1 and user_id = $2;`, orgID, userID)
+	if err != nil {
+		return fmt.Errorf("remove member: %w", err)
+	}
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("remove member: %w", err)
+	}
+	return nil
+}
+
+// SetRole changes the role of a member of an organization. ErrLastAdmin is
+// returned if they are its only admin and would no longer be one, ErrNotFound
+// if they aren't a member.
+func (service *OrganizationService) SetRole(orgID, userID int, role OrganizationRole) error {
+	if !role.Valid() {
+		return fmt.Errorf("set member role: invalid role %q", role)
+	}
+	tx, err := service.DB.Begin()
+	if err != nil {
+		return fmt.Errorf("set member role: %w", err)
+	}
+	defer tx.Rollback()
+	if role != OrganizationAdmin {
+		err = lockLastAdmin(tx, orgID, userID)
+		if err != nil {
+			return fmt.Errorf("set member role: %w", err)
+		}
+	}
+	result, err := tx.Exec(`
+	update organization_members
+	set role = $3
+	where organization_id = $1 and user_id = $2;`, orgID, userID, role)
+	if err != nil {
+		return fmt.Errorf("set member role: %w", err)
+	}
+	if n, err := result.RowsAffected(); err != nil || n == 0 {
+		return fmt.Errorf("set member role: %w", ErrNotFound)
+	}
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("set member role: %w", err)
+	}
+	return nil
+}
+
+// lockLastAdmin locks the admins of an organization until tx ends, returning
+// ErrLastAdmin if the user is the only one. Locking them makes sure two
+// admins removing or demoting each other can't leave the organization
+// without one.
+func lockLastAdmin(tx *sql.Tx, orgID, userID int) error {
+	rows, err := tx.Query(`
+	select user_id
+	from organization_members
+	where organization_id = $1 and role = $2
+	for update;`, orgID, OrganizationAdmin)
+	if err != nil {
+		return err
+	}
+	var admins []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return err
+		}
+		admins = append(admins, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if len(admins) == 1 && admins[0] == userID {
+		return ErrLastAdmin
+	}
+	return nil
+}
+
+// Delete deletes an organization along with its members and invitations.
+// Its galleries aren't deleted, they go to the admin deleting it. The users
+// who created them may no longer be members, or never had access to them.
+func (service *OrganizationService) Delete(id, adminID int) error {
+	tx, err := service.DB.Begin()
+	if err != nil {
+		return fmt.Errorf("delete organization: %w", err)
+	}
+	defer tx.Rollback()
+	var name, email string
+	row := tx.QueryRow(`
+	select organizations.name, users.email
+	from organizations, users
+	where organizations.id = $1 and users.id = $2;`, id, adminID)
+	err = row.Scan(&name, &email)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return fmt.Errorf("delete organization: %w", ErrNotFound)
+		}
+		return fmt.Errorf("delete organization: %w", err)
+	}
+	rows, err := tx.Query(`
+	update galleries
+	set user_id = $2, organization_id = null
+	where organization_id = $1
+	returning id, parent_id is null;`, id, adminID)
+	if err != nil {
+		return fmt.Errorf("delete organization: %w", err)
+	}
+	var galleryIDs []int
+	for rows.Next() {
+		var galleryID int
+		var topLevel bool
+		err = rows.Scan(&galleryID, &topLevel)
+		if err != nil {
+			rows.Close()
+			return fmt.Errorf("delete organization: %w", err)
+		}
+		if topLevel {
+			galleryIDs = append(galleryIDs, galleryID)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("delete organization: %w", err)
+	}
+	for _, galleryID := range galleryIDs {
+		// The admin owns the gallery now, they don't need a role of their
+		// own anymore.
+		_, err = tx.Exec(`
+		delete from gallery_collaborators
+		where gallery_id = $1 and user_id = $2;`, galleryID, adminID)
+		if err != nil {
+			return fmt.Errorf("delete organization: %w", err)
+		}
+		err = recordAudit(tx, AuditEntry{
+			Action:    AuditOrganizationDeleted,
+			ActorID:   adminID,
+			GalleryID: galleryID,
+			Details: map[string]string{
+				"organization": name,
+				"to_email":     email,
+			},
+		})
+		if err != nil {
+			return fmt.Errorf("delete organization: %w", err)
+		}
+	}
+	_, err = tx.Exec(`
+	delete from organizations
+	where id = $1;`, id)
+	if err != nil {
+		return fmt.Errorf("delete organization: %w", err)
+	}
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("delete organization: %w", err)
+	}
+	return nil
+}
+
+// Invite creates an invitation for the user with the given email to join an
+// organization, replacing any invitation they had already. The user doesn't
+// need to have an account yet.
+func (service *OrganizationService) Invite(orgID int, email string, role OrganizationRole, invitedBy int) (*Invitation, error) {
+	if !role.Valid() {
+		return nil, fmt.Errorf("invite member: invalid role %q", role)
+	}
+	bytesPerToken := service.BytesPerToken
+	if bytesPerToken < MinBytesPerToken {
+		bytesPerToken = MinBytesPerToken
+	}
+	token, err := rand.String(bytesPerToken)
+	if err != nil {
+		return nil, fmt.Errorf("invite member: %w", err)
+	}
+	duration := service.InvitationDuration
+	if duration <= 0 {
+		duration = DefaultInvitationDuration
+	}
+	invitation := Invitation{
+		OrganizationID: orgID,
+		Email:          strings.ToLower(strings.TrimSpace(email)),
+		Role:           role,
+		Token:          token,
+		TokenHash:      service.hash(token),
+		ExpiresAt:      time.Now().Add(duration),
+	}
+	row := service.DB.QueryRow(`
+	insert into organization_invitations (organization_id, email, role, token_hash, invited_by, expires_at)
+	values ($1, $2, $3, $4, $5, $6) on conflict (organization_id, email) do
+	update
+	set role = $3, token_hash = $4, invited_by = $5, expires_at = $6
+	returning id, (select name from organizations where id = $1);`, invitation.OrganizationID,
+		invitation.Email, invitation.Role, invitation.TokenHash, invitedBy, invitation.ExpiresAt)
+	err = row.Scan(&invitation.ID, &invitation.OrganizationName)
+	if err != nil {
+		return nil, fmt.Errorf("invite member: %w", err)
+	}
+	return &invitation, nil
+}
+
+// Invitations returns the invitations of an organization that can still be
+// accepted, newest first.
+func (service *OrganizationService) Invitations(orgID int) ([]Invitation, error) {
+	rows, err := service.DB.Query(`
+	select id, email, role, token_hash, expires_at
+	from organization_invitations
+	where organization_id = $1 and expires_at > now()
+	order by created_at desc, id desc;`, orgID)
+	if err != nil {
+		return nil, fmt.Errorf("query invitations: %w", err)
+	}
+	defer rows.Close()
+	var invitations []Invitation
+	for rows.Next() {
+		invitation := Invitation{
+			OrganizationID: orgID,
+		}
+		err := rows.Scan(&invitation.ID, &invitation.Email, &invitation.Role,
+			&invitation.TokenHash, &invitation.ExpiresAt)
+		if err != nil {
+			return nil, fmt.Errorf("query invitations: %w", err)
+		}
+		invitations = append(invitations, invitation)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("query invitations: %w", err)
+	}
+	return invitations, nil
+}
+
+// Invitation looks up the invitation with the given token. ErrLinkExpired is
+// returned if it can't be accepted anymore, ErrNotFound if there is no such
+// invitation.
+func (service *OrganizationService) Invitation(token string) (*Invitation, error) {
+	invitation := Invitation{
+		Token:     token,
+		TokenHash: service.hash(token),
+	}
+	row := service.DB.QueryRow(`
+	select organization_invitations.id, organization_invitations.organization_id,
+		organizations.name, organization_invitations.email, organization_invitations.role,
+		organization_invitations.expires_at
+	from organization_invitations
+	join organizations on organizations.id = organization_invitations.organization_id
+	where organization_invitations.token_hash = $1;`, invitation.TokenHash)
+	err := row.Scan(&invitation.ID, &invitation.OrganizationID, &invitation.OrganizationName,
+		&invitation.Email, &invitation.Role, &invitation.ExpiresAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("query invitation: %w", ErrNotFound)
+		}
+		return nil, fmt.Errorf("query invitation: %w", err)
+	}
+	if !time.Now().Before(invitation.ExpiresAt) {
+		return nil, fmt.Errorf("query invitation: %w", ErrLinkExpired)
+	}
+	return &invitation, nil
+}
+
+// Accept makes user a member of the organization the invitation with the
+// given token is for, and uses the invitation up. Invitations can only be
+// accepted by the user they were sent to, ErrNotFound is returned for
+// anyone else. Users who are members already keep their role, unless the
+// invitation makes them an admin.
+func (service *OrganizationService) Accept(token string, user *User) (*Invitation, error) {
+	invitation, err := service.Invitation(token)
+	if err != nil {
+		return nil, fmt.Errorf("accept invitation: %w", err)
+	}
+	if invitation.Email != strings.ToLower(user.Email) {
+		return nil, fmt.Errorf("accept invitation: %w", ErrNotFound)
+	}
+	tx, err := service.DB.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("accept invitation: %w", err)
+	}
+	defer tx.Rollback()
+	// Deleting the invitation first makes sure it is only used once.
+	result, err := tx.Exec(`
+	delete from organization_invitations
+	where id = $1 and token_hash = $2;`, invitation.ID, invitation.TokenHash)
+	if err != nil {
+		return nil, fmt.Errorf("accept invitation: %w", err)
+	}
+	if n, err := result.RowsAffected(); err != nil || n == 0 {
+		return nil, fmt.Errorf("accept invitation: %w", ErrNotFound)
+	}
+	_, err = tx.Exec(`
+	insert into organization_members (organization_id, user_id, role)
+	values ($1, $2, $3) on conflict (organization_id, user_id) do
+	update
+	set role = $3
+	where $3 = 'admin';`,
+		invitation.OrganizationID, user.ID, invitation.Role)
+	if err != nil {
+		return nil, fmt.Errorf("accept invitation: %w", err)
+	}
+	err = tx.Commit()
+	if err != nil {
+		return nil, fmt.Errorf("accept invitation: %w", err)
+	}
+	return invitation, nil
+}
+
+// RevokeInvitation deletes an invitation of an organization, so it can't be
+// accepted anymore.
+func (service *OrganizationService) RevokeInvitation(orgID, id int) error {
+	_, err := service.DB.Exec(`
+	delete from organization_invitations
+	where organization_id = $1 and id = $2;`, orgID, id)
+	if err != nil {
+		return fmt.Errorf("revoke invitation: %w", err)
+	}
+	return nil
+}
+
+func (service *OrganizationService) hash(token string) string {
+	tokenHash := sha256.Sum256([]byte(token))
+	return base64.URLEncoding.EncodeToString(tokenHash[:])
+}
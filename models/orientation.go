@@ -0,0 +1,126 @@
+package models
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/jpeg"
+	"io"
+)
+
+// jpegExifSegment returns the first APP1 segment of a JPEG image that holds
+// EXIF data.
+func jpegExifSegment(r io.Reader) ([]byte, bool) {
+	br := bufio.NewReader(r)
+	var soi [2]byte
+	_, err := io.ReadFull(br, soi[:])
+	if err != nil || soi[0] != 0xFF || soi[1] != jpegSOI {
+		return nil, false
+	}
+	for {
+		marker, err := readJPEGMarker(br)
+		if err != nil || marker == jpegSOS {
+			return nil, false
+		}
+		var length [2]byte
+		_, err = io.ReadFull(br, length[:])
+		if err != nil {
+			return nil, false
+		}
+		n := int(binary.BigEndian.Uint16(length[:]))
+		if n < 2 {
+			return nil, false
+		}
+		segment := make([]byte, n-2)
+		_, err = io.ReadFull(br, segment)
+		if err != nil {
+			return nil, false
+		}
+		if marker == jpegAPP1 && bytes.HasPrefix(segment, exifHeader) {
+			return segment, true
+		}
+	}
+}
+
+// normalizeOrientation rotates and flips a JPEG image so it displays upright
+// without relying on its EXIF orientation. The re-encoded image keeps the
+// original EXIF data, with the orientation reset to 1. If the image already
+// is upright, ok is false and the image should be stored as is.
+func normalizeOrientation(src image.Image, original io.Reader) (rotated image.Image, encoded []byte, ok bool, err error) {
+	segment, found := jpegExifSegment(original)
+	if !found {
+		return nil, nil, false, nil
+	}
+	offset, order, found := exifOrientationOffset(segment)
+	if !found {
+		return nil, nil, false, nil
+	}
+	orientation := order.Uint16(segment[offset:])
+	if orientation < 2 || orientation > 8 {
+		return nil, nil, false, nil
+	}
+	rotated = orient(src, orientation)
+
+	var buf bytes.Buffer
+	err = jpeg.Encode(&buf, rotated, &jpeg.Options{Quality: 95})
+	if err != nil {
+		return nil, nil, false, fmt.Errorf("normalize orientation: %w", err)
+	}
+	exif := make([]byte, len(segment))
+	copy(exif, segment)
+	order.PutUint16(exif[offset:], 1)
+
+	// The encoder doesn't write any metadata, so the EXIF segment can go
+	// right after the start of image marker.
+	var out bytes.Buffer
+	out.Write(buf.Bytes()[:2])
+	err = writeJPEGSegment(&out, jpegAPP1, exif)
+	if err != nil {
+		return nil, nil, false, fmt.Errorf("normalize orientation: %w", err)
+	}
+	out.Write(buf.Bytes()[2:])
+	return rotated, out.Bytes(), true, nil
+}
+
+// orient applies the transformation described by an EXIF orientation value
+// to src, returning an image that displays correctly without it.
+func orient(src image.Image, orientation uint16) image.Image {
+	b := src.Bounds()
+	rgba := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(rgba, rgba.Bounds(), src, b.Min, draw.Src)
+	w, h := b.Dx(), b.Dy()
+
+	dw, dh := w, h
+	if orientation >= 5 {
+		dw, dh = h, w
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for dy := 0; dy < dh; dy++ {
+		for dx := 0; dx < dw; dx++ {
+			var sx, sy int
+			switch orientation {
+			case 2: // mirrored horizontally
+				sx, sy = w-1-dx, dy
+			case 3: // rotated 180°
+				sx, sy = w-1-dx, h-1-dy
+			case 4: // mirrored vertically
+				sx, sy = dx, h-1-dy
+			case 5: // transposed
+				sx, sy = dy, dx
+			case 6: // needs a 90° clockwise rotation
+				sx, sy = dy, h-1-dx
+			case 7: // transversed
+				sx, sy = w-1-dy, h-1-dx
+			case 8: // needs a 90° counter clockwise rotation
+				sx, sy = w-1-dy, dx
+			}
+			si := rgba.PixOffset(sx, sy)
+			di := dst.PixOffset(dx, dy)
+			copy(dst.Pix[di:di+4], rgba.Pix[si:si+4])
+		}
+	}
+	return dst
+}
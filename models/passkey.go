@@ -0,0 +1,476 @@
+package models
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/Pupsichekk/lenslocked/rand"
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+)
+
+const (
+	// DefaultCeremonyDuration is how long the browser has to respond when
+	// registering or signing in with a passkey, when PasskeyService doesn't
+	// specify its own duration.
+	DefaultCeremonyDuration = 5 * time.Minute
+	// passkeyHandleBytes is the size of the handles identifying users to
+	// their authenticators, the most WebAuthn allows.
+	passkeyHandleBytes = 64
+	// maxPasskeyNameLength keeps passkey names short enough for the
+	// settings page.
+	maxPasskeyNameLength = 100
+)
+
+var (
+	ErrInvalidPasskey = errors.New("models: the passkey couldn't be verified")
+)
+
+// PasskeyConfig describes the site passkeys are registered for.
+type PasskeyConfig struct {
+	// RPID is the domain of the site, e.g. "example.com". Passkeys only work
+	// on that domain and its subdomains.
+	RPID string
+	// Origin is the URL the site is served from, e.g.
+	// "https://example.com". Defaults to https:// followed by RPID.
+	Origin string
+	// DisplayName names the site when users pick a passkey. Defaults to
+	// DefaultTwoFactorIssuer.
+	DisplayName string
+}
+
+// Passkey is a credential users can sign in with instead of their password.
+type Passkey struct {
+	ID     int
+	UserID int
+	// Name tells passkeys of a user apart, e.g. "Work laptop".
+	Name      string
+	CreatedAt time.Time
+	// LastUsedAt is nil for passkeys that were never used to sign in.
+	LastUsedAt *time.Time
+	Credential webauthn.Credential
+}
+
+// PasskeyCeremony is a passkey registration or sign in waiting for the
+// browser to respond.
+type PasskeyCeremony struct {
+	// Token identifies the ceremony when the browser responds, only its hash
+	// is stored.
+	Token string
+	// Options are passed to navigator.credentials.create when registering a
+	// passkey, and to navigator.credentials.get when signing in.
+	Options any
+}
+
+type PasskeyService struct {
+	DB       *sql.DB
+	WebAuthn *webauthn.WebAuthn
+	// BytesPerToken is used to determine how many bytes are used to generate
+	// ceremony tokens. If specified bytes are less than MinBytesPerToken
+	// MinBytesPerToken will be used instead.
+	BytesPerToken int
+	// CeremonyDuration is how long the browser has to respond. Defaults to
+	// DefaultCeremonyDuration.
+	CeremonyDuration time.Duration
+}
+
+func NewPasskeyService(db *sql.DB, config PasskeyConfig) (*PasskeyService, error) {
+	origin := config.Origin
+	if origin == "" {
+		origin = "https://" + config.RPID
+	}
+	displayName := config.DisplayName
+	if displayName == "" {
+		displayName = DefaultTwoFactorIssuer
+	}
+	wa, err := webauthn.New(&webauthn.Config{
+		RPID:          config.RPID,
+		RPDisplayName: displayName,
+		RPOrigins:     []string{origin},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("new passkey service: %w", err)
+	}
+	return &PasskeyService{
+		DB:       db,
+		WebAuthn: wa,
+	}, nil
+}
+
+// passkeyUser is a user along with their passkeys, the way the webauthn
+// package needs them.
+type passkeyUser struct {
+	user        *User
+	handle      []byte
+	credentials []webauthn.Credential
+}
+
+func (pu *passkeyUser) WebAuthnID() []byte                         { return pu.handle }
+func (pu *passkeyUser) WebAuthnName() string                       { return pu.user.Email }
+func (pu *passkeyUser) WebAuthnDisplayName() string                { return pu.user.Email }
+func (pu *passkeyUser) WebAuthnCredentials() []webauthn.Credential { return pu.credentials }
+func (pu *passkeyUser) WebAuthnIcon() string                       { return "" }
+
+// BeginRegistration starts registering a new passkey for user. Passkeys the
+// user already has are excluded, so the same authenticator isn't registered
+// twice.
+func (service *PasskeyService) BeginRegistration(user *User) (*PasskeyCeremony, error) {
+	handle, err := rand.Bytes(passkeyHandleBytes)
+	if err != nil {
+		return nil, fmt.Errorf("begin passkey registration: %w", err)
+	}
+	// Users keep the handle of their first passkey for all others.
+	row := service.DB.QueryRow(`
+	update users
+	set passkey_handle = coalesce(passkey_handle, $2)
+	where id = $1
+	returning passkey_handle;`, user.ID, handle)
+	err = row.Scan(&handle)
+	if err != nil {
+		return nil, fmt.Errorf("begin passkey registration: %w", err)
+	}
+	pu, err := service.passkeyUser(user, handle)
+	if err != nil {
+		return nil, fmt.Errorf("begin passkey registration: %w", err)
+	}
+	options, session, err := service.beginRegistration(pu)
+	if err != nil {
+		return nil, fmt.Errorf("begin passkey registration: %w", err)
+	}
+	token, err := service.startCeremony(user.ID, session)
+	if err != nil {
+		return nil, fmt.Errorf("begin passkey registration: %w", err)
+	}
+	return &PasskeyCeremony{
+		Token:   token,
+		Options: options,
+	}, nil
+}
+
+// FinishRegistration verifies the response of the authenticator to the
+// registration ceremony with the given token, and stores the new passkey.
+// ErrInvalidPasskey is returned if the response can't be verified.
+func (service *PasskeyService) FinishRegistration(user *User, token, name string, response *protocol.ParsedCredentialCreationData) (*Passkey, error) {
+	ceremony, err := service.takeCeremony(token)
+	if err != nil {
+		return nil, fmt.Errorf("finish passkey registration: %w", err)
+	}
+	pu, err := service.passkeyUser(user, ceremony.Session.UserID)
+	if err != nil {
+		return nil, fmt.Errorf("finish passkey registration: %w", err)
+	}
+	credential, err := service.finishRegistration(ceremony, pu, response)
+	if err != nil {
+		return nil, fmt.Errorf("finish passkey registration: %w", err)
+	}
+	name = strings.TrimSpace(name)
+	if runes := []rune(name); len(runes) > maxPasskeyNameLength {
+		name = string(runes[:maxPasskeyNameLength])
+	}
+	if name == "" {
+		name = "Passkey"
+	}
+	passkey := Passkey{
+		UserID:     user.ID,
+		Name:       name,
+		Credential: *credential,
+	}
+	credentialJSON, err := json.Marshal(passkey.Credential)
+	if err != nil {
+		return nil, fmt.Errorf("finish passkey registration: %w", err)
+	}
+	row := service.DB.QueryRow(`
+	insert into passkeys (user_id, name, credential_id, credential)
+	values ($1, $2, $3, $4)
+	returning id, created_at;`, passkey.UserID, passkey.Name, passkey.Credential.ID, credentialJSON)
+	err = row.Scan(&passkey.ID, &passkey.CreatedAt)
+	if err != nil {
+		return nil, fmt.Errorf("finish passkey registration: %w", err)
+	}
+	return &passkey, nil
+}
+
+// BeginLogin starts signing in with a passkey. Nobody is signed in yet, so
+// the browser offers all passkeys it has for the site and the one picked
+// tells who the user is.
+func (service *PasskeyService) BeginLogin() (*PasskeyCeremony, error) {
+	options, session, err := service.beginLogin()
+	if err != nil {
+		return nil, fmt.Errorf("begin passkey login: %w", err)
+	}
+	token, err := service.startCeremony(0, session)
+	if err != nil {
+		return nil, fmt.Errorf("begin passkey login: %w", err)
+	}
+	return &PasskeyCeremony{
+		Token:   token,
+		Options: options,
+	}, nil
+}
+
+// FinishLogin verifies the response of the authenticator to the sign in
+// ceremony with the given token, returning the user the passkey belongs to.
+// ErrInvalidPasskey is returned if it can't be verified, or if the passkey
+// looks cloned.
+func (service *PasskeyService) FinishLogin(token string, response *protocol.ParsedCredentialAssertionData) (*User, error) {
+	ceremony, err := service.takeCeremony(token)
+	if err != nil {
+		return nil, fmt.Errorf("finish passkey login: %w", err)
+	}
+	lookup := func(userHandle []byte) (*passkeyUser, error) {
+		user := User{}
+		row := service.DB.QueryRow(`
+		select id, email, password_hash
+		from users
+		where passkey_handle = $1;`, userHandle)
+		err := row.Scan(&user.ID, &user.Email, &user.PasswordHash)
+		if err != nil {
+			return nil, err
+		}
+		return service.passkeyUser(&user, userHandle)
+	}
+	user, credential, err := service.finishLogin(ceremony, lookup, response)
+	if err != nil {
+		return nil, fmt.Errorf("finish passkey login: %w", err)
+	}
+	credentialJSON, err := json.Marshal(credential)
+	if err != nil {
+		return nil, fmt.Errorf("finish passkey login: %w", err)
+	}
+	_, err = service.DB.Exec(`
+	update passkeys
+	set credential = $3, last_used_at = now()
+	where user_id = $1 and credential_id = $2;`, user.ID, credential.ID, credentialJSON)
+	if err != nil {
+		return nil, fmt.Errorf("finish passkey login: %w", err)
+	}
+	return user, nil
+}
+
+// ByUserID returns the passkeys of a user, oldest first.
+func (service *PasskeyService) ByUserID(userID int) ([]Passkey, error) {
+	rows, err := service.DB.Query(`
+	select id, name, credential, created_at, last_used_at
+	from passkeys
+	where user_id = $1
+	order by id;`, userID)
+	if err != nil {
+		return nil, fmt.Errorf("query passkeys by user: %w", err)
+	}
+	defer rows.Close()
+	var passkeys []Passkey
+	for rows.Next() {
+		passkey := Passkey{
+			UserID: userID,
+		}
+		var credentialJSON []byte
+		var lastUsedAt sql.NullTime
+		err = rows.Scan(&passkey.ID, &passkey.Name, &credentialJSON, &passkey.CreatedAt, &lastUsedAt)
+		if err != nil {
+			return nil, fmt.Errorf("query passkeys by user: %w", err)
+		}
+		err = json.Unmarshal(credentialJSON, &passkey.Credential)
+		if err != nil {
+			return nil, fmt.Errorf("query passkeys by user: %w", err)
+		}
+		if lastUsedAt.Valid {
+			passkey.LastUsedAt = &lastUsedAt.Time
+		}
+		passkeys = append(passkeys, passkey)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("query passkeys by user: %w", err)
+	}
+	return passkeys, nil
+}
+
+// Delete removes a passkey of a user. ErrNotFound is returned if the user
+// has no such passkey.
+func (service *PasskeyService) Delete(userID, id int) error {
+	result, err := service.DB.Exec(`
+	delete from passkeys
+	where id = $1 and user_id = $2;`, id, userID)
+	if err != nil {
+		return fmt.Errorf("delete passkey: %w", err)
+	}
+	if n, err := result.RowsAffected(); err != nil || n == 0 {
+		return fmt.Errorf("delete passkey: %w", ErrNotFound)
+	}
+	return nil
+}
+
+// passkeyUser loads the passkeys of user for the webauthn package.
+func (service *PasskeyService) passkeyUser(user *User, handle []byte) (*passkeyUser, error) {
+	passkeys, err := service.ByUserID(user.ID)
+	if err != nil {
+		return nil, err
+	}
+	pu := passkeyUser{
+		user:   user,
+		handle: handle,
+	}
+	for _, passkey := range passkeys {
+		pu.credentials = append(pu.credentials, passkey.Credential)
+	}
+	return &pu, nil
+}
+
+// startCeremony stores the session data of a ceremony until the browser
+// responds, returning the token identifying it. userID is 0 when signing in.
+// Ceremonies that expired are cleaned up along the way.
+func (service *PasskeyService) startCeremony(userID int, session *webauthn.SessionData) (string, error) {
+	bytesPerToken := service.BytesPerToken
+	if bytesPerToken < MinBytesPerToken {
+		bytesPerToken = MinBytesPerToken
+	}
+	token, err := rand.String(bytesPerToken)
+	if err != nil {
+		return "", err
+	}
+	sessionJSON, err := json.Marshal(session)
+	if err != nil {
+		return "", err
+	}
+	duration := service.CeremonyDuration
+	if duration <= 0 {
+		duration = DefaultCeremonyDuration
+	}
+	_, err = service.DB.Exec(`
+	delete from passkey_ceremonies
+	where expires_at <= now();`)
+	if err != nil {
+		return "", err
+	}
+	var user sql.NullInt64
+	if userID != 0 {
+		user = sql.NullInt64{Int64: int64(userID), Valid: true}
+	}
+	_, err = service.DB.Exec(`
+	insert into passkey_ceremonies (user_id, token_hash, session_data, expires_at)
+	values ($1, $2, $3, $4);`, user, service.hash(token), sessionJSON, time.Now().Add(duration))
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// passkeyCeremony is a ceremony as stored until the browser responds.
+type passkeyCeremony struct {
+	// UserID is 0 when signing in.
+	UserID    int
+	Session   webauthn.SessionData
+	ExpiresAt time.Time
+}
+
+// takeCeremony looks up the ceremony with the given token and deletes it, so
+// each challenge can only be answered once. ErrNotFound is returned if there
+// is no such ceremony.
+func (service *PasskeyService) takeCeremony(token string) (*passkeyCeremony, error) {
+	var ceremony passkeyCeremony
+	var userID sql.NullInt64
+	var sessionJSON []byte
+	row := service.DB.QueryRow(`
+	delete from passkey_ceremonies
+	where token_hash = $1
+	returning user_id, session_data, expires_at;`, service.hash(token))
+	err := row.Scan(&userID, &sessionJSON, &ceremony.ExpiresAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+	ceremony.UserID = int(userID.Int64)
+	err = json.Unmarshal(sessionJSON, &ceremony.Session)
+	if err != nil {
+		return nil, err
+	}
+	return &ceremony, nil
+}
+
+// beginRegistration returns the options and session data of a registration
+// ceremony for pu. Passkeys pu already has are excluded, so the same
+// authenticator isn't registered twice.
+func (service *PasskeyService) beginRegistration(pu *passkeyUser) (*protocol.CredentialCreation, *webauthn.SessionData, error) {
+	var exclusions []protocol.CredentialDescriptor
+	for _, credential := range pu.credentials {
+		exclusions = append(exclusions, credential.Descriptor())
+	}
+	return service.WebAuthn.BeginRegistration(pu,
+		webauthn.WithExclusions(exclusions),
+		webauthn.WithAuthenticatorSelection(protocol.AuthenticatorSelection{
+			RequireResidentKey: protocol.ResidentKeyRequired(),
+			ResidentKey:        protocol.ResidentKeyRequirementRequired,
+			UserVerification:   protocol.VerificationRequired,
+		}))
+}
+
+// finishRegistration verifies the response of the authenticator to a
+// registration ceremony of pu, returning the new credential. ErrLinkExpired
+// is returned if the browser took too long, ErrNotFound if the ceremony was
+// started by someone else and ErrInvalidPasskey if the response can't be
+// verified.
+func (service *PasskeyService) finishRegistration(ceremony *passkeyCeremony, pu *passkeyUser, response *protocol.ParsedCredentialCreationData) (*webauthn.Credential, error) {
+	if !time.Now().Before(ceremony.ExpiresAt) {
+		return nil, ErrLinkExpired
+	}
+	if ceremony.UserID == 0 || ceremony.UserID != pu.user.ID {
+		return nil, ErrNotFound
+	}
+	credential, err := service.WebAuthn.CreateCredential(pu, ceremony.Session, response)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidPasskey, err)
+	}
+	return credential, nil
+}
+
+// beginLogin returns the options and session data of a sign in ceremony.
+func (service *PasskeyService) beginLogin() (*protocol.CredentialAssertion, *webauthn.SessionData, error) {
+	return service.WebAuthn.BeginDiscoverableLogin(
+		webauthn.WithUserVerification(protocol.VerificationRequired))
+}
+
+// finishLogin verifies the response of the authenticator to a sign in
+// ceremony. lookup returns the user with the handle the authenticator sent.
+// The user the passkey belongs to is returned along with the passkey, its
+// sign count updated. ErrLinkExpired is returned if the browser took too
+// long, ErrNotFound if the ceremony wasn't a sign in and ErrInvalidPasskey if
+// the response can't be verified or the passkey looks cloned.
+func (service *PasskeyService) finishLogin(ceremony *passkeyCeremony, lookup func(userHandle []byte) (*passkeyUser, error), response *protocol.ParsedCredentialAssertionData) (*User, *webauthn.Credential, error) {
+	if !time.Now().Before(ceremony.ExpiresAt) {
+		return nil, nil, ErrLinkExpired
+	}
+	if ceremony.UserID != 0 {
+		return nil, nil, ErrNotFound
+	}
+	var user *User
+	handler := func(rawID, userHandle []byte) (webauthn.User, error) {
+		pu, err := lookup(userHandle)
+		if err != nil {
+			return nil, err
+		}
+		user = pu.user
+		return pu, nil
+	}
+	credential, err := service.WebAuthn.ValidateDiscoverableLogin(handler, ceremony.Session, response)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: %v", ErrInvalidPasskey, err)
+	}
+	// Authenticators count how often they were used. A count that went
+	// backwards means someone else has a copy of the passkey.
+	if credential.Authenticator.CloneWarning {
+		return nil, nil, fmt.Errorf("sign count went backwards: %w", ErrInvalidPasskey)
+	}
+	return user, credential, nil
+}
+
+func (service *PasskeyService) hash(token string) string {
+	tokenHash := sha256.Sum256([]byte(token))
+	return base64.URLEncoding.EncodeToString(tokenHash[:])
+}
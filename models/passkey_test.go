@@ -0,0 +1,330 @@
+package models
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/protocol/webauthncbor"
+)
+
+const testPasskeyOrigin = "https://localhost"
+
+func testPasskeyService(t *testing.T) *PasskeyService {
+	t.Helper()
+	service, err := NewPasskeyService(nil, PasskeyConfig{RPID: "localhost"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return service
+}
+
+// softAuthenticator is a passkey kept in memory, answering ceremonies the
+// way a browser passes on the responses of a real authenticator.
+type softAuthenticator struct {
+	t      *testing.T
+	rpID   string
+	key    *ecdsa.PrivateKey
+	id     []byte
+	handle []byte
+	count  uint32
+}
+
+func newSoftAuthenticator(t *testing.T) *softAuthenticator {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := make([]byte, 16)
+	rand.Read(id)
+	return &softAuthenticator{t: t, rpID: "localhost", key: key, id: id}
+}
+
+func (a *softAuthenticator) clientData(typ string, challenge protocol.URLEncodedBase64) []byte {
+	clientData, err := json.Marshal(map[string]string{
+		"type":      typ,
+		"challenge": challenge.String(),
+		"origin":    testPasskeyOrigin,
+	})
+	if err != nil {
+		a.t.Fatal(err)
+	}
+	return clientData
+}
+
+// authData returns authenticator data with the user present and verified
+// flags set, followed by rest.
+func (a *softAuthenticator) authData(flags byte, rest []byte) []byte {
+	rpIDHash := sha256.Sum256([]byte(a.rpID))
+	data := append([]byte{}, rpIDHash[:]...)
+	data = append(data, flags|0x05)
+	data = binary.BigEndian.AppendUint32(data, a.count)
+	return append(data, rest...)
+}
+
+// create answers a registration ceremony.
+func (a *softAuthenticator) create(options *protocol.CredentialCreation) *protocol.ParsedCredentialCreationData {
+	a.t.Helper()
+	a.handle = options.Response.User.ID.(protocol.URLEncodedBase64)
+	publicKey, err := webauthncbor.Marshal(map[int]any{
+		1:  2,  // EC2
+		3:  -7, // ES256
+		-1: 1,  // P-256
+		-2: a.key.X.FillBytes(make([]byte, 32)),
+		-3: a.key.Y.FillBytes(make([]byte, 32)),
+	})
+	if err != nil {
+		a.t.Fatal(err)
+	}
+	var attested []byte
+	attested = append(attested, make([]byte, 16)...) // AAGUID
+	attested = binary.BigEndian.AppendUint16(attested, uint16(len(a.id)))
+	attested = append(attested, a.id...)
+	attested = append(attested, publicKey...)
+	attestation, err := webauthncbor.Marshal(map[string]any{
+		"fmt":      "none",
+		"attStmt":  map[string]any{},
+		"authData": a.authData(0x40, attested),
+	})
+	if err != nil {
+		a.t.Fatal(err)
+	}
+	body, err := json.Marshal(map[string]any{
+		"id":    base64.RawURLEncoding.EncodeToString(a.id),
+		"rawId": base64.RawURLEncoding.EncodeToString(a.id),
+		"type":  "public-key",
+		"response": map[string]any{
+			"attestationObject": base64.RawURLEncoding.EncodeToString(attestation),
+			"clientDataJSON":    base64.RawURLEncoding.EncodeToString(a.clientData("webauthn.create", options.Response.Challenge)),
+		},
+	})
+	if err != nil {
+		a.t.Fatal(err)
+	}
+	response, err := protocol.ParseCredentialCreationResponseBody(bytes.NewReader(body))
+	if err != nil {
+		a.t.Fatal(err)
+	}
+	return response
+}
+
+// get answers a sign in ceremony, counting one more use of the passkey.
+func (a *softAuthenticator) get(options *protocol.CredentialAssertion) *protocol.ParsedCredentialAssertionData {
+	a.t.Helper()
+	a.count++
+	authData := a.authData(0, nil)
+	clientData := a.clientData("webauthn.get", options.Response.Challenge)
+	clientDataHash := sha256.Sum256(clientData)
+	signed := sha256.Sum256(append(append([]byte{}, authData...), clientDataHash[:]...))
+	signature, err := ecdsa.SignASN1(rand.Reader, a.key, signed[:])
+	if err != nil {
+		a.t.Fatal(err)
+	}
+	body, err := json.Marshal(map[string]any{
+		"id":    base64.RawURLEncoding.EncodeToString(a.id),
+		"rawId": base64.RawURLEncoding.EncodeToString(a.id),
+		"type":  "public-key",
+		"response": map[string]any{
+			"authenticatorData": base64.RawURLEncoding.EncodeToString(authData),
+			"clientDataJSON":    base64.RawURLEncoding.EncodeToString(clientData),
+			"signature":         base64.RawURLEncoding.EncodeToString(signature),
+			"userHandle":        base64.RawURLEncoding.EncodeToString(a.handle),
+		},
+	})
+	if err != nil {
+		a.t.Fatal(err)
+	}
+	response, err := protocol.ParseCredentialRequestResponseBody(bytes.NewReader(body))
+	if err != nil {
+		a.t.Fatal(err)
+	}
+	return response
+}
+
+// register runs a registration ceremony of pu with the authenticator,
+// adding the new passkey to pu.
+func register(t *testing.T, service *PasskeyService, pu *passkeyUser, authenticator *softAuthenticator) {
+	t.Helper()
+	options, session, err := service.beginRegistration(pu)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ceremony := &passkeyCeremony{
+		UserID:    pu.user.ID,
+		Session:   *session,
+		ExpiresAt: time.Now().Add(time.Minute),
+	}
+	credential, err := service.finishRegistration(ceremony, pu, authenticator.create(options))
+	if err != nil {
+		t.Fatalf("finishRegistration() err = %v, want nil", err)
+	}
+	pu.credentials = append(pu.credentials, *credential)
+}
+
+// startLogin starts a sign in ceremony, returning the options for the
+// authenticator.
+func startLogin(t *testing.T, service *PasskeyService, expiresAt time.Time) (*protocol.CredentialAssertion, *passkeyCeremony) {
+	t.Helper()
+	options, session, err := service.beginLogin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return options, &passkeyCeremony{
+		Session:   *session,
+		ExpiresAt: expiresAt,
+	}
+}
+
+func lookupUser(pu *passkeyUser) func([]byte) (*passkeyUser, error) {
+	return func(userHandle []byte) (*passkeyUser, error) {
+		if !bytes.Equal(userHandle, pu.handle) {
+			return nil, ErrNotFound
+		}
+		return pu, nil
+	}
+}
+
+func newTestPasskeyUser(t *testing.T, id int) *passkeyUser {
+	t.Helper()
+	handle := make([]byte, passkeyHandleBytes)
+	rand.Read(handle)
+	return &passkeyUser{
+		user:   &User{ID: id, Email: "jon@example.com"},
+		handle: handle,
+	}
+}
+
+func TestPasskeyRoundTrip(t *testing.T) {
+	service := testPasskeyService(t)
+	pu := newTestPasskeyUser(t, 1)
+	authenticator := newSoftAuthenticator(t)
+	register(t, service, pu, authenticator)
+
+	for i := 0; i < 2; i++ {
+		options, ceremony := startLogin(t, service, time.Now().Add(time.Minute))
+		user, credential, err := service.finishLogin(ceremony, lookupUser(pu), authenticator.get(options))
+		if err != nil {
+			t.Fatalf("finishLogin() err = %v, want nil", err)
+		}
+		if user.ID != pu.user.ID {
+			t.Errorf("finishLogin() user = %d, want %d", user.ID, pu.user.ID)
+		}
+		if credential.Authenticator.SignCount != authenticator.count {
+			t.Errorf("finishLogin() sign count = %d, want %d", credential.Authenticator.SignCount, authenticator.count)
+		}
+		pu.credentials[0] = *credential
+	}
+}
+
+func TestPasskeyRegisterTwice(t *testing.T) {
+	service := testPasskeyService(t)
+	pu := newTestPasskeyUser(t, 1)
+	authenticator := newSoftAuthenticator(t)
+	register(t, service, pu, authenticator)
+
+	options, _, err := service.beginRegistration(pu)
+	if err != nil {
+		t.Fatal(err)
+	}
+	excluded := options.Response.CredentialExcludeList
+	if len(excluded) != 1 || !bytes.Equal(excluded[0].CredentialID, authenticator.id) {
+		t.Errorf("beginRegistration() exclusions = %v, want the registered passkey", excluded)
+	}
+}
+
+func TestPasskeyCloneWarning(t *testing.T) {
+	service := testPasskeyService(t)
+	pu := newTestPasskeyUser(t, 1)
+	authenticator := newSoftAuthenticator(t)
+	register(t, service, pu, authenticator)
+	// The copy of the passkey was used 5 times, the original is used again
+	// after that.
+	pu.credentials[0].Authenticator.SignCount = 5
+
+	options, ceremony := startLogin(t, service, time.Now().Add(time.Minute))
+	_, _, err := service.finishLogin(ceremony, lookupUser(pu), authenticator.get(options))
+	if !errors.Is(err, ErrInvalidPasskey) {
+		t.Errorf("finishLogin() err = %v, want %v", err, ErrInvalidPasskey)
+	}
+}
+
+func TestPasskeyExpiredCeremony(t *testing.T) {
+	service := testPasskeyService(t)
+	pu := newTestPasskeyUser(t, 1)
+	authenticator := newSoftAuthenticator(t)
+
+	options, session, err := service.beginRegistration(pu)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ceremony := &passkeyCeremony{
+		UserID:    pu.user.ID,
+		Session:   *session,
+		ExpiresAt: time.Now().Add(-time.Second),
+	}
+	_, err = service.finishRegistration(ceremony, pu, authenticator.create(options))
+	if !errors.Is(err, ErrLinkExpired) {
+		t.Errorf("finishRegistration() err = %v, want %v", err, ErrLinkExpired)
+	}
+
+	register(t, service, pu, authenticator)
+	loginOptions, loginCeremony := startLogin(t, service, time.Now().Add(-time.Second))
+	_, _, err = service.finishLogin(loginCeremony, lookupUser(pu), authenticator.get(loginOptions))
+	if !errors.Is(err, ErrLinkExpired) {
+		t.Errorf("finishLogin() err = %v, want %v", err, ErrLinkExpired)
+	}
+}
+
+func TestPasskeyWrongUser(t *testing.T) {
+	service := testPasskeyService(t)
+	pu := newTestPasskeyUser(t, 1)
+	other := newTestPasskeyUser(t, 2)
+	authenticator := newSoftAuthenticator(t)
+
+	t.Run("registration started by someone else", func(t *testing.T) {
+		options, session, err := service.beginRegistration(pu)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ceremony := &passkeyCeremony{
+			UserID:    pu.user.ID,
+			Session:   *session,
+			ExpiresAt: time.Now().Add(time.Minute),
+		}
+		_, err = service.finishRegistration(ceremony, other, authenticator.create(options))
+		if !errors.Is(err, ErrNotFound) {
+			t.Errorf("finishRegistration() err = %v, want %v", err, ErrNotFound)
+		}
+	})
+
+	t.Run("registration ceremony used to sign in", func(t *testing.T) {
+		register(t, service, pu, authenticator)
+		options, ceremony := startLogin(t, service, time.Now().Add(time.Minute))
+		ceremony.UserID = pu.user.ID
+		_, _, err := service.finishLogin(ceremony, lookupUser(pu), authenticator.get(options))
+		if !errors.Is(err, ErrNotFound) {
+			t.Errorf("finishLogin() err = %v, want %v", err, ErrNotFound)
+		}
+	})
+
+	t.Run("passkey of another user", func(t *testing.T) {
+		// The authenticator claims to belong to other, who never registered
+		// it.
+		authenticator.handle = other.handle
+		options, ceremony := startLogin(t, service, time.Now().Add(time.Minute))
+		_, _, err := service.finishLogin(ceremony, lookupUser(other), authenticator.get(options))
+		if !errors.Is(err, ErrInvalidPasskey) {
+			t.Errorf("finishLogin() err = %v, want %v", err, ErrInvalidPasskey)
+		}
+	})
+}
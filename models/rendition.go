@@ -0,0 +1,164 @@
+package models
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"path"
+
+	"golang.org/x/image/draw"
+)
+
+var (
+	// DefaultRenditionSizes are the sizes used when a GalleryService doesn't
+	// specify its own RenditionSizes.
+	DefaultRenditionSizes = []int{256, 1024, 2048}
+)
+
+// Rendition is a resized copy of an image. Size is the length, in pixels, of
+// the longest edge the rendition was scaled down to.
+type Rendition struct {
+	Size   int
+	Key    string
+	Width  int
+	Height int
+}
+
+// Rendition returns the smallest rendition of image that is at least size
+// pixels along its longest edge. If there is no such rendition, ok is false
+// and the original should be used instead.
+func (image Image) Rendition(size int) (rendition Rendition, ok bool) {
+	for _, r := range image.Renditions {
+		if r.Size >= size && (!ok || r.Size < rendition.Size) {
+			rendition, ok = r, true
+		}
+	}
+	return rendition, ok
+}
+
+func (service *GalleryService) renditionSizes() []int {
+	if len(service.RenditionSizes) == 0 {
+		return DefaultRenditionSizes
+	}
+	return service.RenditionSizes
+}
+
+// createRenditions scales src down to each of the rendition sizes that are
+// smaller than the image itself, stores them and records them for img.
+// Animated GIFs would lose their animation, so GIFs don't get renditions.
+func (service *GalleryService) createRenditions(tx *sql.Tx, img *Image, src image.Image) error {
+	if img.ContentType == "image/gif" {
+		return nil
+	}
+	bounds := src.Bounds()
+	longest := max(bounds.Dx(), bounds.Dy())
+	for _, size := range service.renditionSizes() {
+		if size >= longest {
+			continue
+		}
+		rendition := Rendition{
+			Size:   size,
+			Key:    fmt.Sprintf("%s/%d%s", path.Dir(img.Key), size, path.Ext(img.Key)),
+			Width:  bounds.Dx() * size / longest,
+			Height: bounds.Dy() * size / longest,
+		}
+		dst := image.NewRGBA(image.Rect(0, 0, max(rendition.Width, 1), max(rendition.Height, 1)))
+		draw.CatmullRom.Scale(dst, dst.Bounds(), src, bounds, draw.Src, nil)
+
+		var buf bytes.Buffer
+		var err error
+		if img.ContentType == "image/png" {
+			err = png.Encode(&buf, dst)
+		} else {
+			err = jpeg.Encode(&buf, dst, &jpeg.Options{Quality: 85})
+		}
+		if err != nil {
+			return fmt.Errorf("encoding %dpx rendition: %w", size, err)
+		}
+		err = service.storage().Put(rendition.Key, &buf)
+		if err != nil {
+			return fmt.Errorf("storing %dpx rendition: %w", size, err)
+		}
+		_, err = tx.Exec(`
+		insert into image_renditions (image_id, size, storage_key, width, height)
+		values ($1, $2, $3, $4, $5);`, img.ID, rendition.Size,
+			rendition.Key, rendition.Width, rendition.Height)
+		if err != nil {
+			return fmt.Errorf("recording %dpx rendition: %w", size, err)
+		}
+		img.Renditions = append(img.Renditions, rendition)
+	}
+	return nil
+}
+
+// shareRenditions records the renditions of the blob img shares with images
+// uploaded earlier, as these were created when the blob was stored.
+func (service *GalleryService) shareRenditions(tx *sql.Tx, img *Image) error {
+	rows, err := tx.Query(`
+	insert into image_renditions (image_id, size, storage_key, width, height)
+	select $1, size, storage_key, width, height
+	from image_renditions
+	where image_id = (
+		select id
+		from images
+		where blob_hash = $2 and id <> $1
+		order by id
+		limit 1
+	)
+	returning size, storage_key, width, height;`, img.ID, img.BlobHash)
+	if err != nil {
+		return fmt.Errorf("share renditions: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var rendition Rendition
+		err := rows.Scan(&rendition.Size, &rendition.Key, &rendition.Width, &rendition.Height)
+		if err != nil {
+			return fmt.Errorf("share renditions: %w", err)
+		}
+		img.Renditions = append(img.Renditions, rendition)
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("share renditions: %w", err)
+	}
+	return nil
+}
+
+// renditions loads the renditions of all the given images.
+func (service *GalleryService) renditions(images []Image) error {
+	if len(images) == 0 {
+		return nil
+	}
+	index := make(map[int]int, len(images))
+	ids := make([]int64, 0, len(images))
+	for i, image := range images {
+		index[image.ID] = i
+		ids = append(ids, int64(image.ID))
+	}
+	rows, err := service.DB.Query(`
+	select image_id, size, storage_key, width, height
+	from image_renditions
+	where image_id = any($1)
+	order by size;`, ids)
+	if err != nil {
+		return fmt.Errorf("query renditions: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var imageID int
+		var rendition Rendition
+		err := rows.Scan(&imageID, &rendition.Size, &rendition.Key, &rendition.Width, &rendition.Height)
+		if err != nil {
+			return fmt.Errorf("query renditions: %w", err)
+		}
+		i := index[imageID]
+		images[i].Renditions = append(images[i].Renditions, rendition)
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("query renditions: %w", err)
+	}
+	return nil
+}
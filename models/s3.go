@@ -0,0 +1,123 @@
+package models
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"mime"
+	"path"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+type S3Config struct {
+	// Endpoint is the host (and port) of the S3 compatible service, such as
+	// "s3.amazonaws.com" or "localhost:9000" for a local MinIO server.
+	Endpoint  string
+	Region    string
+	Bucket    string
+	AccessKey string
+	SecretKey string
+	UseSSL    bool
+}
+
+// S3Storage stores objects in a bucket of an S3 compatible service.
+type S3Storage struct {
+	Bucket string
+
+	// unexported fields
+	client *minio.Client
+}
+
+func NewS3Storage(config S3Config) (*S3Storage, error) {
+	client, err := minio.New(config.Endpoint, &minio.Options{
+		Creds:  credentials.NewStaticV4(config.AccessKey, config.SecretKey, ""),
+		Secure: config.UseSSL,
+		Region: config.Region,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("new s3 storage: %w", err)
+	}
+	ss := S3Storage{
+		Bucket: config.Bucket,
+		client: client,
+	}
+	return &ss, nil
+}
+
+func (ss *S3Storage) Put(key string, r io.Reader) error {
+	opts := minio.PutObjectOptions{
+		ContentType: mime.TypeByExtension(path.Ext(key)),
+	}
+	_, err := ss.client.PutObject(context.Background(), ss.Bucket, key, r, -1, opts)
+	if err != nil {
+		return fmt.Errorf("put %v: %w", key, err)
+	}
+	return nil
+}
+
+func (ss *S3Storage) Get(key string) (*StorageObject, error) {
+	obj, err := ss.client.GetObject(context.Background(), ss.Bucket, key, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("get %v: %w", key, err)
+	}
+	// GetObject doesn't reach out to the service until the object is read
+	// from, so stat it to find out whether it exists.
+	info, err := obj.Stat()
+	if err != nil {
+		obj.Close()
+		if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("get %v: %w", key, err)
+	}
+	return &StorageObject{
+		ReadCloser: obj,
+		Size:       info.Size,
+		ModTime:    info.LastModified,
+	}, nil
+}
+
+func (ss *S3Storage) Delete(key string) error {
+	err := ss.client.RemoveObject(context.Background(), ss.Bucket, key, minio.RemoveObjectOptions{})
+	if err != nil {
+		return fmt.Errorf("delete %v: %w", key, err)
+	}
+	return nil
+}
+
+func (ss *S3Storage) DeletePrefix(prefix string) error {
+	ctx := context.Background()
+	objects := ss.client.ListObjects(ctx, ss.Bucket, minio.ListObjectsOptions{
+		Prefix:    prefix,
+		Recursive: true,
+	})
+	// The error channel has to be drained completely, otherwise the goroutine
+	// removing the objects never finishes.
+	var err error
+	for removeErr := range ss.client.RemoveObjects(ctx, ss.Bucket, objects, minio.RemoveObjectsOptions{}) {
+		if err == nil {
+			err = removeErr.Err
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("delete prefix %v: %w", prefix, err)
+	}
+	return nil
+}
+
+func (ss *S3Storage) List(prefix string) ([]string, error) {
+	var keys []string
+	objects := ss.client.ListObjects(context.Background(), ss.Bucket, minio.ListObjectsOptions{
+		Prefix:    prefix,
+		Recursive: true,
+	})
+	for obj := range objects {
+		if obj.Err != nil {
+			return nil, fmt.Errorf("list %v: %w", prefix, obj.Err)
+		}
+		keys = append(keys, obj.Key)
+	}
+	return keys, nil
+}
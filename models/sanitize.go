@@ -0,0 +1,257 @@
+package models
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// StripMetadata copies the image read from r to w, leaving out the metadata
+// that could reveal where a photo was taken or which camera took it: EXIF
+// (including GPS and serial numbers), XMP, IPTC and comments. Pixel data,
+// color profiles and the EXIF orientation are kept. Formats without such
+// metadata, like GIF, are copied unchanged.
+func StripMetadata(w io.Writer, r io.Reader, contentType string) error {
+	switch contentType {
+	case "image/jpeg":
+		return stripJPEG(w, r)
+	case "image/png":
+		return stripPNG(w, r)
+	}
+	_, err := io.Copy(w, r)
+	if err != nil {
+		return fmt.Errorf("strip metadata: %w", err)
+	}
+	return nil
+}
+
+const (
+	jpegSOI  = 0xD8
+	jpegSOS  = 0xDA
+	jpegAPP1 = 0xE1
+	jpegIPTC = 0xED
+	jpegCOM  = 0xFE
+
+	exifOrientationTag = 0x0112
+)
+
+var exifHeader = []byte("Exif\x00\x00")
+
+func stripJPEG(w io.Writer, r io.Reader) error {
+	br := bufio.NewReader(r)
+	var soi [2]byte
+	_, err := io.ReadFull(br, soi[:])
+	if err != nil {
+		return fmt.Errorf("strip jpeg: %w", err)
+	}
+	if soi[0] != 0xFF || soi[1] != jpegSOI {
+		return fmt.Errorf("strip jpeg: missing start of image marker")
+	}
+	_, err = w.Write(soi[:])
+	if err != nil {
+		return fmt.Errorf("strip jpeg: %w", err)
+	}
+	for {
+		marker, err := readJPEGMarker(br)
+		if err != nil {
+			return fmt.Errorf("strip jpeg: %w", err)
+		}
+		if marker == jpegSOS {
+			// Everything after the start of scan is entropy coded image
+			// data, which can't contain metadata segments.
+			_, err = w.Write([]byte{0xFF, marker})
+			if err != nil {
+				return fmt.Errorf("strip jpeg: %w", err)
+			}
+			_, err = io.Copy(w, br)
+			if err != nil {
+				return fmt.Errorf("strip jpeg: %w", err)
+			}
+			return nil
+		}
+		var length [2]byte
+		_, err = io.ReadFull(br, length[:])
+		if err != nil {
+			return fmt.Errorf("strip jpeg: %w", err)
+		}
+		n := int(binary.BigEndian.Uint16(length[:]))
+		if n < 2 {
+			return fmt.Errorf("strip jpeg: invalid segment length")
+		}
+		segment := make([]byte, n-2)
+		_, err = io.ReadFull(br, segment)
+		if err != nil {
+			return fmt.Errorf("strip jpeg: %w", err)
+		}
+		switch marker {
+		case jpegAPP1:
+			// Both EXIF and XMP are stored in APP1 segments. The
+			// orientation is the only EXIF field worth keeping, as
+			// dropping it would display the image sideways.
+			if orientation, ok := exifOrientation(segment); ok && orientation != 1 {
+				err = writeJPEGSegment(w, jpegAPP1, orientationExif(orientation))
+			}
+		case jpegIPTC, jpegCOM:
+		default:
+			err = writeJPEGSegment(w, marker, segment)
+		}
+		if err != nil {
+			return fmt.Errorf("strip jpeg: %w", err)
+		}
+	}
+}
+
+func readJPEGMarker(br *bufio.Reader) (byte, error) {
+	b, err := br.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	if b != 0xFF {
+		return 0, fmt.Errorf("expected marker, got %#x", b)
+	}
+	// Markers may be preceded by any number of 0xFF fill bytes.
+	for b == 0xFF {
+		b, err = br.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+	}
+	return b, nil
+}
+
+func writeJPEGSegment(w io.Writer, marker byte, segment []byte) error {
+	header := []byte{0xFF, marker, 0, 0}
+	binary.BigEndian.PutUint16(header[2:], uint16(len(segment)+2))
+	_, err := w.Write(header)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(segment)
+	return err
+}
+
+// exifOrientation returns the orientation stored in an APP1 segment, if the
+// segment holds EXIF data with an orientation.
+func exifOrientation(segment []byte) (uint16, bool) {
+	offset, order, ok := exifOrientationOffset(segment)
+	if !ok {
+		return 0, false
+	}
+	return order.Uint16(segment[offset:]), true
+}
+
+// exifOrientationOffset finds where in an APP1 segment the orientation value
+// is stored, along with the byte order it is stored in.
+func exifOrientationOffset(segment []byte) (int, binary.ByteOrder, bool) {
+	if !bytes.HasPrefix(segment, exifHeader) {
+		return 0, nil, false
+	}
+	tiff := segment[len(exifHeader):]
+	if len(tiff) < 8 {
+		return 0, nil, false
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 0, nil, false
+	}
+	ifd := int(order.Uint32(tiff[4:8]))
+	if ifd+2 > len(tiff) || ifd < 8 {
+		return 0, nil, false
+	}
+	count := int(order.Uint16(tiff[ifd:]))
+	for i := 0; i < count; i++ {
+		entry := ifd + 2 + i*12
+		if entry+12 > len(tiff) {
+			return 0, nil, false
+		}
+		if order.Uint16(tiff[entry:]) == exifOrientationTag {
+			// The value of a single SHORT is stored inline, in the first
+			// two bytes of the value field.
+			return len(exifHeader) + entry + 8, order, true
+		}
+	}
+	return 0, nil, false
+}
+
+// orientationExif builds an APP1 segment with EXIF data holding nothing but
+// the given orientation.
+func orientationExif(orientation uint16) []byte {
+	var buf bytes.Buffer
+	buf.Write(exifHeader)
+	buf.WriteString("MM")
+	binary.Write(&buf, binary.BigEndian, uint16(42))
+	binary.Write(&buf, binary.BigEndian, uint32(8))
+	// IFD0 with one entry: the orientation as a single SHORT.
+	binary.Write(&buf, binary.BigEndian, uint16(1))
+	binary.Write(&buf, binary.BigEndian, uint16(exifOrientationTag))
+	binary.Write(&buf, binary.BigEndian, uint16(3))
+	binary.Write(&buf, binary.BigEndian, uint32(1))
+	binary.Write(&buf, binary.BigEndian, orientation)
+	binary.Write(&buf, binary.BigEndian, uint16(0))
+	// No further IFDs.
+	binary.Write(&buf, binary.BigEndian, uint32(0))
+	return buf.Bytes()
+}
+
+var pngSignature = []byte("\x89PNG\r\n\x1a\n")
+
+// pngMetadataChunks are the chunk types that are left out when stripping the
+// metadata of a PNG image.
+var pngMetadataChunks = map[string]bool{
+	"eXIf": true,
+	"tEXt": true,
+	"zTXt": true,
+	"iTXt": true,
+	"tIME": true,
+}
+
+func stripPNG(w io.Writer, r io.Reader) error {
+	signature := make([]byte, len(pngSignature))
+	_, err := io.ReadFull(r, signature)
+	if err != nil {
+		return fmt.Errorf("strip png: %w", err)
+	}
+	if !bytes.Equal(signature, pngSignature) {
+		return fmt.Errorf("strip png: invalid signature")
+	}
+	_, err = w.Write(signature)
+	if err != nil {
+		return fmt.Errorf("strip png: %w", err)
+	}
+	for {
+		var header [8]byte
+		_, err = io.ReadFull(r, header[:])
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return fmt.Errorf("strip png: %w", err)
+		}
+		length := int64(binary.BigEndian.Uint32(header[:4]))
+		chunkType := string(header[4:])
+		// The chunk data is followed by a 4 byte CRC.
+		rest := io.LimitReader(r, length+4)
+		if pngMetadataChunks[chunkType] {
+			_, err = io.Copy(io.Discard, rest)
+		} else {
+			_, err = w.Write(header[:])
+			if err == nil {
+				_, err = io.Copy(w, rest)
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("strip png: %w", err)
+		}
+		if chunkType == "IEND" {
+			return nil
+		}
+	}
+}
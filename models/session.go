@@ -4,7 +4,9 @@ import (
 	"crypto/sha256"
 	"database/sql"
 	"encoding/base64"
+	"errors"
 	"fmt"
+	"time"
 
 	"github.com/Pupsichekk/lenslocked/rand"
 )
@@ -12,6 +14,17 @@ import (
 const (
 	// The minimum number of bytes used for each session token.
 	MinBytesPerToken = 32
+	// lastSeenPrecision is how often the last seen time of a session is
+	// updated, so not every request has to write to the database.
+	lastSeenPrecision = time.Minute
+	// DefaultSessionIdleTimeout and DefaultSessionAbsoluteTimeout are used
+	// when SessionService doesn't specify its own timeouts.
+	DefaultSessionIdleTimeout     = 2 * time.Hour
+	DefaultSessionAbsoluteTimeout = 24 * time.Hour
+	// DefaultRememberIdleTimeout and DefaultRememberAbsoluteTimeout are the
+	// timeouts of sessions of users who asked to be remembered.
+	DefaultRememberIdleTimeout     = 30 * 24 * time.Hour
+	DefaultRememberAbsoluteTimeout = 90 * 24 * time.Hour
 )
 
 type Session struct {
@@ -22,6 +35,18 @@ type Session struct {
 	// and we cannot reverse it into a raw token
 	Token     string
 	TokenHash string
+	// UserAgent and IPAddress describe the client the session was created
+	// from.
+	UserAgent  string
+	IPAddress  string
+	CreatedAt  time.Time
+	LastSeenAt time.Time
+	// Remember is set for sessions that last longer than the browser
+	// session. They have longer timeouts.
+	Remember bool
+	// ExpiresAt is when the session ends, no matter how recently it was
+	// used.
+	ExpiresAt time.Time
 }
 
 type SessionService struct {
@@ -31,9 +56,23 @@ type SessionService struct {
 	// If specified bytes are less than MinBytesPerToken
 	// MinBytesPerToken will be set instead of BytesPerToken.
 	BytesPerToken int
+	// IdleTimeout signs users out of sessions they haven't used for that
+	// long, AbsoluteTimeout of sessions that were created that long ago.
+	// They default to DefaultSessionIdleTimeout and
+	// DefaultSessionAbsoluteTimeout.
+	IdleTimeout     time.Duration
+	AbsoluteTimeout time.Duration
+	// RememberIdleTimeout and RememberAbsoluteTimeout are used instead for
+	// sessions of users who asked to be remembered. They default to
+	// DefaultRememberIdleTimeout and DefaultRememberAbsoluteTimeout.
+	RememberIdleTimeout     time.Duration
+	RememberAbsoluteTimeout time.Duration
 }
 
-func (ss *SessionService) Create(userID int) (*Session, error) {
+// Create signs a user in on a new client. Users can be signed in on any
+// number of clients at once, each with a session of its own. Sessions of
+// users who asked to be remembered last longer.
+func (ss *SessionService) Create(userID int, userAgent, ipAddress string, remember bool) (*Session, error) {
 	bytesPerToken := ss.BytesPerToken
 	if bytesPerToken < MinBytesPerToken {
 		bytesPerToken = MinBytesPerToken
@@ -46,39 +85,187 @@ func (ss *SessionService) Create(userID int) (*Session, error) {
 		UserID:    userID,
 		Token:     token,
 		TokenHash: ss.Hash(token),
+		UserAgent: userAgent,
+		IPAddress: ipAddress,
+		Remember:  remember,
 	}
-
-	// PostgreSql concrete realization
-	// Trying to update session token, if fails
-	// ErrNoRows err is provided and if ErrNoRows
-	// is provided then we can create session token
+	_, absolute := ss.timeouts(remember)
+	session.ExpiresAt = time.Now().Add(absolute)
 	row := ss.DB.QueryRow(`
-		insert into sessions (user_id, token_hash)
-		values ($1, $2) on conflict (user_id) do
-		update
-		set token_hash = $2
-		returning id;`, session.UserID, session.TokenHash)
-	err = row.Scan(&session.ID)
+		insert into sessions (user_id, token_hash, user_agent, ip_address, remember, expires_at)
+		values ($1, $2, $3, $4, $5, $6)
+		returning id, created_at, last_seen_at;`, session.UserID, session.TokenHash,
+		session.UserAgent, session.IPAddress, session.Remember, session.ExpiresAt)
+	err = row.Scan(&session.ID, &session.CreatedAt, &session.LastSeenAt)
 	if err != nil {
 		return nil, fmt.Errorf("create: %w", err)
 	}
 	return &session, nil
 }
 
-// User method on SessionService requires a token and returns a user
-func (ss *SessionService) User(token string) (*User, error) {
+// User method on SessionService requires a token and returns a user along
+// with their session, which is marked as seen. Sessions that timed out are
+// deleted, ErrNotFound is returned for them as for any unknown token.
+func (ss *SessionService) User(token string) (*User, *Session, error) {
 	tokenHash := ss.Hash(token)
 	var user User
+	session := Session{
+		TokenHash: tokenHash,
+	}
 	row := ss.DB.QueryRow(`
-		select users.id, users.email, users.password_hash 
+		select users.id, users.email, users.password_hash, sessions.id, sessions.user_agent,
+			sessions.ip_address, sessions.created_at, sessions.last_seen_at,
+			sessions.remember, sessions.expires_at
 		from sessions
 		join users on users.id = sessions.user_id
 		where sessions.token_hash = $1;`, tokenHash)
-	err := row.Scan(&user.ID, &user.Email, &user.PasswordHash)
+	err := row.Scan(&user.ID, &user.Email, &user.PasswordHash, &session.ID, &session.UserAgent,
+		&session.IPAddress, &session.CreatedAt, &session.LastSeenAt,
+		&session.Remember, &session.ExpiresAt)
 	if err != nil {
-		return nil, fmt.Errorf("user: %w", err)
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil, fmt.Errorf("user: %w", ErrNotFound)
+		}
+		return nil, nil, fmt.Errorf("user: %w", err)
+	}
+	session.UserID = user.ID
+	if ss.expired(&session) {
+		err = ss.Delete(token)
+		if err != nil {
+			return nil, nil, fmt.Errorf("user: %w", err)
+		}
+		return nil, nil, fmt.Errorf("user: session expired: %w", ErrNotFound)
+	}
+	if time.Since(session.LastSeenAt) >= lastSeenPrecision {
+		row = ss.DB.QueryRow(`
+		update sessions
+		set last_seen_at = now()
+		where id = $1
+		returning last_seen_at;`, session.ID)
+		err = row.Scan(&session.LastSeenAt)
+		if err != nil {
+			return nil, nil, fmt.Errorf("user: %w", err)
+		}
+	}
+	return &user, &session, nil
+}
+
+// MaxAge returns how long the session lasts if it isn't used again.
+func (ss *SessionService) MaxAge(session *Session) time.Duration {
+	idle, _ := ss.timeouts(session.Remember)
+	return min(idle-time.Since(session.LastSeenAt), time.Until(session.ExpiresAt))
+}
+
+// DeleteExpired deletes all sessions that timed out, returning how many there
+// were. Expired sessions can't be used anyway, this only keeps them from
+// piling up.
+func (ss *SessionService) DeleteExpired() (int64, error) {
+	idle, _ := ss.timeouts(false)
+	rememberIdle, _ := ss.timeouts(true)
+	now := time.Now()
+	result, err := ss.DB.Exec(`
+	delete from sessions
+	where expires_at <= $1
+		or (not remember and last_seen_at <= $2)
+		or (remember and last_seen_at <= $3);`, now, now.Add(-idle), now.Add(-rememberIdle))
+	if err != nil {
+		return 0, fmt.Errorf("delete expired sessions: %w", err)
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("delete expired sessions: %w", err)
+	}
+	return n, nil
+}
+
+// expired reports whether a session timed out.
+func (ss *SessionService) expired(session *Session) bool {
+	return ss.MaxAge(session) <= 0
+}
+
+// timeouts returns the idle and absolute timeouts of sessions.
+func (ss *SessionService) timeouts(remember bool) (idle, absolute time.Duration) {
+	if remember {
+		idle, absolute = ss.RememberIdleTimeout, ss.RememberAbsoluteTimeout
+		if idle <= 0 {
+			idle = DefaultRememberIdleTimeout
+		}
+		if absolute <= 0 {
+			absolute = DefaultRememberAbsoluteTimeout
+		}
+		return idle, absolute
+	}
+	idle, absolute = ss.IdleTimeout, ss.AbsoluteTimeout
+	if idle <= 0 {
+		idle = DefaultSessionIdleTimeout
+	}
+	if absolute <= 0 {
+		absolute = DefaultSessionAbsoluteTimeout
 	}
-	return &user, nil
+	return idle, absolute
+}
+
+// ByUserID returns the sessions of a user that didn't time out, most recently
+// seen first.
+func (ss *SessionService) ByUserID(userID int) ([]Session, error) {
+	rows, err := ss.DB.Query(`
+	select id, token_hash, user_agent, ip_address, created_at, last_seen_at,
+		remember, expires_at
+	from sessions
+	where user_id = $1
+	order by last_seen_at desc, id desc;`, userID)
+	if err != nil {
+		return nil, fmt.Errorf("query sessions by user: %w", err)
+	}
+	defer rows.Close()
+	var sessions []Session
+	for rows.Next() {
+		session := Session{
+			UserID: userID,
+		}
+		err = rows.Scan(&session.ID, &session.TokenHash, &session.UserAgent,
+			&session.IPAddress, &session.CreatedAt, &session.LastSeenAt,
+			&session.Remember, &session.ExpiresAt)
+		if err != nil {
+			return nil, fmt.Errorf("query sessions by user: %w", err)
+		}
+		// Expired sessions wait for DeleteExpired, but can't be used.
+		if ss.expired(&session) {
+			continue
+		}
+		sessions = append(sessions, session)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("query sessions by user: %w", err)
+	}
+	return sessions, nil
+}
+
+// Revoke signs a user out of the session with the given ID. ErrNotFound is
+// returned if the user has no such session.
+func (ss *SessionService) Revoke(userID, id int) error {
+	result, err := ss.DB.Exec(`
+	delete from sessions
+	where id = $1 and user_id = $2;`, id, userID)
+	if err != nil {
+		return fmt.Errorf("revoke session: %w", err)
+	}
+	if n, err := result.RowsAffected(); err != nil || n == 0 {
+		return fmt.Errorf("revoke session: %w", ErrNotFound)
+	}
+	return nil
+}
+
+// RevokeOthers signs a user out of all their sessions except for the one
+// with the given token.
+func (ss *SessionService) RevokeOthers(userID int, token string) error {
+	_, err := ss.DB.Exec(`
+	delete from sessions
+	where user_id = $1 and token_hash <> $2;`, userID, ss.Hash(token))
+	if err != nil {
+		return fmt.Errorf("revoke other sessions: %w", err)
+	}
+	return nil
 }
 
 func (ss *SessionService) Delete(token string) error {
@@ -0,0 +1,287 @@
+package models
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/Pupsichekk/lenslocked/rand"
+)
+
+// DefaultShareViewDuration is how long a view of a share link lasts when
+// ShareService doesn't specify its own ViewDuration.
+const DefaultShareViewDuration = time.Hour
+
+// ShareLink gives anyone who has its token access to a gallery, no matter
+// its visibility, until it expires, runs out of views or is revoked.
+type ShareLink struct {
+	ID        int
+	GalleryID int
+	// Token is only set when creating a new share link, only its hash is
+	// stored.
+	Token     string
+	TokenHash string
+	// AllowDownload lets the link be used to download the gallery as an
+	// archive, not only to view it.
+	AllowDownload bool
+	// ExpiresAt is nil for links that don't expire.
+	ExpiresAt *time.Time
+	// MaxViews is the number of times the link can be opened, zero means
+	// there is no limit.
+	MaxViews  int
+	Views     int
+	CreatedAt time.Time
+}
+
+// ShareView is one visit of a gallery through a share link. Opening the link
+// starts a view, whose token grants access to the gallery from then on, so
+// every view the link allows only lasts so long.
+type ShareView struct {
+	ID          int
+	ShareLinkID int
+	// Token is only set when the view starts, only its hash is stored.
+	Token     string
+	TokenHash string
+	// ExpiresAt is when the view ends, at the latest when its link expires.
+	ExpiresAt time.Time
+}
+
+// Active reports whether the link can still be opened.
+func (link ShareLink) Active() bool {
+	if link.ExpiresAt != nil && !time.Now().Before(*link.ExpiresAt) {
+		return false
+	}
+	return link.MaxViews == 0 || link.Views < link.MaxViews
+}
+
+type ShareService struct {
+	DB *sql.DB
+	// BytesPerToken is used to determine how many bytes are used to generate
+	// share link tokens. If specified bytes are less than MinBytesPerToken
+	// MinBytesPerToken will be used instead.
+	BytesPerToken int
+	// ViewDuration is how long a view lasts after a share link was opened.
+	// Defaults to DefaultShareViewDuration.
+	ViewDuration time.Duration
+}
+
+func (ss *ShareService) Create(link *ShareLink) error {
+	if link.MaxViews < 0 {
+		return fmt.Errorf("create share link: invalid view limit")
+	}
+	token, err := ss.newToken()
+	if err != nil {
+		return fmt.Errorf("create share link: %w", err)
+	}
+	link.Token = token
+	link.TokenHash = ss.hash(token)
+	row := ss.DB.QueryRow(`
+	insert into share_links (gallery_id, token_hash, allow_download, expires_at, max_views)
+	values ($1, $2, $3, $4, $5)
+	returning id, created_at;`, link.GalleryID, link.TokenHash, link.AllowDownload,
+		link.ExpiresAt, link.MaxViews)
+	err = row.Scan(&link.ID, &link.CreatedAt)
+	if err != nil {
+		return fmt.Errorf("create share link: %w", err)
+	}
+	return nil
+}
+
+// ByGalleryID returns the share links of a gallery, including the ones that
+// expired, newest first.
+func (ss *ShareService) ByGalleryID(galleryID int) ([]ShareLink, error) {
+	rows, err := ss.DB.Query(`
+	select id, token_hash, allow_download, expires_at, max_views, views, created_at
+	from share_links
+	where gallery_id = $1
+	order by created_at desc, id desc;`, galleryID)
+	if err != nil {
+		return nil, fmt.Errorf("query share links: %w", err)
+	}
+	defer rows.Close()
+	var links []ShareLink
+	for rows.Next() {
+		link := ShareLink{
+			GalleryID: galleryID,
+		}
+		var expiresAt sql.NullTime
+		err := rows.Scan(&link.ID, &link.TokenHash, &link.AllowDownload, &expiresAt,
+			&link.MaxViews, &link.Views, &link.CreatedAt)
+		if err != nil {
+			return nil, fmt.Errorf("query share links: %w", err)
+		}
+		if expiresAt.Valid {
+			link.ExpiresAt = &expiresAt.Time
+		}
+		links = append(links, link)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("query share links: %w", err)
+	}
+	return links, nil
+}
+
+// Open counts a view of the share link with the given token and starts it.
+// ErrLinkExpired is returned if the link expired or ran out of views,
+// ErrNotFound if there is no such link.
+func (ss *ShareService) Open(token string) (*ShareLink, *ShareView, error) {
+	link, err := ss.byToken(token)
+	if err != nil {
+		return nil, nil, fmt.Errorf("open share link: %w", err)
+	}
+	if !link.Active() {
+		return nil, nil, fmt.Errorf("open share link: %w", ErrLinkExpired)
+	}
+	viewToken, err := ss.newToken()
+	if err != nil {
+		return nil, nil, fmt.Errorf("open share link: %w", err)
+	}
+	view := ShareView{
+		ShareLinkID: link.ID,
+		Token:       viewToken,
+		TokenHash:   ss.hash(viewToken),
+		ExpiresAt:   time.Now().Add(ss.viewDuration()),
+	}
+	if link.ExpiresAt != nil && link.ExpiresAt.Before(view.ExpiresAt) {
+		view.ExpiresAt = *link.ExpiresAt
+	}
+	tx, err := ss.DB.Begin()
+	if err != nil {
+		return nil, nil, fmt.Errorf("open share link: %w", err)
+	}
+	defer tx.Rollback()
+	// The view limit is checked again, in case the last view was used up
+	// in the meantime.
+	row := tx.QueryRow(`
+	update share_links
+	set views = views + 1
+	where id = $1 and (max_views = 0 or views < max_views)
+	returning views;`, link.ID)
+	err = row.Scan(&link.Views)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil, fmt.Errorf("open share link: %w", ErrLinkExpired)
+		}
+		return nil, nil, fmt.Errorf("open share link: %w", err)
+	}
+	row = tx.QueryRow(`
+	insert into share_views (share_link_id, token_hash, expires_at)
+	values ($1, $2, $3)
+	returning id;`, view.ShareLinkID, view.TokenHash, view.ExpiresAt)
+	err = row.Scan(&view.ID)
+	if err != nil {
+		return nil, nil, fmt.Errorf("open share link: %w", err)
+	}
+	err = tx.Commit()
+	if err != nil {
+		return nil, nil, fmt.Errorf("open share link: %w", err)
+	}
+	return link, &view, nil
+}
+
+// Check returns the share link a view with the given token was started for
+// if the view still grants access to the gallery. Views end when they
+// expire, and when their link is revoked.
+func (ss *ShareService) Check(viewToken string, galleryID int) (*ShareLink, error) {
+	var link ShareLink
+	var expiresAt sql.NullTime
+	var viewExpiresAt time.Time
+	row := ss.DB.QueryRow(`
+	select share_links.id, share_links.gallery_id, share_links.allow_download,
+		share_links.expires_at, share_links.max_views, share_links.views,
+		share_links.created_at, share_views.expires_at
+	from share_views
+	join share_links on share_links.id = share_views.share_link_id
+	where share_views.token_hash = $1;`, ss.hash(viewToken))
+	err := row.Scan(&link.ID, &link.GalleryID, &link.AllowDownload, &expiresAt,
+		&link.MaxViews, &link.Views, &link.CreatedAt, &viewExpiresAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("check share link: %w", ErrNotFound)
+		}
+		return nil, fmt.Errorf("check share link: %w", err)
+	}
+	if expiresAt.Valid {
+		link.ExpiresAt = &expiresAt.Time
+	}
+	if link.GalleryID != galleryID {
+		return nil, fmt.Errorf("check share link: %w", ErrNotFound)
+	}
+	if !time.Now().Before(viewExpiresAt) {
+		return nil, fmt.Errorf("check share link: %w", ErrLinkExpired)
+	}
+	return &link, nil
+}
+
+// DeleteExpired deletes all views of share links that expired, returning how
+// many there were.
+func (ss *ShareService) DeleteExpired() (int64, error) {
+	result, err := ss.DB.Exec(`
+	delete from share_views
+	where expires_at <= now();`)
+	if err != nil {
+		return 0, fmt.Errorf("delete expired share views: %w", err)
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("delete expired share views: %w", err)
+	}
+	return n, nil
+}
+
+// Revoke deletes a share link of a gallery, so it stops working.
+func (ss *ShareService) Revoke(galleryID, id int) error {
+	_, err := ss.DB.Exec(`
+	delete from share_links
+	where id = $1 and gallery_id = $2;`, id, galleryID)
+	if err != nil {
+		return fmt.Errorf("revoke share link: %w", err)
+	}
+	return nil
+}
+
+func (ss *ShareService) byToken(token string) (*ShareLink, error) {
+	link := ShareLink{
+		TokenHash: ss.hash(token),
+	}
+	var expiresAt sql.NullTime
+	row := ss.DB.QueryRow(`
+	select id, gallery_id, allow_download, expires_at, max_views, views, created_at
+	from share_links
+	where token_hash = $1;`, link.TokenHash)
+	err := row.Scan(&link.ID, &link.GalleryID, &link.AllowDownload, &expiresAt,
+		&link.MaxViews, &link.Views, &link.CreatedAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+	if expiresAt.Valid {
+		link.ExpiresAt = &expiresAt.Time
+	}
+	return &link, nil
+}
+
+func (ss *ShareService) newToken() (string, error) {
+	bytesPerToken := ss.BytesPerToken
+	if bytesPerToken < MinBytesPerToken {
+		bytesPerToken = MinBytesPerToken
+	}
+	return rand.String(bytesPerToken)
+}
+
+func (ss *ShareService) viewDuration() time.Duration {
+	if ss.ViewDuration <= 0 {
+		return DefaultShareViewDuration
+	}
+	return ss.ViewDuration
+}
+
+func (ss *ShareService) hash(token string) string {
+	tokenHash := sha256.Sum256([]byte(token))
+	return base64.URLEncoding.EncodeToString(tokenHash[:])
+}
@@ -0,0 +1,193 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Storage is used to store and retrieve image files. Keys are slash separated
+// paths such as "gallery-1/photo.jpg", no matter which backend is used.
+type Storage interface {
+	// Put stores everything read from r under key, replacing any object that
+	// was previously stored there.
+	Put(key string, r io.Reader) error
+	// Get returns the object stored under key. Callers need to close the
+	// returned object. ErrNotFound is returned if the object doesn't exist.
+	Get(key string) (*StorageObject, error)
+	// Delete removes the object stored under key. Deleting an object that
+	// doesn't exist is not an error.
+	Delete(key string) error
+	// DeletePrefix removes every object with a key starting with prefix.
+	DeletePrefix(prefix string) error
+	// List returns the keys of every object with a key starting with prefix.
+	List(prefix string) ([]string, error)
+}
+
+type StorageObject struct {
+	io.ReadCloser
+	Size    int64
+	ModTime time.Time
+}
+
+// LocalStorage stores objects as files on the local disk.
+type LocalStorage struct {
+	// Dir is the root directory of the storage, if not set, value is
+	// defaulted to images directory
+	Dir string
+}
+
+func (ls *LocalStorage) Put(key string, r io.Reader) error {
+	filePath, err := ls.path(key)
+	if err != nil {
+		return fmt.Errorf("put %v: %w", key, err)
+	}
+	err = os.MkdirAll(filepath.Dir(filePath), 0755)
+	if err != nil {
+		return fmt.Errorf("put %v: %w", key, err)
+	}
+	// Write to a temporary file first so readers never see a partially
+	// written object.
+	tmp, err := os.CreateTemp(filepath.Dir(filePath), ".upload-*")
+	if err != nil {
+		return fmt.Errorf("put %v: %w", key, err)
+	}
+	defer os.Remove(tmp.Name())
+	_, err = io.Copy(tmp, r)
+	if err != nil {
+		tmp.Close()
+		return fmt.Errorf("put %v: %w", key, err)
+	}
+	err = tmp.Close()
+	if err != nil {
+		return fmt.Errorf("put %v: %w", key, err)
+	}
+	err = os.Rename(tmp.Name(), filePath)
+	if err != nil {
+		return fmt.Errorf("put %v: %w", key, err)
+	}
+	return nil
+}
+
+func (ls *LocalStorage) Get(key string) (*StorageObject, error) {
+	filePath, err := ls.path(key)
+	if err != nil {
+		return nil, fmt.Errorf("get %v: %w", key, err)
+	}
+	f, err := os.Open(filePath)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("get %v: %w", key, err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("get %v: %w", key, err)
+	}
+	if info.IsDir() {
+		f.Close()
+		return nil, ErrNotFound
+	}
+	return &StorageObject{
+		ReadCloser: f,
+		Size:       info.Size(),
+		ModTime:    info.ModTime(),
+	}, nil
+}
+
+func (ls *LocalStorage) Delete(key string) error {
+	filePath, err := ls.path(key)
+	if err != nil {
+		return fmt.Errorf("delete %v: %w", key, err)
+	}
+	err = os.Remove(filePath)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("delete %v: %w", key, err)
+	}
+	return nil
+}
+
+func (ls *LocalStorage) DeletePrefix(prefix string) error {
+	keys, err := ls.List(prefix)
+	if err != nil {
+		return fmt.Errorf("delete prefix %v: %w", prefix, err)
+	}
+	for _, key := range keys {
+		err = ls.Delete(key)
+		if err != nil {
+			return fmt.Errorf("delete prefix %v: %w", prefix, err)
+		}
+	}
+	// Directory style prefixes also get their now empty directories removed.
+	if strings.HasSuffix(prefix, "/") {
+		dirPath, err := ls.path(prefix)
+		if err != nil {
+			return fmt.Errorf("delete prefix %v: %w", prefix, err)
+		}
+		err = os.RemoveAll(dirPath)
+		if err != nil {
+			return fmt.Errorf("delete prefix %v: %w", prefix, err)
+		}
+	}
+	return nil
+}
+
+func (ls *LocalStorage) List(prefix string) ([]string, error) {
+	root := ls.dir()
+	// Only walk the deepest directory that can contain matching keys.
+	walkDir, err := ls.path(path.Dir(prefix + "x"))
+	if err != nil {
+		return nil, fmt.Errorf("list %v: %w", prefix, err)
+	}
+	var keys []string
+	err = filepath.WalkDir(walkDir, func(filePath string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if d.IsDir() || strings.HasPrefix(d.Name(), ".upload-") {
+			return nil
+		}
+		rel, err := filepath.Rel(root, filePath)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("list %v: %w", prefix, err)
+	}
+	return keys, nil
+}
+
+func (ls *LocalStorage) dir() string {
+	if ls.Dir == "" {
+		return "images"
+	}
+	return ls.Dir
+}
+
+// path converts a storage key into a file path, making sure the key can't be
+// used to reach files outside of the storage directory.
+func (ls *LocalStorage) path(key string) (string, error) {
+	for _, part := range strings.Split(key, "/") {
+		if part == ".." {
+			return "", fmt.Errorf("invalid storage key: %v", key)
+		}
+	}
+	return filepath.Join(ls.dir(), filepath.FromSlash(key)), nil
+}
@@ -0,0 +1,216 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/Pupsichekk/lenslocked/rand"
+	"github.com/minio/minio-go/v7"
+)
+
+func TestLocalStorage(t *testing.T) {
+	dir := t.TempDir()
+	testStorage(t, &LocalStorage{Dir: dir}, "")
+
+	t.Run("directories of deleted prefixes are removed", func(t *testing.T) {
+		ls := &LocalStorage{Dir: dir}
+		putObject(t, ls, "gallery-9/a.jpg", "a")
+		err := ls.DeletePrefix("gallery-9/")
+		if err != nil {
+			t.Fatalf("DeletePrefix() err = %v, want nil", err)
+		}
+		_, err = os.Stat(filepath.Join(dir, "gallery-9"))
+		if !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("Stat() err = %v, want %v", err, os.ErrNotExist)
+		}
+	})
+
+	t.Run("keys can't leave the directory", func(t *testing.T) {
+		ls := &LocalStorage{Dir: filepath.Join(dir, "inner")}
+		err := ls.Put("../outside.jpg", strings.NewReader("x"))
+		if err == nil {
+			t.Errorf("Put() err = nil, want an error")
+		}
+		_, err = ls.Get("gallery-1/../../outside.jpg")
+		if err == nil {
+			t.Errorf("Get() err = nil, want an error")
+		}
+	})
+}
+
+// TestS3Storage runs against the S3 compatible service S3_ENDPOINT points
+// to, e.g. a local MinIO server started with
+//
+//	docker run -p 9000:9000 minio/minio server /data
+//
+// and S3_ENDPOINT=localhost:9000 S3_ACCESS_KEY=minioadmin
+// S3_SECRET_KEY=minioadmin S3_BUCKET=lenslocked-test. The bucket is created if
+// it doesn't exist yet.
+func TestS3Storage(t *testing.T) {
+	endpoint := os.Getenv("S3_ENDPOINT")
+	if endpoint == "" {
+		t.Skip("S3_ENDPOINT is not set")
+	}
+	ss, err := NewS3Storage(S3Config{
+		Endpoint:  endpoint,
+		Region:    os.Getenv("S3_REGION"),
+		Bucket:    os.Getenv("S3_BUCKET"),
+		AccessKey: os.Getenv("S3_ACCESS_KEY"),
+		SecretKey: os.Getenv("S3_SECRET_KEY"),
+		UseSSL:    os.Getenv("S3_USE_SSL") == "true",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	exists, err := ss.client.BucketExists(ctx, ss.Bucket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !exists {
+		err = ss.client.MakeBucket(ctx, ss.Bucket, minio.MakeBucketOptions{Region: os.Getenv("S3_REGION")})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Every run gets its own prefix, so runs don't see each others objects.
+	run, err := rand.String(8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	prefix := "test-" + strings.Trim(run, "=") + "/"
+	t.Cleanup(func() {
+		ss.DeletePrefix(prefix)
+	})
+	testStorage(t, ss, prefix)
+}
+
+// testStorage checks the behavior every Storage needs to have, storing its
+// objects under prefix.
+func testStorage(t *testing.T, s Storage, prefix string) {
+	t.Run("put and get", func(t *testing.T) {
+		putObject(t, s, prefix+"gallery-1/photo.jpg", "photo")
+		if got := getObject(t, s, prefix+"gallery-1/photo.jpg"); got != "photo" {
+			t.Errorf("Get() = %q, want %q", got, "photo")
+		}
+		obj, err := s.Get(prefix + "gallery-1/photo.jpg")
+		if err != nil {
+			t.Fatalf("Get() err = %v, want nil", err)
+		}
+		obj.Close()
+		if obj.Size != int64(len("photo")) {
+			t.Errorf("Get() size = %d, want %d", obj.Size, len("photo"))
+		}
+		if obj.ModTime.IsZero() {
+			t.Errorf("Get() mod time is zero")
+		}
+	})
+
+	t.Run("put replaces", func(t *testing.T) {
+		putObject(t, s, prefix+"gallery-1/replaced.jpg", "old")
+		putObject(t, s, prefix+"gallery-1/replaced.jpg", "new")
+		if got := getObject(t, s, prefix+"gallery-1/replaced.jpg"); got != "new" {
+			t.Errorf("Get() = %q, want %q", got, "new")
+		}
+	})
+
+	t.Run("get missing", func(t *testing.T) {
+		_, err := s.Get(prefix + "gallery-1/missing.jpg")
+		if !errors.Is(err, ErrNotFound) {
+			t.Errorf("Get() err = %v, want %v", err, ErrNotFound)
+		}
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		putObject(t, s, prefix+"gallery-2/deleted.jpg", "x")
+		err := s.Delete(prefix + "gallery-2/deleted.jpg")
+		if err != nil {
+			t.Fatalf("Delete() err = %v, want nil", err)
+		}
+		_, err = s.Get(prefix + "gallery-2/deleted.jpg")
+		if !errors.Is(err, ErrNotFound) {
+			t.Errorf("Get() err = %v, want %v", err, ErrNotFound)
+		}
+		err = s.Delete(prefix + "gallery-2/deleted.jpg")
+		if err != nil {
+			t.Errorf("Delete() of a missing object err = %v, want nil", err)
+		}
+	})
+
+	t.Run("list", func(t *testing.T) {
+		putObject(t, s, prefix+"gallery-3/a.jpg", "a")
+		putObject(t, s, prefix+"gallery-3/thumbs/a.jpg", "a")
+		putObject(t, s, prefix+"gallery-30/b.jpg", "b")
+		tests := map[string][]string{
+			"gallery-3/":  {"gallery-3/a.jpg", "gallery-3/thumbs/a.jpg"},
+			"gallery-3":   {"gallery-3/a.jpg", "gallery-3/thumbs/a.jpg", "gallery-30/b.jpg"},
+			"gallery-3/a": {"gallery-3/a.jpg"},
+			"gallery-4/":  nil,
+		}
+		for listPrefix, want := range tests {
+			got := listKeys(t, s, prefix+listPrefix)
+			for i := range want {
+				want[i] = prefix + want[i]
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("List(%q) = %v, want %v", listPrefix, got, want)
+			}
+		}
+	})
+
+	t.Run("delete prefix", func(t *testing.T) {
+		putObject(t, s, prefix+"gallery-5/a.jpg", "a")
+		putObject(t, s, prefix+"gallery-5/thumbs/a.jpg", "a")
+		putObject(t, s, prefix+"gallery-50/b.jpg", "b")
+		err := s.DeletePrefix(prefix + "gallery-5/")
+		if err != nil {
+			t.Fatalf("DeletePrefix() err = %v, want nil", err)
+		}
+		if got := listKeys(t, s, prefix+"gallery-5/"); got != nil {
+			t.Errorf("List() after DeletePrefix() = %v, want none", got)
+		}
+		want := []string{prefix + "gallery-50/b.jpg"}
+		if got := listKeys(t, s, prefix+"gallery-50/"); !reflect.DeepEqual(got, want) {
+			t.Errorf("List() of other prefix = %v, want %v", got, want)
+		}
+	})
+}
+
+func putObject(t *testing.T, s Storage, key, content string) {
+	t.Helper()
+	err := s.Put(key, strings.NewReader(content))
+	if err != nil {
+		t.Fatalf("Put(%q) err = %v, want nil", key, err)
+	}
+}
+
+func getObject(t *testing.T, s Storage, key string) string {
+	t.Helper()
+	obj, err := s.Get(key)
+	if err != nil {
+		t.Fatalf("Get(%q) err = %v, want nil", key, err)
+	}
+	defer obj.Close()
+	b, err := io.ReadAll(obj)
+	if err != nil {
+		t.Fatalf("Get(%q) read err = %v, want nil", key, err)
+	}
+	return string(b)
+}
+
+func listKeys(t *testing.T, s Storage, prefix string) []string {
+	t.Helper()
+	keys, err := s.List(prefix)
+	if err != nil {
+		t.Fatalf("List(%q) err = %v, want nil", prefix, err)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,76 @@
+package models
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// The SHA1 test vectors of RFC 6238, appendix B. The RFC lists 8 digit
+// codes, the last 6 digits are the codes with 6.
+func TestTOTPCode(t *testing.T) {
+	key := []byte("12345678901234567890")
+	tests := []struct {
+		unix int64
+		want string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+	for _, tt := range tests {
+		got := totpCode(key, totpStep(time.Unix(tt.unix, 0)))
+		if got != tt.want {
+			t.Errorf("totpCode(%d) = %q, want %q", tt.unix, got, tt.want)
+		}
+	}
+}
+
+func TestMatchTOTP(t *testing.T) {
+	secret := totpEncoding.EncodeToString([]byte("12345678901234567890"))
+	now := time.Unix(1234567890, 0)
+	tests := []struct {
+		name string
+		code string
+		want bool
+	}{
+		{"current", "005924", true},
+		{"with spaces", "005 924", true},
+		{"previous period", totpCode([]byte("12345678901234567890"), totpStep(now)-1), true},
+		{"next period", totpCode([]byte("12345678901234567890"), totpStep(now)+1), true},
+		{"too old", totpCode([]byte("12345678901234567890"), totpStep(now)-2), false},
+		{"wrong", "123456", false},
+		{"too short", "5924", false},
+	}
+	for _, tt := range tests {
+		_, got := matchTOTP(secret, tt.code, now)
+		if got != tt.want {
+			t.Errorf("matchTOTP(%s) = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestRecoveryCode(t *testing.T) {
+	code, err := newRecoveryCode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(code) != recoveryCodeLength+1 || code[recoveryCodeLength/2] != '-' {
+		t.Fatalf("newRecoveryCode() = %q, want %d characters with a dash in the middle", code, recoveryCodeLength)
+	}
+	codeHash, err := hashRecoveryCode(code)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entered := range []string{code, strings.ToUpper(code), strings.Replace(code, "-", " ", 1)} {
+		err = bcrypt.CompareHashAndPassword([]byte(codeHash), []byte(normalizeRecoveryCode(entered)))
+		if err != nil {
+			t.Errorf("recovery code %q entered as %q doesn't match: %v", code, entered, err)
+		}
+	}
+}
@@ -0,0 +1,254 @@
+package models
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/Pupsichekk/lenslocked/rand"
+)
+
+const (
+	// DefaultTransferDuration is how long a gallery transfer can be accepted
+	// when TransferService doesn't specify its own.
+	DefaultTransferDuration = 7 * 24 * time.Hour
+)
+
+var (
+	ErrTransferToSelf = errors.New("models: galleries can't be transferred to their owner")
+)
+
+// Transfer moves a gallery, along with its images and collaborators, to
+// another user once they accept it.
+type Transfer struct {
+	ID           int
+	GalleryID    int
+	GalleryTitle string
+	FromUserID   int
+	FromEmail    string
+	ToUserID     int
+	ToEmail      string
+	// Token is only set when starting a new transfer, only its hash is
+	// stored.
+	Token     string
+	TokenHash string
+	ExpiresAt time.Time
+}
+
+type TransferService struct {
+	DB *sql.DB
+	// BytesPerToken is used to determine how many bytes are used to generate
+	// transfer tokens. If specified bytes are less than MinBytesPerToken
+	// MinBytesPerToken will be used instead.
+	BytesPerToken int
+	// Duration is how long transfers can be accepted. Defaults to
+	// DefaultTransferDuration.
+	Duration time.Duration
+}
+
+// Start starts transferring gallery to the user with the given email,
+// replacing any transfer of the gallery that wasn't accepted yet.
+// ErrNotFound is returned if there is no user with that email. Only personal
+// galleries can be transferred, organization galleries already belong to
+// all of its members.
+func (service *TransferService) Start(gallery *Gallery, email string) (*Transfer, error) {
+	if gallery.OrganizationID != 0 {
+		return nil, fmt.Errorf("start transfer: gallery belongs to an organization")
+	}
+	if gallery.IsAlbum() {
+		return nil, fmt.Errorf("start transfer: albums move with their root gallery")
+	}
+	transfer := Transfer{
+		GalleryID:    gallery.ID,
+		GalleryTitle: gallery.Title,
+		FromUserID:   gallery.UserID,
+	}
+	row := service.DB.QueryRow(`
+	select id, email
+	from users
+	where email = $1;`, strings.ToLower(strings.TrimSpace(email)))
+	err := row.Scan(&transfer.ToUserID, &transfer.ToEmail)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("start transfer: %w", ErrNotFound)
+		}
+		return nil, fmt.Errorf("start transfer: %w", err)
+	}
+	if transfer.ToUserID == transfer.FromUserID {
+		return nil, fmt.Errorf("start transfer: %w", ErrTransferToSelf)
+	}
+	bytesPerToken := service.BytesPerToken
+	if bytesPerToken < MinBytesPerToken {
+		bytesPerToken = MinBytesPerToken
+	}
+	transfer.Token, err = rand.String(bytesPerToken)
+	if err != nil {
+		return nil, fmt.Errorf("start transfer: %w", err)
+	}
+	transfer.TokenHash = service.hash(transfer.Token)
+	duration := service.Duration
+	if duration <= 0 {
+		duration = DefaultTransferDuration
+	}
+	transfer.ExpiresAt = time.Now().Add(duration)
+	row = service.DB.QueryRow(`
+	insert into gallery_transfers (gallery_id, from_user_id, to_user_id, token_hash, expires_at)
+	values ($1, $2, $3, $4, $5) on conflict (gallery_id) do
+	update
+	set from_user_id = $2, to_user_id = $3, token_hash = $4, expires_at = $5, created_at = now()
+	returning id, (select email from users where id = $2);`, transfer.GalleryID,
+		transfer.FromUserID, transfer.ToUserID, transfer.TokenHash, transfer.ExpiresAt)
+	err = row.Scan(&transfer.ID, &transfer.FromEmail)
+	if err != nil {
+		return nil, fmt.Errorf("start transfer: %w", err)
+	}
+	return &transfer, nil
+}
+
+// ByGalleryID returns the transfer of a gallery that can still be accepted.
+// ErrNotFound is returned if there is none.
+func (service *TransferService) ByGalleryID(galleryID int) (*Transfer, error) {
+	transfer, err := service.query(`gallery_transfers.gallery_id = $1`, galleryID)
+	if err != nil {
+		return nil, fmt.Errorf("transfer by gallery: %w", err)
+	}
+	if !time.Now().Before(transfer.ExpiresAt) {
+		return nil, fmt.Errorf("transfer by gallery: %w", ErrNotFound)
+	}
+	return transfer, nil
+}
+
+// Transfer looks up the transfer with the given token. ErrLinkExpired is
+// returned if it can't be accepted anymore, ErrNotFound if there is no such
+// transfer.
+func (service *TransferService) Transfer(token string) (*Transfer, error) {
+	transfer, err := service.query(`gallery_transfers.token_hash = $1`, service.hash(token))
+	if err != nil {
+		return nil, fmt.Errorf("query transfer: %w", err)
+	}
+	if !time.Now().Before(transfer.ExpiresAt) {
+		return nil, fmt.Errorf("query transfer: %w", ErrLinkExpired)
+	}
+	transfer.Token = token
+	return transfer, nil
+}
+
+// Accept makes user the owner of the gallery the transfer with the given
+// token is for. Transfers can only be accepted by the user they were started
+// for, ErrNotFound is returned for anyone else. Images, albums and
+// collaborators belong to the gallery, so they move with it. The transfer is
+// recorded in the audit log.
+func (service *TransferService) Accept(token string, user *User) (*Transfer, error) {
+	transfer, err := service.Transfer(token)
+	if err != nil {
+		return nil, fmt.Errorf("accept transfer: %w", err)
+	}
+	if transfer.ToUserID != user.ID {
+		return nil, fmt.Errorf("accept transfer: %w", ErrNotFound)
+	}
+	tx, err := service.DB.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("accept transfer: %w", err)
+	}
+	defer tx.Rollback()
+	// Deleting the transfer first makes sure it is only used once.
+	result, err := tx.Exec(`
+	delete from gallery_transfers
+	where id = $1 and token_hash = $2;`, transfer.ID, transfer.TokenHash)
+	if err != nil {
+		return nil, fmt.Errorf("accept transfer: %w", err)
+	}
+	if n, err := result.RowsAffected(); err != nil || n == 0 {
+		return nil, fmt.Errorf("accept transfer: %w", ErrNotFound)
+	}
+	// The gallery has to still belong to whoever started the transfer.
+	result, err = tx.Exec(`
+	update galleries
+	set user_id = $2
+	where id = $1 and user_id = $3 and organization_id is null;`, transfer.GalleryID,
+		transfer.ToUserID, transfer.FromUserID)
+	if err != nil {
+		return nil, fmt.Errorf("accept transfer: %w", err)
+	}
+	if n, err := result.RowsAffected(); err != nil || n == 0 {
+		return nil, fmt.Errorf("accept transfer: %w", ErrNotFound)
+	}
+	_, err = tx.Exec(`
+	update galleries
+	set user_id = $2
+	where root_id = $1;`, transfer.GalleryID, transfer.ToUserID)
+	if err != nil {
+		return nil, fmt.Errorf("accept transfer: %w", err)
+	}
+	// The new owner doesn't need a role of their own anymore.
+	_, err = tx.Exec(`
+	delete from gallery_collaborators
+	where gallery_id = $1 and user_id = $2;`, transfer.GalleryID, transfer.ToUserID)
+	if err != nil {
+		return nil, fmt.Errorf("accept transfer: %w", err)
+	}
+	err = recordAudit(tx, AuditEntry{
+		Action:    AuditGalleryTransferred,
+		ActorID:   transfer.ToUserID,
+		GalleryID: transfer.GalleryID,
+		Details: map[string]string{
+			"from_email": transfer.FromEmail,
+			"to_email":   transfer.ToEmail,
+			"title":      transfer.GalleryTitle,
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("accept transfer: %w", err)
+	}
+	err = tx.Commit()
+	if err != nil {
+		return nil, fmt.Errorf("accept transfer: %w", err)
+	}
+	return transfer, nil
+}
+
+// Cancel cancels the transfer of a gallery, so it can't be accepted anymore.
+func (service *TransferService) Cancel(galleryID int) error {
+	_, err := service.DB.Exec(`
+	delete from gallery_transfers
+	where gallery_id = $1;`, galleryID)
+	if err != nil {
+		return fmt.Errorf("cancel transfer: %w", err)
+	}
+	return nil
+}
+
+// query looks up the transfer matching where, which is passed a single
+// argument.
+func (service *TransferService) query(where string, arg any) (*Transfer, error) {
+	var transfer Transfer
+	row := service.DB.QueryRow(`
+	select gallery_transfers.id, gallery_transfers.gallery_id, galleries.title,
+		gallery_transfers.from_user_id, from_users.email,
+		gallery_transfers.to_user_id, to_users.email,
+		gallery_transfers.token_hash, gallery_transfers.expires_at
+	from gallery_transfers
+	join galleries on galleries.id = gallery_transfers.gallery_id
+	join users from_users on from_users.id = gallery_transfers.from_user_id
+	join users to_users on to_users.id = gallery_transfers.to_user_id
+	where `+where+`;`, arg)
+	err := row.Scan(&transfer.ID, &transfer.GalleryID, &transfer.GalleryTitle,
+		&transfer.FromUserID, &transfer.FromEmail, &transfer.ToUserID, &transfer.ToEmail,
+		&transfer.TokenHash, &transfer.ExpiresAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+	return &transfer, nil
+}
+
+func (service *TransferService) hash(token string) string {
+	tokenHash := sha256.Sum256([]byte(token))
+	return base64.URLEncoding.EncodeToString(tokenHash[:])
+}
@@ -0,0 +1,413 @@
+package models
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/Pupsichekk/lenslocked/rand"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	// DefaultTwoFactorIssuer names the site in authenticator apps when
+	// TwoFactorService doesn't specify its own Issuer.
+	DefaultTwoFactorIssuer = "Lenslocked"
+	// DefaultChallengeDuration is how long users have to enter their code
+	// after their password when TwoFactorService doesn't specify its own.
+	DefaultChallengeDuration = 5 * time.Minute
+	// RecoveryCodeCount is how many recovery codes users get when enabling
+	// two-factor authentication.
+	RecoveryCodeCount = 10
+	// recoveryCodeLength is the number of characters of a recovery code,
+	// not counting the dash in the middle.
+	recoveryCodeLength = 10
+)
+
+var (
+	ErrTwoFactorEnabled = errors.New("models: two-factor authentication is already enabled")
+	ErrInvalidCode      = errors.New("models: invalid two-factor authentication code")
+)
+
+// Enrollment is what users need to add their account to an authenticator
+// app.
+type Enrollment struct {
+	Secret string
+	// URL is the otpauth URL the QR code for the app holds.
+	URL string
+}
+
+// TwoFactorChallenge is a sign in waiting for a two-factor authentication
+// code after the password was entered.
+type TwoFactorChallenge struct {
+	ID       int
+	UserID   int
+	Remember bool
+	// Token is only set when starting a new challenge, only its hash is
+	// stored.
+	Token     string
+	TokenHash string
+	ExpiresAt time.Time
+}
+
+type TwoFactorService struct {
+	DB *sql.DB
+	// Issuer names the site in authenticator apps. Defaults to
+	// DefaultTwoFactorIssuer.
+	Issuer string
+	// BytesPerToken is used to determine how many bytes are used to generate
+	// challenge tokens. If specified bytes are less than MinBytesPerToken
+	// MinBytesPerToken will be used instead.
+	BytesPerToken int
+	// ChallengeDuration is how long users have to enter their code. Defaults
+	// to DefaultChallengeDuration.
+	ChallengeDuration time.Duration
+}
+
+// Enabled reports whether a user needs a code to sign in.
+func (service *TwoFactorService) Enabled(userID int) (bool, error) {
+	var enabled bool
+	err := service.DB.QueryRow(`
+	select exists (
+		select 1
+		from two_factor
+		where user_id = $1 and enabled_at is not null
+	);`, userID).Scan(&enabled)
+	if err != nil {
+		return false, fmt.Errorf("two-factor enabled: %w", err)
+	}
+	return enabled, nil
+}
+
+// Enroll returns the secret user needs to add to their authenticator app
+// before enabling two-factor authentication. The same secret is returned
+// until it is enabled, so the QR code doesn't change on every page load.
+// ErrTwoFactorEnabled is returned if it already is.
+func (service *TwoFactorService) Enroll(user *User) (*Enrollment, error) {
+	secret, err := newTOTPSecret()
+	if err != nil {
+		return nil, fmt.Errorf("enroll two-factor: %w", err)
+	}
+	_, err = service.DB.Exec(`
+	insert into two_factor (user_id, secret)
+	values ($1, $2) on conflict (user_id) do nothing;`, user.ID, secret)
+	if err != nil {
+		return nil, fmt.Errorf("enroll two-factor: %w", err)
+	}
+	var enabledAt sql.NullTime
+	err = service.DB.QueryRow(`
+	select secret, enabled_at
+	from two_factor
+	where user_id = $1;`, user.ID).Scan(&secret, &enabledAt)
+	if err != nil {
+		return nil, fmt.Errorf("enroll two-factor: %w", err)
+	}
+	if enabledAt.Valid {
+		return nil, fmt.Errorf("enroll two-factor: %w", ErrTwoFactorEnabled)
+	}
+	issuer := service.Issuer
+	if issuer == "" {
+		issuer = DefaultTwoFactorIssuer
+	}
+	return &Enrollment{
+		Secret: secret,
+		URL:    totpURL(issuer, user.Email, secret),
+	}, nil
+}
+
+// Enable turns on two-factor authentication for a user once they entered a
+// code from their app, proving it was set up right. The recovery codes
+// returned can each be used once instead of a code, they can't be looked up
+// again. ErrInvalidCode is returned if the code is wrong.
+func (service *TwoFactorService) Enable(userID int, code string) ([]string, error) {
+	tx, err := service.DB.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("enable two-factor: %w", err)
+	}
+	defer tx.Rollback()
+	var secret string
+	var enabledAt sql.NullTime
+	err = tx.QueryRow(`
+	select secret, enabled_at
+	from two_factor
+	where user_id = $1
+	for update;`, userID).Scan(&secret, &enabledAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("enable two-factor: %w", ErrNotFound)
+		}
+		return nil, fmt.Errorf("enable two-factor: %w", err)
+	}
+	if enabledAt.Valid {
+		return nil, fmt.Errorf("enable two-factor: %w", ErrTwoFactorEnabled)
+	}
+	step, ok := matchTOTP(secret, code, time.Now())
+	if !ok {
+		return nil, fmt.Errorf("enable two-factor: %w", ErrInvalidCode)
+	}
+	_, err = tx.Exec(`
+	update two_factor
+	set enabled_at = now(), last_step = $2
+	where user_id = $1;`, userID, step)
+	if err != nil {
+		return nil, fmt.Errorf("enable two-factor: %w", err)
+	}
+	_, err = tx.Exec(`
+	delete from recovery_codes
+	where user_id = $1;`, userID)
+	if err != nil {
+		return nil, fmt.Errorf("enable two-factor: %w", err)
+	}
+	var codes []string
+	for i := 0; i < RecoveryCodeCount; i++ {
+		code, err := newRecoveryCode()
+		if err != nil {
+			return nil, fmt.Errorf("enable two-factor: %w", err)
+		}
+		codeHash, err := hashRecoveryCode(code)
+		if err != nil {
+			return nil, fmt.Errorf("enable two-factor: %w", err)
+		}
+		_, err = tx.Exec(`
+		insert into recovery_codes (user_id, code_hash)
+		values ($1, $2);`, userID, codeHash)
+		if err != nil {
+			return nil, fmt.Errorf("enable two-factor: %w", err)
+		}
+		codes = append(codes, code)
+	}
+	err = tx.Commit()
+	if err != nil {
+		return nil, fmt.Errorf("enable two-factor: %w", err)
+	}
+	return codes, nil
+}
+
+// Verify checks a code a user entered to sign in. Both codes from their app
+// and unused recovery codes are accepted, and neither can be used twice.
+// ErrInvalidCode is returned if the code is wrong.
+func (service *TwoFactorService) Verify(userID int, code string) error {
+	var secret string
+	err := service.DB.QueryRow(`
+	select secret
+	from two_factor
+	where user_id = $1 and enabled_at is not null;`, userID).Scan(&secret)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return fmt.Errorf("verify two-factor: %w", ErrNotFound)
+		}
+		return fmt.Errorf("verify two-factor: %w", err)
+	}
+	if step, ok := matchTOTP(secret, code, time.Now()); ok {
+		result, err := service.DB.Exec(`
+		update two_factor
+		set last_step = $2
+		where user_id = $1 and last_step < $2;`, userID, step)
+		if err != nil {
+			return fmt.Errorf("verify two-factor: %w", err)
+		}
+		if n, err := result.RowsAffected(); err != nil || n == 0 {
+			return fmt.Errorf("verify two-factor: code already used: %w", ErrInvalidCode)
+		}
+		return nil
+	}
+	code = normalizeRecoveryCode(code)
+	if len(code) != recoveryCodeLength {
+		return fmt.Errorf("verify two-factor: %w", ErrInvalidCode)
+	}
+	// Recovery codes are hashed with bcrypt, so they can't be looked up by
+	// their hash. Users only have a few, each is compared.
+	rows, err := service.DB.Query(`
+	select id, code_hash
+	from recovery_codes
+	where user_id = $1 and used_at is null;`, userID)
+	if err != nil {
+		return fmt.Errorf("verify two-factor: %w", err)
+	}
+	defer rows.Close()
+	id := 0
+	for rows.Next() {
+		var codeID int
+		var codeHash string
+		err = rows.Scan(&codeID, &codeHash)
+		if err != nil {
+			return fmt.Errorf("verify two-factor: %w", err)
+		}
+		if bcrypt.CompareHashAndPassword([]byte(codeHash), []byte(code)) == nil {
+			id = codeID
+			break
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("verify two-factor: %w", err)
+	}
+	rows.Close()
+	if id == 0 {
+		return fmt.Errorf("verify two-factor: %w", ErrInvalidCode)
+	}
+	result, err := service.DB.Exec(`
+	update recovery_codes
+	set used_at = now()
+	where id = $1 and used_at is null;`, id)
+	if err != nil {
+		return fmt.Errorf("verify two-factor: %w", err)
+	}
+	if n, err := result.RowsAffected(); err != nil || n == 0 {
+		return fmt.Errorf("verify two-factor: code already used: %w", ErrInvalidCode)
+	}
+	return nil
+}
+
+// RecoveryCodesLeft returns how many recovery codes of a user weren't used
+// yet.
+func (service *TwoFactorService) RecoveryCodesLeft(userID int) (int, error) {
+	var n int
+	err := service.DB.QueryRow(`
+	select count(*)
+	from recovery_codes
+	where user_id = $1 and used_at is null;`, userID).Scan(&n)
+	if err != nil {
+		return 0, fmt.Errorf("recovery codes left: %w", err)
+	}
+	return n, nil
+}
+
+// Disable turns off two-factor authentication for a user, forgetting their
+// secret and recovery codes. Enabling it again needs a new secret.
+func (service *TwoFactorService) Disable(userID int) error {
+	tx, err := service.DB.Begin()
+	if err != nil {
+		return fmt.Errorf("disable two-factor: %w", err)
+	}
+	defer tx.Rollback()
+	_, err = tx.Exec(`
+	delete from recovery_codes
+	where user_id = $1;`, userID)
+	if err != nil {
+		return fmt.Errorf("disable two-factor: %w", err)
+	}
+	_, err = tx.Exec(`
+	delete from two_factor
+	where user_id = $1;`, userID)
+	if err != nil {
+		return fmt.Errorf("disable two-factor: %w", err)
+	}
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("disable two-factor: %w", err)
+	}
+	return nil
+}
+
+// StartChallenge starts the second step of signing in a user who entered
+// their password. Challenges of other sign ins that expired are cleaned up
+// along the way.
+func (service *TwoFactorService) StartChallenge(userID int, remember bool) (*TwoFactorChallenge, error) {
+	bytesPerToken := service.BytesPerToken
+	if bytesPerToken < MinBytesPerToken {
+		bytesPerToken = MinBytesPerToken
+	}
+	token, err := rand.String(bytesPerToken)
+	if err != nil {
+		return nil, fmt.Errorf("start two-factor challenge: %w", err)
+	}
+	duration := service.ChallengeDuration
+	if duration <= 0 {
+		duration = DefaultChallengeDuration
+	}
+	challenge := TwoFactorChallenge{
+		UserID:    userID,
+		Remember:  remember,
+		Token:     token,
+		TokenHash: service.hash(token),
+		ExpiresAt: time.Now().Add(duration),
+	}
+	_, err = service.DB.Exec(`
+	delete from two_factor_challenges
+	where expires_at <= now();`)
+	if err != nil {
+		return nil, fmt.Errorf("start two-factor challenge: %w", err)
+	}
+	row := service.DB.QueryRow(`
+	insert into two_factor_challenges (user_id, token_hash, remember, expires_at)
+	values ($1, $2, $3, $4)
+	returning id;`, challenge.UserID, challenge.TokenHash, challenge.Remember, challenge.ExpiresAt)
+	err = row.Scan(&challenge.ID)
+	if err != nil {
+		return nil, fmt.Errorf("start two-factor challenge: %w", err)
+	}
+	return &challenge, nil
+}
+
+// Challenge looks up the challenge with the given token. ErrLinkExpired is
+// returned if it took too long to enter the code, ErrNotFound if there is no
+// such challenge.
+func (service *TwoFactorService) Challenge(token string) (*TwoFactorChallenge, error) {
+	challenge := TwoFactorChallenge{
+		TokenHash: service.hash(token),
+	}
+	row := service.DB.QueryRow(`
+	select id, user_id, remember, expires_at
+	from two_factor_challenges
+	where token_hash = $1;`, challenge.TokenHash)
+	err := row.Scan(&challenge.ID, &challenge.UserID, &challenge.Remember, &challenge.ExpiresAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("query two-factor challenge: %w", ErrNotFound)
+		}
+		return nil, fmt.Errorf("query two-factor challenge: %w", err)
+	}
+	if !time.Now().Before(challenge.ExpiresAt) {
+		return nil, fmt.Errorf("query two-factor challenge: %w", ErrLinkExpired)
+	}
+	return &challenge, nil
+}
+
+// DeleteChallenge deletes a challenge once the code was entered, so it can't
+// be used to sign in again.
+func (service *TwoFactorService) DeleteChallenge(id int) error {
+	_, err := service.DB.Exec(`
+	delete from two_factor_challenges
+	where id = $1;`, id)
+	if err != nil {
+		return fmt.Errorf("delete two-factor challenge: %w", err)
+	}
+	return nil
+}
+
+func (service *TwoFactorService) hash(token string) string {
+	tokenHash := sha256.Sum256([]byte(token))
+	return base64.URLEncoding.EncodeToString(tokenHash[:])
+}
+
+// newRecoveryCode returns a random recovery code like "abcde-fghij".
+func newRecoveryCode() (string, error) {
+	b, err := rand.Bytes(recoveryCodeLength * 5 / 8)
+	if err != nil {
+		return "", fmt.Errorf("new recovery code: %w", err)
+	}
+	code := strings.ToLower(totpEncoding.EncodeToString(b))
+	half := recoveryCodeLength / 2
+	return code[:half] + "-" + code[half:], nil
+}
+
+// normalizeRecoveryCode returns a recovery code the way it is hashed, so
+// case, dashes and spaces don't matter when entering it.
+func normalizeRecoveryCode(code string) string {
+	code = strings.ToLower(code)
+	return strings.NewReplacer("-", "", " ", "").Replace(code)
+}
+
+// hashRecoveryCode hashes a recovery code with bcrypt, like passwords, so
+// codes can't be recovered from a leaked database.
+func hashRecoveryCode(code string) (string, error) {
+	codeHash, err := bcrypt.GenerateFromPassword([]byte(normalizeRecoveryCode(code)), bcrypt.DefaultCost)
+	if err != nil {
+		return "", fmt.Errorf("hash recovery code: %w", err)
+	}
+	return string(codeHash), nil
+}
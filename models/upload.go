@@ -0,0 +1,320 @@
+package models
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/Pupsichekk/lenslocked/rand"
+)
+
+const (
+	// DefaultMaxUploadSize is the largest file that can be uploaded in
+	// parts when an UploadService doesn't specify its own MaxSize.
+	DefaultMaxUploadSize = 100 << 20
+	// DefaultUploadExpiry is how long an upload can go without receiving
+	// a part when an UploadService doesn't specify its own Expiry.
+	DefaultUploadExpiry = 24 * time.Hour
+
+	bytesPerUploadID = 18
+)
+
+var (
+	ErrUploadOffset = errors.New("models: upload offset does not match")
+	ErrUploadSize   = errors.New("models: upload exceeds its length")
+)
+
+// Upload is a file that is uploaded to a gallery in several parts, so the
+// upload can be resumed after a dropped connection.
+type Upload struct {
+	ID        string
+	GalleryID int
+	UserID    int
+	Filename  string
+	// Length is the size of the whole file, in bytes.
+	Length int64
+	// Offset is the number of bytes that were received so far.
+	Offset    int64
+	CreatedAt time.Time
+	// ExpiresAt is when the upload is abandoned unless another part is
+	// received before.
+	ExpiresAt time.Time
+}
+
+// Complete reports whether every byte of the upload has been received.
+func (upload *Upload) Complete() bool {
+	return upload.Offset == upload.Length
+}
+
+type UploadService struct {
+	DB *sql.DB
+	// Storage keeps the received parts until the upload is complete, if not
+	// set, value is defaulted to a LocalStorage in the images directory.
+	Storage Storage
+	// MaxSize is the largest file, in bytes, that can be uploaded. Defaults
+	// to DefaultMaxUploadSize
+	MaxSize int64
+	// Expiry is how long an upload can go without receiving a part before it
+	// is abandoned. Defaults to DefaultUploadExpiry.
+	Expiry time.Duration
+}
+
+func (service *UploadService) Create(galleryID, userID int, filename string, length int64) (*Upload, error) {
+	if length < 0 {
+		return nil, fmt.Errorf("create upload: invalid length")
+	}
+	if length > service.SizeLimit() {
+		return nil, fmt.Errorf("create upload: %w", ErrUploadSize)
+	}
+	id, err := rand.String(bytesPerUploadID)
+	if err != nil {
+		return nil, fmt.Errorf("create upload: %w", err)
+	}
+	upload := Upload{
+		ID:        id,
+		GalleryID: galleryID,
+		UserID:    userID,
+		Filename:  filename,
+		Length:    length,
+		ExpiresAt: service.expiresAt(),
+	}
+	row := service.DB.QueryRow(`
+	insert into uploads (id, gallery_id, user_id, filename, length, expires_at)
+	values ($1, $2, $3, $4, $5, $6)
+	returning created_at;`, upload.ID, upload.GalleryID, upload.UserID,
+		upload.Filename, upload.Length, upload.ExpiresAt)
+	err = row.Scan(&upload.CreatedAt)
+	if err != nil {
+		return nil, fmt.Errorf("create upload: %w", err)
+	}
+	return &upload, nil
+}
+
+// ByID looks up an upload of a gallery. ErrNotFound is returned if there is
+// no such upload, or if it expired.
+func (service *UploadService) ByID(galleryID int, id string) (*Upload, error) {
+	upload := Upload{
+		ID:        id,
+		GalleryID: galleryID,
+	}
+	row := service.DB.QueryRow(`
+	select user_id, filename, length, upload_offset, created_at, expires_at
+	from uploads
+	where id = $1 and gallery_id = $2;`, id, galleryID)
+	err := row.Scan(&upload.UserID, &upload.Filename, &upload.Length,
+		&upload.Offset, &upload.CreatedAt, &upload.ExpiresAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("upload by id: %w", err)
+	}
+	// Expired uploads wait for DeleteExpired, but can't be resumed.
+	if !time.Now().Before(upload.ExpiresAt) {
+		return nil, ErrNotFound
+	}
+	return &upload, nil
+}
+
+// Append stores the bytes read from r as the part of upload starting at
+// offset, which has to match the number of bytes received so far. If reading
+// from r fails part way, the bytes read up to that point are kept, so the
+// client can resume from there.
+func (service *UploadService) Append(upload *Upload, offset int64, r io.Reader) error {
+	if offset != upload.Offset {
+		return ErrUploadOffset
+	}
+	// Buffer the part on disk first, so the upload isn't locked while the
+	// client is still sending it.
+	tmp, err := os.CreateTemp("", "lenslocked-upload-*")
+	if err != nil {
+		return fmt.Errorf("append upload: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	remaining := upload.Length - upload.Offset
+	n, readErr := io.Copy(tmp, io.LimitReader(r, remaining+1))
+	if n > remaining {
+		return ErrUploadSize
+	}
+	if n == 0 {
+		if readErr != nil {
+			return fmt.Errorf("append upload: %w", readErr)
+		}
+		return nil
+	}
+	_, err = tmp.Seek(0, io.SeekStart)
+	if err != nil {
+		return fmt.Errorf("append upload: %w", err)
+	}
+
+	tx, err := service.DB.Begin()
+	if err != nil {
+		return fmt.Errorf("append upload: %w", err)
+	}
+	defer tx.Rollback()
+	var current int64
+	row := tx.QueryRow(`
+	select upload_offset
+	from uploads
+	where id = $1
+	for update;`, upload.ID)
+	err = row.Scan(&current)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrNotFound
+		}
+		return fmt.Errorf("append upload: %w", err)
+	}
+	// Another request appended to the upload in the meantime.
+	if current != offset {
+		return ErrUploadOffset
+	}
+	err = service.storage().Put(service.partKey(upload.ID, offset), tmp)
+	if err != nil {
+		return fmt.Errorf("append upload: %w", err)
+	}
+	// Every part received gives the client more time to send the next one.
+	expiresAt := service.expiresAt()
+	_, err = tx.Exec(`
+	update uploads
+	set upload_offset = $2, expires_at = $3
+	where id = $1;`, upload.ID, offset+n, expiresAt)
+	if err != nil {
+		return fmt.Errorf("append upload: %w", err)
+	}
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("append upload: %w", err)
+	}
+	upload.Offset = offset + n
+	upload.ExpiresAt = expiresAt
+	if readErr != nil {
+		return fmt.Errorf("append upload: %w", readErr)
+	}
+	return nil
+}
+
+// Open joins the received parts of a complete upload into a temporary file.
+// Callers need to close the file and remove it once they are done with it.
+func (service *UploadService) Open(upload *Upload) (*os.File, error) {
+	if !upload.Complete() {
+		return nil, fmt.Errorf("open upload: upload is not complete")
+	}
+	keys, err := service.storage().List(service.partPrefix(upload.ID))
+	if err != nil {
+		return nil, fmt.Errorf("open upload: %w", err)
+	}
+	tmp, err := os.CreateTemp("", "lenslocked-upload-*")
+	if err != nil {
+		return nil, fmt.Errorf("open upload: %w", err)
+	}
+	// Part keys are zero padded offsets, so they sort in upload order.
+	sort.Strings(keys)
+	for _, key := range keys {
+		err = service.copyPart(tmp, key)
+		if err != nil {
+			tmp.Close()
+			os.Remove(tmp.Name())
+			return nil, fmt.Errorf("open upload: %w", err)
+		}
+	}
+	_, err = tmp.Seek(0, io.SeekStart)
+	if err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return nil, fmt.Errorf("open upload: %w", err)
+	}
+	return tmp, nil
+}
+
+func (service *UploadService) Delete(upload *Upload) error {
+	_, err := service.DB.Exec(`
+	delete from uploads
+	where id = $1;`, upload.ID)
+	if err != nil {
+		return fmt.Errorf("delete upload: %w", err)
+	}
+	err = service.storage().DeletePrefix(service.partPrefix(upload.ID))
+	if err != nil {
+		return fmt.Errorf("delete upload: %w", err)
+	}
+	return nil
+}
+
+// DeleteExpired deletes all uploads that expired along with the parts they
+// received, returning how many there were.
+func (service *UploadService) DeleteExpired() (int64, error) {
+	rows, err := service.DB.Query(`
+	delete from uploads
+	where expires_at <= now()
+	returning id;`)
+	if err != nil {
+		return 0, fmt.Errorf("delete expired uploads: %w", err)
+	}
+	defer rows.Close()
+	var ids []string
+	for rows.Next() {
+		var id string
+		err = rows.Scan(&id)
+		if err != nil {
+			return 0, fmt.Errorf("delete expired uploads: %w", err)
+		}
+		ids = append(ids, id)
+	}
+	if err := rows.Err(); err != nil {
+		return 0, fmt.Errorf("delete expired uploads: %w", err)
+	}
+	for _, id := range ids {
+		err = service.storage().DeletePrefix(service.partPrefix(id))
+		if err != nil {
+			return 0, fmt.Errorf("delete expired uploads: %w", err)
+		}
+	}
+	return int64(len(ids)), nil
+}
+
+func (service *UploadService) copyPart(w io.Writer, key string) error {
+	obj, err := service.storage().Get(key)
+	if err != nil {
+		return err
+	}
+	defer obj.Close()
+	_, err = io.Copy(w, obj)
+	return err
+}
+
+// SizeLimit returns the largest file, in bytes, that can be uploaded.
+func (service *UploadService) SizeLimit() int64 {
+	if service.MaxSize <= 0 {
+		return DefaultMaxUploadSize
+	}
+	return service.MaxSize
+}
+
+func (service *UploadService) expiresAt() time.Time {
+	expiry := service.Expiry
+	if expiry <= 0 {
+		expiry = DefaultUploadExpiry
+	}
+	return time.Now().Add(expiry)
+}
+
+func (service *UploadService) storage() Storage {
+	if service.Storage == nil {
+		return &LocalStorage{}
+	}
+	return service.Storage
+}
+
+func (service *UploadService) partPrefix(id string) string {
+	return "uploads/" + id + "/"
+}
+
+func (service *UploadService) partKey(id string, offset int64) string {
+	return fmt.Sprintf("%s%020d", service.partPrefix(id), offset)
+}
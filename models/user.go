@@ -70,18 +70,69 @@ func (us *UserService) Authenticate(email, password string) (*User, error) {
 	return &user, nil
 }
 
+// UpdatePassword changes the password of a user, signs them out of all their
+// sessions and removes their passkeys, so whoever knew the old password,
+// stole a session or added a passkey is locked out. Callers start a new
+// session for the user if they need one.
 func (us *UserService) UpdatePassword(userID int, password string) error {
 	hashedBytes, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
 	if err != nil {
 		return fmt.Errorf("update password: %w", err)
 	}
 	passwordHash := string(hashedBytes)
-	_, err = us.DB.Exec(`
+	tx, err := us.DB.Begin()
+	if err != nil {
+		return fmt.Errorf("update password: %w", err)
+	}
+	defer tx.Rollback()
+	_, err = tx.Exec(`
 	UPDATE users
 	SET password_hash = $2
 	WHERE id = $1;`, userID, passwordHash)
 	if err != nil {
 		return fmt.Errorf("update password: %w", err)
 	}
+	_, err = tx.Exec(`
+	DELETE FROM sessions
+	WHERE user_id = $1;`, userID)
+	if err != nil {
+		return fmt.Errorf("update password: %w", err)
+	}
+	_, err = tx.Exec(`
+	DELETE FROM passkeys
+	WHERE user_id = $1;`, userID)
+	if err != nil {
+		return fmt.Errorf("update password: %w", err)
+	}
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("update password: %w", err)
+	}
+	return nil
+}
+
+// StripsMetadata reports whether the user wants private metadata removed
+// from the images of their galleries before they are served to visitors.
+func (us *UserService) StripsMetadata(userID int) (bool, error) {
+	var strip bool
+	row := us.DB.QueryRow(`
+	SELECT strip_metadata
+	FROM users
+	WHERE id = $1;`, userID)
+	err := row.Scan(&strip)
+	if err != nil {
+		return false, fmt.Errorf("strips metadata: %w", err)
+	}
+	return strip, nil
+}
+
+func (us *UserService) UpdateStripMetadata(userID int, strip bool) error {
+	_, err := us.DB.Exec(`
+	UPDATE users
+	SET strip_metadata = $2
+	WHERE id = $1;`, userID, strip)
+	if err != nil {
+		return fmt.Errorf("update strip metadata: %w", err)
+	}
 	return nil
 }
@@ -2,5 +2,5 @@ package templates
 
 import "embed"
 
-//go:embed *.gohtml galleries/*.gohtml
+//go:embed *.gohtml galleries/*.gohtml organizations/*.gohtml
 var FS embed.FS